@@ -1,20 +1,44 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mackeper/m_backuper/internal/backup"
 	"github.com/mackeper/m_backuper/internal/config"
 	"github.com/mackeper/m_backuper/internal/copier"
 	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/pathutil"
+	"github.com/mackeper/m_backuper/internal/prune"
+	"github.com/mackeper/m_backuper/internal/rebuild"
+	"github.com/mackeper/m_backuper/internal/restore"
 	"github.com/mackeper/m_backuper/internal/scanner"
 	"github.com/mackeper/m_backuper/internal/state"
+	"github.com/mackeper/m_backuper/internal/verify"
 )
 
-var globalConfigPath string
+// exitVerifyFailed is returned by verify when problems were found, so cron
+// jobs can tell a damaged backup apart from a run that couldn't start
+const exitVerifyFailed = 2
+
+// exitInterrupted is returned when a backup was stopped by SIGINT or SIGTERM
+// after saving its progress, following the shell's 128+SIGINT convention
+const exitInterrupted = 130
+
+var (
+	globalConfigPath string
+	globalStatePath  string
+)
 
 func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
@@ -24,6 +48,7 @@ func main() {
 
 	// Global flags
 	flag.StringVar(&globalConfigPath, "config", "", "Path to config file")
+	flag.StringVar(&globalStatePath, "state", "", "Path to state file")
 	flag.Parse()
 
 	if flag.NArg() < 1 {
@@ -36,8 +61,18 @@ func main() {
 	switch command {
 	case "backup":
 		backupCmd(flag.Args()[1:])
+	case "restore":
+		restoreCmd(flag.Args()[1:])
+	case "verify":
+		verifyCmd(flag.Args()[1:])
+	case "snapshots":
+		snapshotsCmd(flag.Args()[1:])
+	case "prune":
+		pruneCmd(flag.Args()[1:])
 	case "status":
 		statusCmd(flag.Args()[1:])
+	case "state":
+		stateCmd(flag.Args()[1:])
 	case "config":
 		configCmd(flag.Args()[1:])
 	case "init":
@@ -53,14 +88,20 @@ func printUsage() {
 	fmt.Println("m_backuper - Incremental backup tool")
 	fmt.Println()
 	fmt.Println("Usage:")
-	fmt.Println("  m_backuper [-config path] <command> [options]")
+	fmt.Println("  m_backuper [-config path] [-state path] <command> [options]")
 	fmt.Println()
 	fmt.Println("Global flags:")
 	fmt.Println("  -config string    Path to config file (default: ~/.config/m_backuper/config.json)")
+	fmt.Println("  -state string     Path to state file (default: one per destination in ~/.config/m_backuper/state)")
 	fmt.Println()
 	fmt.Println("Commands:")
 	fmt.Println("  backup    Run backup")
+	fmt.Println("  restore   Restore files from the backup root")
+	fmt.Println("  verify    Check the backup root against the local state")
+	fmt.Println("  snapshots List the snapshots of a device")
+	fmt.Println("  prune     Remove snapshots not kept by the retention policy")
 	fmt.Println("  status    Show last backup time, file count")
+	fmt.Println("  state     Manage local state (state rebuild: recreate it from the backup root)")
 	fmt.Println("  config    Show current config (merged file + env)")
 	fmt.Println("  init      Generate default config file")
 }
@@ -72,13 +113,71 @@ func loadConfig() (config.Config, error) {
 	return config.Load()
 }
 
+// statePath returns the state file of the configured destination, unless
+// -state overrides it. Commands that write state adopt the legacy state
+// first, the others read it where it is.
+func statePath(cfg *config.Config, adopt bool) (string, error) {
+	if globalStatePath != "" {
+		return globalStatePath, nil
+	}
+	key, err := state.Key(cfg.Profile, cfg.BackupRoot, cfg.DeviceID)
+	if err != nil {
+		return "", err
+	}
+	path, err := state.PathFor(key, cfg.StateBackend)
+	if err != nil {
+		return "", err
+	}
+	if !adopt {
+		return state.ReadPath(path)
+	}
+	if err := state.AdoptLegacy(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// writeJSON writes v as indented JSON to path, or to stdout when path is "-"
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644) //nolint:gosec // reports are meant to be read by other tools
+}
+
+// openState opens the state of the configured destination. Commands that only
+// read it neither adopt the legacy state nor create or migrate a database.
+func openState(cfg *config.Config, readOnly bool) (state.Store, error) {
+	path, err := statePath(cfg, !readOnly)
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		return state.OpenReadOnly(cfg.StateBackend, path)
+	}
+	return state.Open(cfg.StateBackend, path)
+}
+
 func backupCmd(args []string) {
 	fs := flag.NewFlagSet("backup", flag.ExitOnError)
 	dryRun := fs.Bool("dry-run", false, "Show files that would be backed up without copying")
+	report := fs.String("report", "", "Write a JSON summary of the run to this file (- for stdout)")
 	if err := fs.Parse(args); err != nil {
 		slog.Error("failed to parse flags", "error", err)
 		os.Exit(1)
 	}
+	// Messages stay out of the way of a report on stdout
+	out := os.Stdout
+	if *report == "-" {
+		out = os.Stderr
+		logToStderr()
+	}
 
 	// Load configuration
 	cfg, err := loadConfig()
@@ -94,10 +193,21 @@ func backupCmd(args []string) {
 		return
 	}
 
+	ctx, stop := interruptContext()
+	defer stop()
+
 	if *dryRun {
 		slog.Info("running dry-run scan")
-		s := scanner.New(cfg.FilesToIgnorePatterns)
-		files, err := s.ScanDryRun(cfg.PathsToBackup)
+		s, err := newScanner(&cfg)
+		if err != nil {
+			slog.Error("invalid scanner config", "error", err)
+			os.Exit(1)
+		}
+		s.SetOrdered(true)
+		files, err := s.ScanDryRun(ctx, cfg.Paths())
+		if errors.Is(err, context.Canceled) {
+			os.Exit(exitInterrupted)
+		}
 		if err != nil {
 			slog.Error("scan failed", "error", err)
 			os.Exit(1)
@@ -108,9 +218,21 @@ func backupCmd(args []string) {
 		slog.Info("starting backup")
 
 		// Create components
-		s := scanner.New(cfg.FilesToIgnorePatterns)
-		d := detector.NewSizeDetector()
-		c := copier.NewLocalCopier(cfg.BackupRoot)
+		s, err := newScanner(&cfg)
+		if err != nil {
+			slog.Error("invalid scanner config", "error", err)
+			os.Exit(1)
+		}
+		d, err := detector.New(cfg.ChangeDetection, cfg.HashAlgorithm)
+		if err != nil {
+			slog.Error("invalid change detection config", "error", err)
+			os.Exit(1)
+		}
+		c, err := newCopier(&cfg)
+		if err != nil {
+			slog.Error("failed to create copier", "error", err)
+			os.Exit(1)
+		}
 		defer func() {
 			if err := c.Close(); err != nil {
 				slog.Warn("failed to close copier", "error", err)
@@ -118,56 +240,675 @@ func backupCmd(args []string) {
 		}()
 
 		// Load state
-		st, err := state.Load()
+		st, err := openState(&cfg, false)
 		if err != nil {
 			slog.Error("failed to load state", "error", err)
 			return
 		}
+		defer closeState(st)
 
 		// Create and run backup
-		b := backup.New(s, d, c, st, cfg.DeviceID)
-		if err := b.Run(cfg.PathsToBackup, cfg.BackupRoot); err != nil {
+		b, err := newBackup(&cfg, s, d, c, st)
+		if err != nil {
+			slog.Error("invalid backup config", "error", err)
+			return
+		}
+		result, err := b.Run(ctx, cfg.Paths(), cfg.BackupRoot)
+		if *report != "" && result != nil {
+			if err := writeJSON(*report, result); err != nil {
+				slog.Error("failed to write report", "path", *report, "error", err)
+			}
+		}
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				fmt.Fprintln(out, "\nBackup interrupted, progress was saved. Run it again to continue.")
+				// os.Exit skips deferred calls, so close the state and copier first
+				closeState(st)
+				if err := c.Close(); err != nil {
+					slog.Warn("failed to close copier", "error", err)
+				}
+				os.Exit(exitInterrupted)
+			}
 			slog.Error("backup failed", "error", err)
 			return
 		}
 
-		fmt.Println("\nBackup completed successfully!")
-		fmt.Printf("Run 'm_backuper status' to see backup details.\n")
+		fmt.Fprintln(out, "\nBackup completed successfully!")
+		fmt.Fprintf(out, "Run 'm_backuper status' to see backup details.\n")
+	}
+}
+
+// newScanner creates a scanner reading scan_concurrency directories at a time
+// and applying the symlink, filesystem and exclusion settings and the rules of
+// each path to back up
+func newScanner(cfg *config.Config) (*scanner.Scanner, error) {
+	symlinks, err := scanner.ParseSymlinkPolicy(cfg.Symlinks)
+	if err != nil {
+		return nil, err
+	}
+	s := scanner.New(cfg.FilesToIgnorePatterns)
+	s.SetSymlinks(symlinks)
+	s.SetOneFileSystem(cfg.OneFileSystem)
+	s.SetExcludeCaches(cfg.ExcludeCaches)
+	s.SetExcludeMarkers(cfg.ExcludeMarkers)
+	s.SetWalkers(cfg.ScanConcurrency)
+	for _, p := range cfg.PathsToBackup {
+		s.SetRules(p.Path, scanner.Rules{
+			Include:  p.Include,
+			Exclude:  p.Exclude,
+			MaxDepth: p.MaxDepth,
+		})
+	}
+	return s, nil
+}
+
+// newBackup creates a backup configured from cfg
+func newBackup(cfg *config.Config, s *scanner.Scanner, d detector.ChangeDetector, c copier.Copier, st state.Store) (*backup.Backup, error) {
+	policy, err := backup.ParseDeletionPolicy(cfg.DeletionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	gracePeriod, err := time.ParseDuration(cfg.DeletionGracePeriod)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deletion grace period %q: %w", cfg.DeletionGracePeriod, err)
+	}
+	var checkpointInterval time.Duration
+	if cfg.CheckpointInterval != "" {
+		checkpointInterval, err = time.ParseDuration(cfg.CheckpointInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checkpoint interval %q: %w", cfg.CheckpointInterval, err)
+		}
+	}
+
+	b := backup.New(s, d, c, st, cfg.DeviceID)
+	for _, p := range cfg.PathsToBackup {
+		if p.ChangeDetection == "" {
+			continue
+		}
+		rootDetector, err := detector.New(p.ChangeDetection, cfg.HashAlgorithm)
+		if err != nil {
+			return nil, fmt.Errorf("invalid change detection for %s: %w", p.Path, err)
+		}
+		b.SetRootDetector(p.Path, rootDetector)
+	}
+	b.SetDeletionPolicy(policy, gracePeriod)
+	b.SetSnapshots(cfg.Snapshots)
+	b.SetPreserveMetadata(cfg.PreserveMetadata)
+	b.SetConcurrency(cfg.Concurrency)
+	b.SetCheckpoint(cfg.CheckpointFiles, checkpointInterval)
+	return b, nil
+}
+
+// interruptContext returns a context that is cancelled on the first SIGINT or
+// SIGTERM, so a run can save its progress. A second signal exits right away.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Warn("received signal, stopping after saving progress (send again to force exit)", "signal", sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		sig := <-signals
+		slog.Error("received second signal, exiting without saving", "signal", sig)
+		os.Exit(exitInterrupted)
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// newCopier picks the SMB copier for UNC backup roots and the local copier otherwise.
+// SMB shares can't hold POSIX metadata, so there it only goes to the sidecar.
+func newCopier(cfg *config.Config) (copier.Copier, error) {
+	if pathutil.IsUNCPath(cfg.BackupRoot) {
+		return copier.NewSMBCopier(cfg.BackupRoot, cfg.SMBUser, cfg.SMBPassword)
+	}
+	c := copier.NewLocalCopier(cfg.BackupRoot)
+	c.SetPreserveMetadata(cfg.PreserveMetadata)
+	return c, nil
+}
+
+func restoreCmd(args []string) {
+	os.Exit(runRestore(args))
+}
+
+// runRestore does the work of restoreCmd and returns its exit code, so the
+// deferred close of the copier runs before the process exits
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	deviceID := fs.String("device", "", "Device ID to restore from (default: configured device_id)")
+	snapshot := fs.String("snapshot", "", "Snapshot to restore from, or \"latest\" (default: latest when snapshots are enabled, else the mirror)")
+	pattern := fs.String("path", "", "Only restore original paths matching this prefix or glob")
+	target := fs.String("target", "", "Directory to restore into (default: original location)")
+	overwrite := fs.String("overwrite", string(restore.PolicySkip), "What to do with existing files: skip, overwrite or rename")
+	dryRun := fs.Bool("dry-run", false, "List files that would be restored without copying")
+	if err := fs.Parse(args); err != nil {
+		slog.Error("failed to parse flags", "error", err)
+		return 1
+	}
+
+	policy, err := restore.ParsePolicy(*overwrite)
+	if err != nil {
+		slog.Error("invalid overwrite policy", "error", err)
+		return 1
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		return 1
+	}
+
+	if *deviceID == "" {
+		*deviceID = cfg.DeviceID
+	}
+
+	c, err := newCopier(&cfg)
+	if err != nil {
+		slog.Error("failed to create copier", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := c.Close(); err != nil {
+			slog.Warn("failed to close copier", "error", err)
+		}
+	}()
+
+	restorer, ok := c.(copier.Restorer)
+	if !ok {
+		slog.Error("backup root does not support restore", "backup_root", cfg.BackupRoot)
+		return 1
+	}
+
+	snapshotName, err := resolveSnapshot(restorer, &cfg, *deviceID, *snapshot)
+	if err != nil {
+		slog.Error("failed to find snapshot", "error", err)
+		return 1
+	}
+
+	r := restore.New(restorer, cfg.BackupRoot)
+	opts := restore.Options{
+		DeviceID: *deviceID,
+		Snapshot: snapshotName,
+		Pattern:  *pattern,
+		Target:   *target,
+		Policy:   policy,
+		DryRun:   *dryRun,
+	}
+	if err := r.Run(opts); err != nil {
+		slog.Error("restore failed", "error", err)
+		return 1
+	}
+
+	if !*dryRun {
+		fmt.Println("\nRestore completed successfully!")
+	}
+	return 0
+}
+
+func verifyCmd(args []string) {
+	os.Exit(runVerify(args))
+}
+
+// runVerify does the work of verifyCmd and returns its exit code, so the
+// deferred calls close the state and copier before the process exits
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	samplePercent := fs.Float64("sample", 100, "Percentage of files to check (extra files are only reported at 100)")
+	checksums := fs.Bool("checksum", true, "Re-hash destination files that have a recorded digest")
+	if err := fs.Parse(args); err != nil {
+		slog.Error("failed to parse flags", "error", err)
+		return 1
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		return 1
+	}
+
+	st, err := openState(&cfg, true)
+	if err != nil {
+		slog.Error("failed to load state", "error", err)
+		return 1
+	}
+	defer closeState(st)
+
+	c, err := newCopier(&cfg)
+	if err != nil {
+		slog.Error("failed to create copier", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := c.Close(); err != nil {
+			slog.Warn("failed to close copier", "error", err)
+		}
+	}()
+
+	restorer, ok := c.(copier.Restorer)
+	if !ok {
+		slog.Error("backup root does not support verify", "backup_root", cfg.BackupRoot)
+		return 1
+	}
+
+	// State describes the last run, which is the latest snapshot in snapshot mode
+	snapshotName, err := resolveSnapshot(restorer, &cfg, cfg.DeviceID, "")
+	if err != nil {
+		slog.Error("failed to find snapshot", "error", err)
+		return 1
+	}
+
+	result, err := verify.New(restorer, st, cfg.BackupRoot, cfg.DeviceID).Run(verify.Options{
+		SamplePercent: *samplePercent,
+		Checksums:     *checksums,
+		Snapshot:      snapshotName,
+	})
+	if err != nil {
+		slog.Error("verify failed", "error", err)
+		return 1
+	}
+
+	fmt.Println("Verify Report:")
+	fmt.Println()
+	fmt.Printf("  Checked: %d of %d files\n", result.Checked, result.Total)
+	fmt.Printf("  OK: %d\n", result.OK)
+	fmt.Printf("  Missing: %d\n", len(result.Missing))
+	for _, p := range result.Missing {
+		fmt.Printf("    %s (expected %d bytes)\n", p.Path, p.Expected)
+	}
+	printProblems("Truncated", result.Truncated)
+	printProblems("Size mismatch", result.Mismatch)
+	printProblems("Checksum mismatch", result.Corrupt)
+	fmt.Printf("  Extra: %d\n", len(result.Extra))
+	for _, path := range result.Extra {
+		fmt.Printf("    %s\n", path)
+	}
+
+	if result.Failed() {
+		return exitVerifyFailed
+	}
+	return 0
+}
+
+// resolveSnapshot turns a -snapshot flag into a snapshot name. "latest", or an
+// empty flag when snapshots are enabled, reads the device's latest pointer.
+func resolveSnapshot(r copier.Restorer, cfg *config.Config, deviceID, name string) (string, error) {
+	if name == "" && !cfg.Snapshots {
+		return "", nil
+	}
+	if name != "" && name != backup.LatestFile {
+		return name, nil
+	}
+
+	latest, err := backup.LatestSnapshot(r, cfg.BackupRoot, deviceID)
+	if err != nil {
+		return "", err
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no snapshots found for device %s", deviceID)
+	}
+	return latest, nil
+}
+
+func snapshotsCmd(args []string) {
+	fs := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	deviceID := fs.String("device", "", "Device ID to list snapshots for (default: configured device_id)")
+	if err := fs.Parse(args); err != nil {
+		slog.Error("failed to parse flags", "error", err)
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+
+	if *deviceID == "" {
+		*deviceID = cfg.DeviceID
+	}
+
+	c, err := newCopier(&cfg)
+	if err != nil {
+		slog.Error("failed to create copier", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := c.Close(); err != nil {
+			slog.Warn("failed to close copier", "error", err)
+		}
+	}()
+
+	restorer, ok := c.(copier.Restorer)
+	if !ok {
+		slog.Error("backup root does not support listing snapshots", "backup_root", cfg.BackupRoot)
+		return
+	}
+
+	names, err := backup.ListSnapshots(restorer, cfg.BackupRoot, *deviceID)
+	if err != nil {
+		slog.Error("failed to list snapshots", "error", err)
+		return
+	}
+	latest, err := backup.LatestSnapshot(restorer, cfg.BackupRoot, *deviceID)
+	if err != nil {
+		slog.Warn("failed to read latest snapshot", "error", err)
+	}
+
+	fmt.Printf("Snapshots for %s: %d\n", *deviceID, len(names))
+	for _, name := range names {
+		if name == latest {
+			fmt.Printf("  %s (latest)\n", name)
+		} else {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+}
+
+func pruneCmd(args []string) {
+	os.Exit(runPrune(args))
+}
+
+// runPrune does the work of pruneCmd and returns its exit code, so the
+// deferred close of the copier runs before the process exits
+func runPrune(args []string) int {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	deviceID := fs.String("device", "", "Device ID to prune snapshots for (default: configured device_id)")
+	dryRun := fs.Bool("dry-run", false, "Print the plan without removing anything")
+	if err := fs.Parse(args); err != nil {
+		slog.Error("failed to parse flags", "error", err)
+		return 1
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		return 1
+	}
+
+	if *deviceID == "" {
+		*deviceID = cfg.DeviceID
+	}
+
+	policy := prune.Policy{
+		KeepLast:    cfg.Retention.KeepLast,
+		KeepDaily:   cfg.Retention.KeepDaily,
+		KeepWeekly:  cfg.Retention.KeepWeekly,
+		KeepMonthly: cfg.Retention.KeepMonthly,
+	}
+	if cfg.Retention.KeepWithin != "" {
+		if policy.KeepWithin, err = time.ParseDuration(cfg.Retention.KeepWithin); err != nil {
+			slog.Error("invalid retention keep_within", "value", cfg.Retention.KeepWithin, "error", err)
+			return 1
+		}
+	}
+
+	c, err := newCopier(&cfg)
+	if err != nil {
+		slog.Error("failed to create copier", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := c.Close(); err != nil {
+			slog.Warn("failed to close copier", "error", err)
+		}
+	}()
+
+	restorer, canRead := c.(copier.Restorer)
+	remover, canRemove := c.(copier.Remover)
+	if !canRead || !canRemove {
+		slog.Error("backup root does not support prune", "backup_root", cfg.BackupRoot)
+		return 1
+	}
+
+	plan, err := prune.New(restorer, remover, cfg.BackupRoot, *deviceID).Run(policy, time.Now(), *dryRun)
+	if plan != nil {
+		fmt.Printf("Prune plan for %s: keep %d, remove %d\n", *deviceID, len(plan.Keep), len(plan.Remove))
+		for _, d := range plan.Keep {
+			fmt.Printf("  keep    %s (%s)\n", d.Name, strings.Join(d.Reasons, ", "))
+		}
+		for _, d := range plan.Remove {
+			fmt.Printf("  remove  %s\n", d.Name)
+		}
+	}
+	if err != nil {
+		slog.Error("prune failed", "error", err)
+		return 1
+	}
+
+	if *dryRun {
+		fmt.Println("\nDry run, nothing was removed.")
+	}
+	return 0
+}
+
+func stateCmd(args []string) {
+	if len(args) < 1 || args[0] != "rebuild" {
+		fmt.Fprintln(os.Stderr, "Usage: m_backuper state rebuild [options]")
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("state rebuild", flag.ExitOnError)
+	hash := fs.Bool("hash", false, "Compare contents instead of size and modification time, and record digests")
+	snapshot := fs.String("snapshot", "", "Snapshot to read (default: latest in snapshot mode, otherwise the mirror)")
+	dryRun := fs.Bool("dry-run", false, "Show files that would be recorded without changing state")
+	if err := fs.Parse(args[1:]); err != nil {
+		slog.Error("failed to parse flags", "error", err)
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+
+	st, err := openState(&cfg, false)
+	if err != nil {
+		slog.Error("failed to load state", "error", err)
+		os.Exit(1)
+	}
+	defer closeState(st)
+
+	c, err := newCopier(&cfg)
+	if err != nil {
+		slog.Error("failed to create copier", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := c.Close(); err != nil {
+			slog.Warn("failed to close copier", "error", err)
+		}
+	}()
+
+	restorer, ok := c.(copier.Restorer)
+	if !ok {
+		slog.Error("backup root does not support state rebuild", "backup_root", cfg.BackupRoot)
+		os.Exit(1)
+	}
+
+	// The next backup compares against the latest snapshot in snapshot mode
+	snapshotName, err := resolveSnapshot(restorer, &cfg, cfg.DeviceID, *snapshot)
+	if err != nil {
+		slog.Error("failed to find snapshot", "error", err)
+		os.Exit(1)
+	}
+
+	opts := rebuild.Options{Snapshot: snapshotName, DryRun: *dryRun}
+	if *hash {
+		opts.HashAlgorithm = cfg.HashAlgorithm
+		if opts.HashAlgorithm == "" {
+			opts.HashAlgorithm = detector.DefaultHashAlgorithm
+		}
+	}
+	result, err := rebuild.New(restorer, st, cfg.BackupRoot, cfg.DeviceID).Run(opts)
+	if err != nil {
+		slog.Error("state rebuild failed", "error", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("State Rebuild Report:")
+	fmt.Println()
+	fmt.Printf("  Backed up files found: %d\n", result.Scanned)
+	fmt.Printf("  Recorded: %d\n", result.Added)
+	fmt.Printf("  Changed since backup: %d\n", result.Changed)
+	fmt.Printf("  Source missing: %d\n", result.NoSource)
+	fmt.Printf("  Errors: %d\n", result.Errors)
+	if *dryRun {
+		fmt.Println("\nDry run, state was not changed.")
+	} else if result.Changed > 0 && !*hash {
+		fmt.Println("\nChanged files are copied again by the next backup. Without preserve_metadata")
+		fmt.Println("modification times aren't kept, use -hash to compare contents instead.")
+	}
+}
+
+func printProblems(label string, problems []verify.Problem) {
+	fmt.Printf("  %s: %d\n", label, len(problems))
+	for _, p := range problems {
+		fmt.Printf("    %s (expected %d bytes, found %d)\n", p.Path, p.Expected, p.Actual)
 	}
 }
 
 func statusCmd(args []string) {
 	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print status as JSON")
 	if err := fs.Parse(args); err != nil {
 		slog.Error("failed to parse flags", "error", err)
 		os.Exit(1)
 	}
+	if *asJSON {
+		logToStderr()
+	}
 
-	// Load state
-	st, err := state.Load()
+	cfg, err := loadConfig()
 	if err != nil {
-		slog.Error("failed to load state", "error", err)
+		slog.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+
+	current, err := statePath(&cfg, false)
+	if err != nil {
+		slog.Error("failed to locate state", "error", err)
 		os.Exit(1)
 	}
 
+	// An explicit -state shows just that one, otherwise every destination's
+	files := []state.StateFile{{Key: current, Backend: cfg.StateBackend, Path: current}}
+	if globalStatePath == "" {
+		if files, err = state.List(); err != nil {
+			slog.Error("failed to list state files", "error", err)
+			os.Exit(1)
+		}
+		// The legacy state stays outside the state directory until a backup
+		// adopts it
+		if legacy, err := state.StatePath(); err == nil && strings.TrimSuffix(current, filepath.Ext(current)) == strings.TrimSuffix(legacy, ".json") {
+			files = append(files, state.StateFile{Key: "legacy", Backend: cfg.StateBackend, Path: current})
+		}
+	}
+
+	statuses := make([]stateStatus, 0, len(files))
+	for _, file := range files {
+		status := readStateStatus(file)
+		status.Current = strings.TrimSuffix(file.Path, filepath.Ext(file.Path)) == strings.TrimSuffix(current, filepath.Ext(current))
+		statuses = append(statuses, status)
+	}
+
+	if *asJSON {
+		if err := writeJSON("-", map[string]any{"states": statuses}); err != nil {
+			slog.Error("failed to write status", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Display status
 	fmt.Println("Backup Status:")
-	fmt.Println()
-
-	if st.LastRun.IsZero() {
+	if len(statuses) == 0 {
+		fmt.Println()
 		fmt.Println("  Last backup: Never")
-	} else {
-		fmt.Printf("  Last backup: %s\n", st.LastRun.Format("2006-01-02 15:04:05"))
+		return
 	}
+	for _, status := range statuses {
+		fmt.Println()
+		marker := ""
+		if status.Current {
+			marker = " (current config)"
+		}
+		fmt.Printf("%s [%s]%s\n", status.Key, status.Backend, marker)
+		if status.Error != "" {
+			fmt.Printf("  Error: %s\n", status.Error)
+			continue
+		}
 
-	fmt.Printf("  Files backed up: %d\n", st.FileCount())
+		if status.LastRun == nil {
+			fmt.Println("  Last backup: Never")
+		} else {
+			fmt.Printf("  Last backup: %s\n", status.LastRun.Format("2006-01-02 15:04:05"))
+		}
 
-	if st.FileCount() > 0 {
-		var totalSize int64
-		for _, fileState := range st.Files {
-			totalSize += fileState.Size
+		fmt.Printf("  Files backed up: %d\n", status.Files)
+
+		if status.Files > 0 {
+			fmt.Printf("  Total size: %d bytes (%.2f MB)\n", status.TotalSize, float64(status.TotalSize)/(1024*1024))
 		}
-		fmt.Printf("  Total size: %d bytes (%.2f MB)\n", totalSize, float64(totalSize)/(1024*1024))
+	}
+}
+
+// stateStatus is what status reports about one state file
+//
+//nolint:govet // fieldalignment: field order optimized for JSON readability
+type stateStatus struct {
+	Key       string     `json:"key"`
+	Backend   string     `json:"backend"`
+	Path      string     `json:"path"`
+	Current   bool       `json:"current"` // used by the loaded config
+	LastRun   *time.Time `json:"last_run"`
+	Files     int        `json:"files"`
+	TotalSize int64      `json:"total_size"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func readStateStatus(file state.StateFile) stateStatus {
+	status := stateStatus{Key: file.Key, Backend: file.Backend, Path: file.Path}
+
+	st, err := state.OpenReadOnly(file.Backend, file.Path)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	defer closeState(st)
+
+	stats, err := st.Stats()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if !stats.LastRun.IsZero() {
+		status.LastRun = &stats.LastRun
+	}
+	status.Files = stats.Files
+	status.TotalSize = stats.TotalSize
+	return status
+}
+
+// logToStderr keeps stdout clean for JSON output
+func logToStderr() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})))
+}
+
+func closeState(st state.Store) {
+	if err := st.Close(); err != nil {
+		slog.Warn("failed to close state", "error", err)
 	}
 }
 
@@ -1,3 +1,14 @@
 module github.com/mackeper/m_backuper
 
 go 1.23
+
+require (
+	github.com/hirochachacha/go-smb2 v1.1.0
+	go.etcd.io/bbolt v1.4.3
+)
+
+require (
+	github.com/geoffgarside/ber v1.2.0 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+)
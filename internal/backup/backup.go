@@ -1,102 +1,504 @@
 package backup
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/mackeper/m_backuper/internal/copier"
 	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/metadata"
 	"github.com/mackeper/m_backuper/internal/scanner"
 	"github.com/mackeper/m_backuper/internal/state"
 )
 
 type Backup struct {
-	scanner  *scanner.Scanner
-	detector detector.ChangeDetector
-	copier   copier.Copier
-	state    *state.State
-	deviceID string
+	scanner            *scanner.Scanner
+	detector           detector.ChangeDetector
+	rootDetectors      map[string]detector.ChangeDetector // by cleaned path to back up
+	copier             copier.Copier
+	state              state.Store
+	deviceID           string
+	deletionPolicy     DeletionPolicy
+	gracePeriod        time.Duration
+	snapshots          bool
+	preserveMetadata   bool
+	concurrency        int
+	checkpointFiles    int
+	checkpointInterval time.Duration
 }
 
-func New(s *scanner.Scanner, d detector.ChangeDetector, c copier.Copier, st *state.State, deviceID string) *Backup {
+func New(s *scanner.Scanner, d detector.ChangeDetector, c copier.Copier, st state.Store, deviceID string) *Backup {
 	return &Backup{
-		scanner:  s,
-		detector: d,
-		copier:   c,
-		state:    st,
-		deviceID: deviceID,
+		scanner:        s,
+		detector:       d,
+		copier:         c,
+		state:          st,
+		deviceID:       deviceID,
+		deletionPolicy: DeletionKeep,
+		concurrency:    1,
 	}
 }
 
-func (b *Backup) Run(paths []string, backupRoot string) error {
+// SetConcurrency sets how many files are checked and copied at the same time
+func (b *Backup) SetConcurrency(n int) {
+	b.concurrency = max(n, 1)
+}
+
+// SetRootDetector checks the files below root, one of the paths passed to
+// Run, with d instead of the detector passed to New
+func (b *Backup) SetRootDetector(root string, d detector.ChangeDetector) {
+	if b.rootDetectors == nil {
+		b.rootDetectors = make(map[string]detector.ChangeDetector)
+	}
+	b.rootDetectors[filepath.Clean(root)] = d
+}
+
+// Run backs up paths to backupRoot and returns what it did. When ctx is
+// cancelled it aborts the files in flight, saves state for what was already
+// copied and returns an error wrapping ctx's error along with the result.
+func (b *Backup) Run(ctx context.Context, paths []string, backupRoot string) (*Result, error) {
 	slog.Info("starting backup", "paths", paths, "device_id", b.deviceID)
+	startTime := time.Now()
+	result := newResult(b.deviceID, paths, startTime)
 
-	// Scan files
-	slog.Info("scanning files...")
-	files, err := b.scanner.Scan(paths)
-	if err != nil {
-		return fmt.Errorf("scan failed: %w", err)
+	// Files go to the mirror, or to a new snapshot when snapshots are enabled
+	destRoot := filepath.Join(backupRoot, b.deviceID)
+	var snapshot *snapshotRun
+	if b.snapshots {
+		snapshot = b.startSnapshot(backupRoot, startTime)
+		destRoot = snapshot.root
 	}
-	slog.Info("scan complete", "file_count", len(files))
+	// Holds metadata with preserve_metadata, and links the copier can't store
+	sidecar := metadata.NewSidecar()
 
 	// Process each file
-	copiedCount := 0
-	skippedCount := 0
-	errorCount := 0
-
-	for _, file := range files {
-		// Get file info for change detection
-		fileInfo, err := os.Stat(file.Path)
-		if err != nil {
-			slog.Warn("failed to stat file", "path", file.Path, "error", err)
-			errorCount++
-			continue
+	detectors := make([]detector.ChangeDetector, len(paths))
+	for i, path := range paths {
+		detectors[i] = b.detector
+		if d, ok := b.rootDetectors[filepath.Clean(path)]; ok {
+			detectors[i] = d
 		}
+	}
+	run := &fileRun{
+		destRoot:  destRoot,
+		snapshot:  snapshot,
+		sidecar:   sidecar,
+		detector:  b.detector,
+		detectors: detectors,
+		roots:     newRootIndex(paths),
+		result:    result,
+	}
+	run.manifest = b.startManifest(run, startTime)
+	result.RunID = run.manifest.RunID
+	result.Snapshot = run.manifest.Snapshot
 
-		// Check if file has changed
-		fileState, exists := b.state.GetFileState(file.Path)
-		detectorState := detector.FileState{
-			Size:    fileState.Size,
-			ModTime: 0, // We're only using size for now
+	// Files are processed while the scan is still finding more
+	slog.Info("scanning and copying files...")
+	files := make(chan scanner.FileInfo, scanAhead)
+	seen := make(map[string]bool)
+	var scanErr error
+	var unreadable []string // what was backed up below them isn't deleted
+	var skippedMu sync.Mutex
+	b.scanner.SetSkipHandler(func(skip scanner.Skipped) {
+		skippedMu.Lock()
+		defer skippedMu.Unlock()
+		result.SkippedPaths = append(result.SkippedPaths, SkippedPath{Path: skip.Path, Reason: skip.Reason})
+		if skip.Reason == scanner.SkipUnreadable {
+			unreadable = append(unreadable, skip.Path)
 		}
-
-		if exists && !b.detector.HasChanged(file.Path, fileInfo, detectorState) {
-			slog.Debug("file unchanged, skipping", "path", file.Path)
-			skippedCount++
-			continue
+	})
+	go func() {
+		defer close(files)
+		scanErr = b.scanner.Walk(ctx, paths, func(file scanner.FileInfo) error {
+			seen[file.Path] = true
+			select {
+			case files <- file:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if scanErr == nil {
+			slog.Info("scan complete", "file_count", len(seen))
 		}
+	}()
+	remaining := b.processFiles(ctx, files, run)
+	// The walk only stops early when ctx is cancelled
+	if scanErr != nil || len(remaining) > 0 {
+		return result, b.interrupted(ctx, backupRoot, run, remaining, scanErr == nil)
+	}
 
-		// Determine destination path
-		destPath := filepath.Join(backupRoot, b.deviceID, file.Path)
+	// Handle files deleted locally since the last run
+	result.Counts.Deleted = b.propagateDeletions(paths, seen, unreadable, backupRoot, startTime, result)
 
-		// Copy file
-		slog.Debug("copying file", "src", file.Path, "dst", destPath)
-		_, err = b.copier.Copy(file.Path, destPath)
-		if err != nil {
-			slog.Error("failed to copy file", "path", file.Path, "error", err)
-			errorCount++
-			continue
+	if sidecar.Len() > 0 {
+		if err := b.writeSidecar(destRoot, sidecar); err != nil {
+			slog.Error("failed to write metadata sidecar", "error", err)
+			result.addError(SidecarPath(destRoot), "sidecar", err)
 		}
+	}
 
-		// Update state
-		b.state.SetFileState(file.Path, file.Size)
-		copiedCount++
+	// Only write to and point latest at snapshots that actually hold files
+	hasFiles := result.Counts.Copied+result.Counts.Skipped > 0
+	if snapshot == nil || hasFiles {
+		run.manifest.Counts = result.Counts
+		if err := b.writeManifest(run, nil); err != nil {
+			slog.Error("failed to write manifest", "error", err)
+			result.addError(ManifestPath(destRoot), "manifest", err)
+		}
+	}
+	if snapshot != nil && hasFiles {
+		if err := b.finishSnapshot(backupRoot, snapshot); err != nil {
+			slog.Error("failed to finish snapshot", "snapshot", snapshot.name, "error", err)
+			result.addError(snapshot.root, "snapshot", err)
+		}
 	}
 
-	// Save state
+	// Save state. Only a finished run counts as the last backup, checkpoints
+	// and interrupted runs leave the time of the previous one.
 	slog.Info("saving state...")
+	if err := b.state.SetLastRun(time.Now()); err != nil {
+		result.finish()
+		return result, fmt.Errorf("failed to save state: %w", err)
+	}
 	if err := b.state.Save(); err != nil {
-		return fmt.Errorf("failed to save state: %w", err)
+		result.finish()
+		return result, fmt.Errorf("failed to save state: %w", err)
 	}
+	result.finish()
 
 	slog.Info("backup complete",
-		"total_files", len(files),
-		"copied", copiedCount,
-		"skipped", skippedCount,
-		"errors", errorCount,
+		"total_files", result.Counts.Total,
+		"copied", result.Counts.Copied,
+		"skipped", result.Counts.Skipped,
+		"deleted", result.Counts.Deleted,
+		"errors", len(result.Errors),
+		"skipped_paths", len(result.SkippedPaths),
 	)
 
-	return nil
+	return result, nil
+}
+
+// interrupted wraps up a cancelled run. Deletions aren't propagated since
+// files that weren't reached can't be told apart from deleted ones. remaining
+// are the files found but not processed, scanned whether the scan finished.
+func (b *Backup) interrupted(ctx context.Context, backupRoot string, run *fileRun, remaining []scanner.FileInfo, scanned bool) error {
+	slog.Warn("backup interrupted, saving progress", "remaining", len(remaining))
+	result := run.result
+	result.Interrupted = true
+	result.Remaining = len(remaining)
+	run.manifest.Interrupted = true
+	run.manifest.Counts = result.Counts
+
+	if run.snapshot == nil {
+		if err := b.writeManifest(run, nil); err != nil {
+			slog.Error("failed to write manifest", "error", err)
+			result.addError(ManifestPath(run.destRoot), "manifest", err)
+		}
+	} else {
+		// The previous snapshot tells which files a cut short scan didn't find
+		complete := true
+		if !scanned {
+			var unscanned []scanner.FileInfo
+			unscanned, complete = b.unscannedFiles(run, remaining)
+			remaining = append(remaining, unscanned...)
+		}
+		if complete && b.completeSnapshot(run, remaining) {
+			if run.sidecar.Len() > 0 {
+				if err := b.writeSidecar(run.destRoot, run.sidecar); err != nil {
+					slog.Error("failed to write metadata sidecar", "error", err)
+					result.addError(SidecarPath(run.destRoot), "sidecar", err)
+				}
+			}
+			if err := b.writeManifest(run, remaining); err != nil {
+				slog.Error("failed to write manifest", "error", err)
+				result.addError(ManifestPath(run.destRoot), "manifest", err)
+			}
+			if err := b.finishSnapshot(backupRoot, run.snapshot); err != nil {
+				slog.Error("failed to finish snapshot", "snapshot", run.snapshot.name, "error", err)
+				result.addError(run.snapshot.root, "snapshot", err)
+			}
+		} else {
+			slog.Warn("leaving snapshot unfinished, the next run resumes it", "snapshot", run.snapshot.name)
+		}
+	}
+
+	slog.Info("saving state...")
+	err := b.state.Save()
+	result.finish()
+	if err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+
+	slog.Info("backup stopped",
+		"copied", result.Counts.Copied,
+		"skipped", result.Counts.Skipped,
+		"remaining", result.Remaining,
+		"errors", len(result.Errors),
+	)
+	return fmt.Errorf("backup interrupted: %w", ctx.Err())
+}
+
+// scanAhead is how many files the scan may find before the workers get to them
+const scanAhead = 256
+
+// fileRun is what every file of a run shares
+type fileRun struct {
+	destRoot     string
+	snapshot     *snapshotRun
+	sidecar      *metadata.Sidecar
+	detector     detector.ChangeDetector   // for files outside every root
+	detectors    []detector.ChangeDetector // per root
+	manifest     *Manifest
+	prevManifest *Manifest // of the mirror, to carry over files this run didn't touch
+	roots        *rootIndex
+	// Only touched by the goroutine collecting results
+	result *Result
+	placed []string // files copied or kept
+}
+
+// detectorFor returns the change detector for path, and its digester when it
+// computes digests
+func (run *fileRun) detectorFor(path string) (detector.ChangeDetector, detector.Digester) {
+	d := run.detector
+	if i := run.roots.of(path); i >= 0 {
+		d = run.detectors[i]
+	}
+	digester, ok := d.(detector.Digester)
+	if !ok || digester.Algorithm() == "" {
+		return d, nil
+	}
+	return d, digester
+}
+
+// outcome is what happened to a single file
+type outcome int
+
+const (
+	outcomeCopied outcome = iota
+	outcomeSkipped
+	outcomeFailed
+	outcomeCanceled
+)
+
+type fileResult struct {
+	file    scanner.FileInfo
+	outcome outcome
+	bytes   int64  // copied
+	op      string // what failed
+	err     error
+}
+
+// processFiles hands the files to a bounded pool of workers as they arrive
+// and tallies their outcomes in run.result. Once ctx is cancelled no new
+// files are started; the ones that weren't finished are returned.
+func (b *Backup) processFiles(ctx context.Context, files <-chan scanner.FileInfo, run *fileRun) []scanner.FileInfo {
+	results := make(chan fileResult)
+
+	var wg sync.WaitGroup
+	for range b.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Once ctx is cancelled the files left are returned right away
+			for file := range files {
+				r := b.processFile(ctx, file, run)
+				r.file = file
+				results <- r
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var remaining []scanner.FileInfo
+	checkpoint := b.newCheckpointer()
+	for r := range results {
+		// Files the run didn't get to are reported as remaining, not counted
+		if r.outcome == outcomeCanceled {
+			remaining = append(remaining, r.file)
+			continue
+		}
+		checkpoint.fileDone()
+
+		var root *RootResult
+		if i := run.roots.of(r.file.Path); i >= 0 {
+			root = &run.result.Roots[i]
+		} else {
+			root = &RootResult{}
+		}
+		counts := &run.result.Counts
+		counts.Total++
+		root.Total++
+		switch r.outcome {
+		case outcomeCopied:
+			counts.Copied++
+			counts.Bytes += r.bytes
+			root.Copied++
+			root.Bytes += r.bytes
+			run.placed = append(run.placed, r.file.Path)
+		case outcomeSkipped:
+			counts.Skipped++
+			root.Skipped++
+			run.placed = append(run.placed, r.file.Path)
+		case outcomeFailed:
+			counts.Failed++
+			root.Failed++
+			run.result.addError(r.file.Path, r.op, r.err)
+		}
+	}
+	return remaining
+}
+
+// processFile checks a single file and copies it when it has changed
+func (b *Backup) processFile(ctx context.Context, file scanner.FileInfo, run *fileRun) fileResult {
+	if ctx.Err() != nil {
+		return fileResult{outcome: outcomeCanceled}
+	}
+	if file.LinkTarget != "" {
+		return b.processLink(file, run)
+	}
+
+	// Get file info for change detection
+	fileInfo, err := os.Stat(file.Path)
+	if err != nil {
+		slog.Warn("failed to stat file", "path", file.Path, "error", err)
+		return fileResult{outcome: outcomeFailed, op: "stat", err: err}
+	}
+	if b.preserveMetadata {
+		captureMetadata(run.sidecar, file.Path, fileInfo)
+	}
+
+	// Check if file has changed
+	fileState, exists, err := b.state.Get(file.Path)
+	if err != nil {
+		slog.Warn("failed to read state, treating file as new", "path", file.Path, "error", err)
+		exists = false
+	}
+	detectorState := detector.FileState{
+		Size:    fileState.Size,
+		ModTime: fileState.ModTime,
+		Digest:  fileState.Digest,
+	}
+
+	// Determine destination path
+	destPath := filepath.Join(run.destRoot, file.Path)
+
+	// A file that was backed up as a link needs its content copied
+	changeDetector, digester := run.detectorFor(file.Path)
+	if digester != nil {
+		// Whatever the check cached is of no use once the file is done
+		defer digester.Forget(file.Path)
+	}
+	if exists && fileState.LinkTarget == "" && !changeDetector.HasChanged(ctx, file.Path, fileInfo, detectorState) {
+		slog.Debug("file unchanged, skipping", "path", file.Path)
+		if run.snapshot != nil {
+			if err := b.carryOver(ctx, run.snapshot, file.Path, destPath); err != nil {
+				if ctx.Err() != nil {
+					return fileResult{outcome: outcomeCanceled}
+				}
+				slog.Error("failed to add unchanged file to snapshot", "path", file.Path, "error", err)
+				return fileResult{outcome: outcomeFailed, op: "link", err: err}
+			}
+		}
+		// Refresh what the check learned so the next run can stay cheap,
+		// e.g. a touched file whose content hash still matches
+		updated := fileState
+		updated.MissingSince = ""
+		updated.ModTime = file.ModTime
+		if digester != nil {
+			if digest, ok := digester.CachedDigest(file.Path); ok {
+				updated.Digest = digest
+			}
+		}
+		if updated != fileState {
+			if err := b.state.Put(file.Path, updated); err != nil {
+				slog.Warn("failed to update state", "path", file.Path, "error", err)
+			}
+		}
+		return fileResult{outcome: outcomeSkipped}
+	}
+
+	// Copy file
+	slog.Debug("copying file", "src", file.Path, "dst", destPath)
+	written, digest, err := b.copyFile(ctx, file.Path, destPath, digester)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fileResult{outcome: outcomeCanceled}
+		}
+		slog.Error("failed to copy file", "path", file.Path, "error", err)
+		return fileResult{outcome: outcomeFailed, op: "copy", err: err}
+	}
+
+	// Update state
+	updated := state.FileState{
+		Size:     file.Size,
+		ModTime:  file.ModTime,
+		BackedUp: time.Now().Format(time.RFC3339),
+		Digest:   digest,
+	}
+	if err := b.state.Put(file.Path, updated); err != nil {
+		slog.Error("failed to update state", "path", file.Path, "error", err)
+		return fileResult{outcome: outcomeFailed, op: "state", err: err}
+	}
+	return fileResult{outcome: outcomeCopied, bytes: written}
+}
+
+// copyFile copies src to dst and, given a digester, returns the digest of
+// the bytes written. They are hashed on the way when the copier can pass them
+// on, otherwise src is hashed again after the copy.
+func (b *Backup) copyFile(ctx context.Context, src, dst string, digester detector.Digester) (int64, string, error) {
+	tee, canTee := b.copier.(copier.TeeCopier)
+	if digester == nil || !canTee {
+		written, err := b.copier.Copy(ctx, src, dst)
+		if err != nil || digester == nil {
+			return written, "", err
+		}
+		digest, err := digester.Digest(ctx, src)
+		if err != nil {
+			slog.Warn("failed to hash file", "path", src, "error", err)
+		}
+		return written, digest, nil
+	}
+
+	w, err := detector.NewDigestWriter(digester.Algorithm())
+	if err != nil {
+		return 0, "", err
+	}
+	written, err := tee.CopyTee(ctx, src, dst, w)
+	if err != nil {
+		return written, "", err
+	}
+	return written, w.Digest(), nil
+}
+
+// writeFile stores data at dst through the copier, by way of a local temp file
+func (b *Backup) writeFile(dst string, data []byte) error {
+	tmp, err := os.CreateTemp("", "m_backuper-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		if err := os.Remove(tmp.Name()); err != nil {
+			slog.Warn("failed to remove temp file", "path", tmp.Name(), "error", err)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+
+	_, err = b.copier.Copy(context.Background(), tmp.Name(), dst)
+	return err
 }
@@ -2,9 +2,14 @@ package backup
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/mackeper/m_backuper/internal/copier"
 	"github.com/mackeper/m_backuper/internal/detector"
@@ -46,7 +51,7 @@ func TestFullBackupFlow(t *testing.T) {
 	b := New(s, d, c, st, deviceID)
 
 	// Run backup
-	if err := b.Run([]string{srcDir}, dstDir); err != nil {
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
 		t.Fatalf("backup failed: %v", err)
 	}
 
@@ -97,7 +102,7 @@ func TestIncrementalBackupOnlyCopiesChangedFiles(t *testing.T) {
 	// First backup
 	deviceID := "test-device"
 	b := New(s, d, c, st, deviceID)
-	if err := b.Run([]string{srcDir}, dstDir); err != nil {
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
 		t.Fatalf("first backup failed: %v", err)
 	}
 
@@ -114,7 +119,7 @@ func TestIncrementalBackupOnlyCopiesChangedFiles(t *testing.T) {
 
 	// Second backup (incremental)
 	b2 := New(s, d, c, st, deviceID)
-	if err := b2.Run([]string{srcDir}, dstDir); err != nil {
+	if _, err := b2.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
 		t.Fatalf("second backup failed: %v", err)
 	}
 
@@ -155,7 +160,7 @@ func TestStateUpdatesAfterSuccessfulBackup(t *testing.T) {
 	// Run backup
 	deviceID := "test-device"
 	b := New(s, d, c, st, deviceID)
-	if err := b.Run([]string{srcDir}, dstDir); err != nil {
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
 		t.Fatalf("backup failed: %v", err)
 	}
 
@@ -204,7 +209,7 @@ func TestPartialFailuresHandledGracefully(t *testing.T) {
 	// Run backup (should succeed for the good file)
 	deviceID := "test-device"
 	b := New(s, d, c, st, deviceID)
-	if err := b.Run([]string{srcDir}, dstDir); err != nil {
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
 		t.Fatalf("backup failed: %v", err)
 	}
 
@@ -219,3 +224,533 @@ func TestPartialFailuresHandledGracefully(t *testing.T) {
 		t.Error("state should be updated even with partial failures")
 	}
 }
+
+func TestHashDetectorCatchesSameSizeEdits(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	srcDir := filepath.Join(tmpDir, "src")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatalf("failed to create source directory: %v", err)
+	}
+
+	filePath := filepath.Join(srcDir, "doc.txt")
+	if err := os.WriteFile(filePath, []byte("version 1"), 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	s := scanner.New([]string{})
+	d, err := detector.NewHashDetector("")
+	if err != nil {
+		t.Fatalf("failed to create hash detector: %v", err)
+	}
+	dstDir := filepath.Join(tmpDir, "backup")
+	c := copier.NewLocalCopier(dstDir)
+	st := state.New()
+	deviceID := "test-device"
+
+	if _, err := New(s, d, c, st, deviceID).Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("first backup failed: %v", err)
+	}
+
+	fileState, _ := st.GetFileState(filePath)
+	if detector.DigestAlgorithm(fileState.Digest) != detector.DefaultHashAlgorithm {
+		t.Fatalf("expected digest to be stored in state, got %q", fileState.Digest)
+	}
+
+	// Same size, different content
+	if err := os.WriteFile(filePath, []byte("version 2"), 0644); err != nil {
+		t.Fatalf("failed to modify file: %v", err)
+	}
+
+	if _, err := New(s, d, c, st, deviceID).Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("second backup failed: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dstDir, deviceID, filePath))
+	if err != nil {
+		t.Fatalf("failed to read backed up file: %v", err)
+	}
+	if string(content) != "version 2" {
+		t.Errorf("expected same-size edit to be backed up, got %q", content)
+	}
+
+	updated, _ := st.GetFileState(filePath)
+	if updated.Digest == fileState.Digest {
+		t.Error("expected digest in state to be updated after the edit")
+	}
+	// Hashed while copying, so it is the digest of the backed up bytes
+	if written, _ := detector.FileDigest(filepath.Join(dstDir, deviceID, filePath), detector.DefaultHashAlgorithm); updated.Digest != written {
+		t.Errorf("expected digest %s of the backup in state, got %s", written, updated.Digest)
+	}
+}
+
+func TestFirstHashRunRecopiesFilesWithoutDigest(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	srcDir := filepath.Join(tmpDir, "src")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatalf("failed to create source directory: %v", err)
+	}
+
+	filePath := filepath.Join(srcDir, "doc.txt")
+	if err := os.WriteFile(filePath, []byte("version 1"), 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	s := scanner.New([]string{})
+	dstDir := filepath.Join(tmpDir, "backup")
+	c := copier.NewLocalCopier(dstDir)
+	st := state.New()
+	deviceID := "test-device"
+
+	if _, err := New(s, detector.NewSizeDetector(), c, st, deviceID).Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("size backup failed: %v", err)
+	}
+
+	// A same-size edit the size check can't see, then hashing is enabled
+	if err := os.WriteFile(filePath, []byte("version 2"), 0644); err != nil {
+		t.Fatalf("failed to modify file: %v", err)
+	}
+	d, err := detector.NewHashDetector("")
+	if err != nil {
+		t.Fatalf("failed to create hash detector: %v", err)
+	}
+	if _, err := New(s, d, c, st, deviceID).Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("hash backup failed: %v", err)
+	}
+
+	backedUp := filepath.Join(dstDir, deviceID, filePath)
+	if content, _ := os.ReadFile(backedUp); string(content) != "version 2" {
+		t.Errorf("expected the file to be copied again, got %q", content)
+	}
+	// The recorded digest must describe the backup, or verify flags it corrupt
+	fileState, _ := st.GetFileState(filePath)
+	if written, _ := detector.FileDigest(backedUp, detector.DefaultHashAlgorithm); fileState.Digest != written {
+		t.Errorf("expected digest %s of the backup in state, got %s", written, fileState.Digest)
+	}
+}
+
+func TestFailedCopyForgetsCachedDigest(t *testing.T) {
+	tmpDir := t.TempDir()
+	filePath := filepath.Join(tmpDir, "src", "doc.txt")
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte("version 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := detector.NewHashDetector("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstDir := filepath.Join(tmpDir, "backup")
+	c := &failingCopier{LocalCopier: copier.NewLocalCopier(dstDir), fail: map[string]bool{}}
+	b := New(scanner.New([]string{}), d, c, state.New(), "test-device")
+	if _, err := b.Run(context.Background(), []string{filepath.Dir(filePath)}, dstDir); err != nil {
+		t.Fatalf("first backup failed: %v", err)
+	}
+
+	// Same size, so the check hashes it before the copy fails
+	if err := os.WriteFile(filePath, []byte("version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.fail[filePath] = true
+	result, err := b.Run(context.Background(), []string{filepath.Dir(filePath)}, dstDir)
+	if err != nil {
+		t.Fatalf("second backup failed: %v", err)
+	}
+	if result.Counts.Failed != 1 {
+		t.Fatalf("expected the copy to fail, got %+v", result.Counts)
+	}
+	if _, ok := d.CachedDigest(filePath); ok {
+		t.Error("expected the digest of the failed copy to be forgotten")
+	}
+}
+
+func TestRootDetectorOverridesDefault(t *testing.T) {
+	tmpDir := t.TempDir()
+	hashed := filepath.Join(tmpDir, "hashed")
+	sized := filepath.Join(tmpDir, "sized")
+	dstDir := filepath.Join(tmpDir, "backup")
+	files := []string{filepath.Join(hashed, "doc.txt"), filepath.Join(sized, "doc.txt")}
+	for _, path := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("version 1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hash, err := detector.NewHashDetector("")
+	if err != nil {
+		t.Fatalf("failed to create hash detector: %v", err)
+	}
+	st := state.New()
+	run := func() *Result {
+		t.Helper()
+		b := New(scanner.New([]string{}), detector.NewSizeDetector(), copier.NewLocalCopier(dstDir), st, "test-device")
+		b.SetRootDetector(hashed, hash)
+		result, err := b.Run(context.Background(), []string{hashed, sized}, dstDir)
+		if err != nil {
+			t.Fatalf("backup failed: %v", err)
+		}
+		return result
+	}
+
+	run()
+	if fileState, _ := st.GetFileState(files[0]); fileState.Digest == "" {
+		t.Error("expected digest for the file checked by the hash detector")
+	}
+
+	// Same size, different content: only the hashed root notices
+	for _, path := range files {
+		if err := os.WriteFile(path, []byte("version 2"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result := run()
+	if result.Roots[0].Copied != 1 || result.Roots[1].Skipped != 1 {
+		t.Errorf("expected the edit copied only under the hashed root, got %+v", result.Roots)
+	}
+}
+
+func TestTouchedFileIsNotRecopiedWithTieredDetection(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	srcDir := filepath.Join(tmpDir, "src")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatalf("failed to create source directory: %v", err)
+	}
+
+	filePath := filepath.Join(srcDir, "photo.jpg")
+	if err := os.WriteFile(filePath, []byte("pixels"), 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	s := scanner.New([]string{})
+	d, err := detector.New("size+mtime+hash", "")
+	if err != nil {
+		t.Fatalf("failed to create detector: %v", err)
+	}
+	dstDir := filepath.Join(tmpDir, "backup")
+	c := copier.NewLocalCopier(dstDir)
+	st := state.New()
+	deviceID := "test-device"
+
+	if _, err := New(s, d, c, st, deviceID).Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("first backup failed: %v", err)
+	}
+
+	fileState, _ := st.GetFileState(filePath)
+	if fileState.ModTime == 0 || fileState.Digest == "" {
+		t.Fatalf("expected mtime and digest in state, got %+v", fileState)
+	}
+
+	// Touch the file without changing its content and mark the backup copy
+	touched := time.Unix(fileState.ModTime, 0).Add(time.Hour)
+	if err := os.Chtimes(filePath, touched, touched); err != nil {
+		t.Fatalf("failed to touch file: %v", err)
+	}
+	dstFile := filepath.Join(dstDir, deviceID, filePath)
+	if err := os.WriteFile(dstFile, []byte("marker"), 0644); err != nil {
+		t.Fatalf("failed to mark backup copy: %v", err)
+	}
+
+	if _, err := New(s, d, c, st, deviceID).Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("second backup failed: %v", err)
+	}
+
+	if content, _ := os.ReadFile(dstFile); string(content) != "marker" {
+		t.Error("touched file with identical content should not be recopied")
+	}
+
+	updated, _ := st.GetFileState(filePath)
+	if updated.ModTime != touched.Unix() {
+		t.Errorf("expected state mtime to be refreshed to %d, got %d", touched.Unix(), updated.ModTime)
+	}
+}
+
+func TestPreserveMetadataWritesSidecar(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	dstDir := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	srcFile := filepath.Join(srcDir, "file.txt")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.WriteFile(srcFile, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(srcFile, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	c := copier.NewLocalCopier(dstDir)
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), c, state.New(), "test-device")
+	b.SetPreserveMetadata(true)
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	sidecar, err := LoadSidecar(c, filepath.Join(dstDir, "test-device"))
+	if err != nil {
+		t.Fatalf("failed to load sidecar: %v", err)
+	}
+	m := sidecar.Get(srcFile)
+	if m == nil {
+		t.Fatal("expected sidecar entry for backed up file")
+	}
+	if !m.ModTime.Equal(mtime) {
+		t.Errorf("sidecar mtime %v, want %v", m.ModTime, mtime)
+	}
+	// It lives next to the mirror, where it can't collide with a backed up path
+	if _, err := os.Stat(filepath.Join(dstDir, "test-device", MetaDir)); !os.IsNotExist(err) {
+		t.Error("expected no metadata directory inside the mirror")
+	}
+}
+
+func TestConcurrentBackupCopiesEveryFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	dstDir := filepath.Join(tmpDir, "backup")
+
+	testFiles := make(map[string][]byte)
+	for i := range 40 {
+		path := filepath.Join(srcDir, fmt.Sprintf("dir%d", i%4), fmt.Sprintf("file%d.txt", i))
+		testFiles[path] = []byte(fmt.Sprintf("content %d", i))
+	}
+	for path, content := range testFiles {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := detector.NewHashDetector("sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := state.New()
+	b := New(scanner.New([]string{}), d, copier.NewLocalCopier(dstDir), st, "test-device")
+	b.SetConcurrency(8)
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	for path, content := range testFiles {
+		got, err := os.ReadFile(filepath.Join(dstDir, "test-device", path))
+		if err != nil {
+			t.Errorf("file was not backed up: %s", path)
+			continue
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("backed up %s has content %q, want %q", path, got, content)
+		}
+		if fileState, _ := st.GetFileState(path); fileState.Digest == "" {
+			t.Errorf("expected digest in state for %s", path)
+		}
+	}
+	if st.FileCount() != len(testFiles) {
+		t.Errorf("expected %d files in state, got %d", len(testFiles), st.FileCount())
+	}
+}
+
+// cancelingCopier cancels the run once it has copied a file
+type cancelingCopier struct {
+	*copier.LocalCopier
+	cancel context.CancelFunc
+}
+
+func (c *cancelingCopier) Copy(ctx context.Context, src, dst string) (int64, error) {
+	n, err := c.LocalCopier.Copy(ctx, src, dst)
+	c.cancel()
+	return n, err
+}
+
+func TestInterruptedBackupSavesProgress(t *testing.T) {
+	srcDir, dstDir, deletedPath, st := deletionFixture(t)
+	newFiles := []string{filepath.Join(srcDir, "a.txt"), filepath.Join(srcDir, "b.txt")}
+	for _, path := range newFiles {
+		if err := os.WriteFile(path, []byte("new"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lastRun := st.LastRun
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &cancelingCopier{LocalCopier: copier.NewLocalCopier(dstDir), cancel: cancel}
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), c, st, "test-device")
+	b.SetDeletionPolicy(DeletionDelete, 0)
+
+	result, err := b.Run(ctx, []string{srcDir}, dstDir)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected interrupted backup, got %v", err)
+	}
+	if result == nil || !result.Interrupted {
+		t.Fatalf("expected result of an interrupted run, got %+v", result)
+	}
+	// Files the run didn't get to are remaining, not part of the total
+	counts := result.Counts
+	if counts.Total != counts.Copied+counts.Skipped+counts.Failed || result.Remaining == 0 {
+		t.Errorf("expected the total to only count processed files, got %+v with %d remaining", counts, result.Remaining)
+	}
+
+	// Only the first new file made it, and state knows about it
+	if _, exists := st.GetFileState(newFiles[0]); !exists {
+		t.Error("expected file copied before the interruption in state")
+	}
+	if _, exists := st.GetFileState(newFiles[1]); exists {
+		t.Error("expected file after the interruption not to be in state")
+	}
+
+	// Unreached files can't be told apart from deleted ones
+	if _, exists := st.GetFileState(deletedPath); !exists {
+		t.Error("expected deletions not to be propagated by an interrupted run")
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "test-device", deletedPath)); err != nil {
+		t.Errorf("expected backup copy of deleted file to be kept: %v", err)
+	}
+
+	// The last backup is still the one that finished
+	if lastRun.IsZero() || !st.LastRun.Equal(lastRun) {
+		t.Errorf("expected last run %v to be kept, got %v", lastRun, st.LastRun)
+	}
+}
+
+func TestBackupWithBoltState(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	dstDir := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	kept := filepath.Join(srcDir, "kept.txt")
+	deleted := filepath.Join(srcDir, "deleted.txt")
+	for _, path := range []string{kept, deleted} {
+		if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dbPath := filepath.Join(tmpDir, "state.db")
+	run := func() {
+		t.Helper()
+		st, err := state.OpenBolt(dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = st.Close() }()
+
+		b := New(scanner.New([]string{}), detector.NewSizeDetector(), copier.NewLocalCopier(dstDir), st, "test-device")
+		b.SetDeletionPolicy(DeletionDelete, 0)
+		if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+			t.Fatalf("backup failed: %v", err)
+		}
+	}
+
+	run()
+	if err := os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+	run()
+
+	st, err := state.OpenBolt(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = st.Close() }()
+
+	if _, exists, _ := st.Get(kept); !exists {
+		t.Error("expected kept file in state")
+	}
+	if _, exists, _ := st.Get(deleted); exists {
+		t.Error("expected deleted file to be dropped from state")
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "test-device", deleted)); !os.IsNotExist(err) {
+		t.Error("expected deleted file to be removed from the backup")
+	}
+}
+
+// failingCopier fails to copy the files in fail
+type failingCopier struct {
+	*copier.LocalCopier
+	fail map[string]bool
+}
+
+func (c *failingCopier) Copy(ctx context.Context, src, dst string) (int64, error) {
+	if c.fail[src] {
+		return 0, errors.New("disk full")
+	}
+	return c.LocalCopier.Copy(ctx, src, dst)
+}
+
+func (c *failingCopier) CopyTee(ctx context.Context, src, dst string, w io.Writer) (int64, error) {
+	if c.fail[src] {
+		return 0, errors.New("disk full")
+	}
+	return c.LocalCopier.CopyTee(ctx, src, dst, w)
+}
+
+func TestRunReportsResult(t *testing.T) {
+	tmpDir := t.TempDir()
+	docs := filepath.Join(tmpDir, "docs")
+	photos := filepath.Join(tmpDir, "photos")
+	dstDir := filepath.Join(tmpDir, "backup")
+	files := map[string]string{
+		filepath.Join(docs, "a.txt"):        "aaa",
+		filepath.Join(docs, "sub", "b.txt"): "bb",
+		filepath.Join(photos, "c.jpg"):      "cccc",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	broken := filepath.Join(photos, "c.jpg")
+
+	st := state.New()
+	c := &failingCopier{LocalCopier: copier.NewLocalCopier(dstDir), fail: map[string]bool{broken: true}}
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), c, st, "test-device")
+	result, err := b.Run(context.Background(), []string{docs, photos}, dstDir)
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	want := Counts{Total: 3, Copied: 2, Failed: 1, Bytes: 5}
+	if result.Counts != want {
+		t.Errorf("expected counts %+v, got %+v", want, result.Counts)
+	}
+	if result.DeviceID != "test-device" || result.Finished.Before(result.Started) {
+		t.Errorf("unexpected result header %+v", result)
+	}
+
+	wantRoots := []RootResult{
+		{Path: docs, Total: 2, Copied: 2, Bytes: 5},
+		{Path: photos, Total: 1, Failed: 1},
+	}
+	if len(result.Roots) != len(wantRoots) {
+		t.Fatalf("expected %d roots, got %+v", len(wantRoots), result.Roots)
+	}
+	for i, root := range wantRoots {
+		if result.Roots[i] != root {
+			t.Errorf("expected root %+v, got %+v", root, result.Roots[i])
+		}
+	}
+
+	if len(result.Errors) != 1 {
+		t.Fatalf("expected 1 error, got %+v", result.Errors)
+	}
+	if e := result.Errors[0]; e.Path != broken || e.Op != "copy" || e.Error == "" {
+		t.Errorf("unexpected error %+v", e)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build unix
+
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/scanner"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+func TestRunReportsSkippedPaths(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fifo := filepath.Join(srcDir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+		t.Skipf("can't create a FIFO: %v", err)
+	}
+
+	dstDir := filepath.Join(tmpDir, "backup")
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), copier.NewLocalCopier(dstDir), state.New(), "test-device")
+	result, err := b.Run(context.Background(), []string{srcDir}, dstDir)
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	if result.Counts.Copied != 1 || len(result.Errors) != 0 {
+		t.Errorf("expected only the regular file to be copied, got %+v and %v", result.Counts, result.Errors)
+	}
+	want := SkippedPath{Path: fifo, Reason: scanner.SkipFIFO}
+	if len(result.SkippedPaths) != 1 || result.SkippedPaths[0] != want {
+		t.Errorf("expected %v in the result, got %v", want, result.SkippedPaths)
+	}
+}
@@ -0,0 +1,44 @@
+package backup
+
+import (
+	"log/slog"
+	"time"
+)
+
+// SetCheckpoint saves state after every files processed files or every
+// interval, whichever comes first, so a crash only loses the work done since
+// the last checkpoint. Zero turns either trigger off.
+func (b *Backup) SetCheckpoint(files int, interval time.Duration) {
+	b.checkpointFiles = files
+	b.checkpointInterval = interval
+}
+
+// checkpointer decides when a run saves its progress. It is only used by the
+// goroutine collecting results, state itself may change concurrently.
+type checkpointer struct {
+	b       *Backup
+	pending int // files processed since the last save
+	last    time.Time
+}
+
+func (b *Backup) newCheckpointer() *checkpointer {
+	return &checkpointer{b: b, last: time.Now()}
+}
+
+// fileDone counts a processed file and saves state when a checkpoint is due
+func (c *checkpointer) fileDone() {
+	c.pending++
+	filesDue := c.b.checkpointFiles > 0 && c.pending >= c.b.checkpointFiles
+	timeDue := c.b.checkpointInterval > 0 && time.Since(c.last) >= c.b.checkpointInterval
+	if !filesDue && !timeDue {
+		return
+	}
+
+	slog.Info("checkpointing state", "files_since_last", c.pending)
+	if err := c.b.state.Save(); err != nil {
+		// The final save may still succeed, so keep going
+		slog.Warn("failed to checkpoint state", "error", err)
+	}
+	c.pending = 0
+	c.last = time.Now()
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/scanner"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+func TestCheckpointSavesEveryNFiles(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	statePath, err := state.StatePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := state.New()
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), copier.NewLocalCopier(t.TempDir()), st, "test-device")
+	b.SetCheckpoint(2, time.Hour)
+	checkpoint := b.newCheckpointer()
+
+	st.SetFileState("/path/to/first.txt", 1)
+	checkpoint.fileDone()
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatalf("expected no checkpoint after one file, got %v", err)
+	}
+
+	st.SetFileState("/path/to/second.txt", 2)
+	checkpoint.fileDone()
+	saved, err := state.LoadFrom(statePath)
+	if err != nil {
+		t.Fatalf("expected checkpoint after two files: %v", err)
+	}
+	if saved.FileCount() != 2 {
+		t.Errorf("expected 2 files in checkpoint, got %d", saved.FileCount())
+	}
+	// A checkpoint isn't a finished run
+	if !saved.LastRun.IsZero() {
+		t.Errorf("expected no last run in checkpoint, got %v", saved.LastRun)
+	}
+}
+
+func TestCheckpointSavesAfterInterval(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	statePath, err := state.StatePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), copier.NewLocalCopier(t.TempDir()), state.New(), "test-device")
+	b.SetCheckpoint(0, time.Minute)
+	checkpoint := b.newCheckpointer()
+	checkpoint.last = time.Now().Add(-2 * time.Minute)
+
+	checkpoint.fileDone()
+	if _, err := os.Stat(statePath); err != nil {
+		t.Errorf("expected checkpoint once the interval passed: %v", err)
+	}
+}
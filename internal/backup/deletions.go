@@ -0,0 +1,172 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+// DeletionPolicy decides what happens to the backup copy of a file that was
+// deleted locally
+type DeletionPolicy string
+
+const (
+	DeletionKeep   DeletionPolicy = "keep"   // leave the backup copy, only forget it in state
+	DeletionMove   DeletionPolicy = "move"   // move it under <device_id>.deleted/<timestamp>/
+	DeletionDelete DeletionPolicy = "delete" // remove it from the backup
+)
+
+// DeletedDir is appended to the device ID to name the directory holding files
+// moved aside by DeletionMove, <backup_root>/<device_id>.deleted
+const DeletedDir = ".deleted"
+
+// timestampFormat names per-run directories. It avoids ':' so it is valid on SMB shares.
+const timestampFormat = "2006-01-02T15-04-05Z"
+
+func ParseDeletionPolicy(s string) (DeletionPolicy, error) {
+	switch p := DeletionPolicy(s); p {
+	case DeletionKeep, DeletionMove, DeletionDelete:
+		return p, nil
+	case "":
+		return DeletionKeep, nil
+	default:
+		return "", fmt.Errorf("unknown deletion policy %q (expected keep, move or delete)", s)
+	}
+}
+
+// SetDeletionPolicy configures how local deletions are propagated. Entries are
+// only acted on once their source has been missing for gracePeriod, so a
+// briefly unmounted path doesn't wipe the backup.
+func (b *Backup) SetDeletionPolicy(policy DeletionPolicy, gracePeriod time.Duration) {
+	b.deletionPolicy = policy
+	b.gracePeriod = gracePeriod
+}
+
+// propagateDeletions handles state entries under the scanned paths that were
+// not seen in this run and returns how many were removed from state. Entries
+// at or under a path the scan couldn't read are left alone. Failures are added
+// to result.
+func (b *Backup) propagateDeletions(paths []string, seen map[string]bool, unreadable []string, backupRoot string, now time.Time, result *Result) (removed int) {
+	roots := availableRoots(paths)
+
+	// Collected first since roots may overlap
+	missing := make(map[string]state.FileState)
+	for _, root := range roots {
+		err := b.state.Walk(root, func(path string, fileState state.FileState) error {
+			if !seen[path] && underAny(path, roots) && !underAny(path, unreadable) {
+				missing[path] = fileState
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("failed to read state", "root", root, "error", err)
+			result.addError(root, "state", err)
+			return removed
+		}
+	}
+	missingPaths := make([]string, 0, len(missing))
+	for path := range missing {
+		missingPaths = append(missingPaths, path)
+	}
+	sort.Strings(missingPaths)
+
+	for _, path := range missingPaths {
+		fileState := missing[path]
+		since := fileState.MarkMissing(now)
+		if err := b.state.Put(path, fileState); err != nil {
+			slog.Error("failed to update state", "path", path, "error", err)
+			result.addError(path, "state", err)
+			continue
+		}
+		if now.Sub(since) < b.gracePeriod {
+			slog.Debug("source missing, within grace period", "path", path, "missing_since", since)
+			continue
+		}
+
+		destPath := filepath.Join(backupRoot, b.deviceID, path)
+		if err := b.applyDeletion(destPath, backupRoot, path, now); err != nil {
+			slog.Error("failed to propagate deletion", "path", path, "policy", b.deletionPolicy, "error", err)
+			result.addError(path, "deletion", err)
+			continue
+		}
+
+		if err := b.state.Delete(path); err != nil {
+			slog.Error("failed to update state", "path", path, "error", err)
+			result.addError(path, "state", err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+func (b *Backup) applyDeletion(destPath, backupRoot, path string, now time.Time) error {
+	// Older snapshots keep their copy and the new one simply doesn't contain it
+	if b.snapshots {
+		return nil
+	}
+
+	switch b.deletionPolicy {
+	case DeletionMove, DeletionDelete:
+	default:
+		slog.Info("source deleted, keeping backup copy", "path", path)
+		return nil
+	}
+
+	remover, ok := b.copier.(copier.Remover)
+	if !ok {
+		return fmt.Errorf("copier does not support deleting files")
+	}
+
+	var err error
+	if b.deletionPolicy == DeletionMove {
+		movedPath := filepath.Join(backupRoot, b.deviceID+DeletedDir, now.UTC().Format(timestampFormat), path)
+		slog.Info("source deleted, moving backup copy aside", "path", path, "to", movedPath)
+		err = remover.Rename(destPath, movedPath)
+	} else {
+		slog.Info("source deleted, removing backup copy", "path", path)
+		err = remover.Remove(destPath)
+	}
+
+	// Already gone from the backup is fine, the state entry can still go
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// availableRoots returns the scanned paths that currently exist, plus their
+// symlink targets, where older versions recorded the files below a linked
+// path. Entries under a missing root (e.g. an unmounted drive) are never touched.
+func availableRoots(paths []string) []string {
+	var roots []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			slog.Warn("backup path unavailable, not propagating deletions under it", "path", path, "error", err)
+			continue
+		}
+		roots = append(roots, filepath.Clean(path))
+		if resolved, err := filepath.EvalSymlinks(path); err == nil && resolved != filepath.Clean(path) {
+			roots = append(roots, resolved)
+		}
+	}
+	return roots
+}
+
+func underAny(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/scanner"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+// deletionFixture backs up two files, deletes one locally and returns the paths involved
+func deletionFixture(t *testing.T) (srcDir, dstDir, deletedPath string, st *state.State) {
+	t.Helper()
+
+	tmpDir := t.TempDir()
+	srcDir = filepath.Join(tmpDir, "src")
+	dstDir = filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatalf("failed to create source directory: %v", err)
+	}
+
+	deletedPath = filepath.Join(srcDir, "deleted.txt")
+	for _, path := range []string{deletedPath, filepath.Join(srcDir, "kept.txt")} {
+		if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+	}
+
+	st = state.New()
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), copier.NewLocalCopier(dstDir), st, "test-device")
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("first backup failed: %v", err)
+	}
+
+	if err := os.Remove(deletedPath); err != nil {
+		t.Fatalf("failed to delete source file: %v", err)
+	}
+	return srcDir, dstDir, deletedPath, st
+}
+
+func runWithPolicy(t *testing.T, srcDir, dstDir string, st *state.State, policy DeletionPolicy, grace time.Duration) {
+	t.Helper()
+
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), copier.NewLocalCopier(dstDir), st, "test-device")
+	b.SetDeletionPolicy(policy, grace)
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+}
+
+func TestDeletionPolicyDelete(t *testing.T) {
+	srcDir, dstDir, deletedPath, st := deletionFixture(t)
+
+	runWithPolicy(t, srcDir, dstDir, st, DeletionDelete, 0)
+
+	if _, err := os.Stat(filepath.Join(dstDir, "test-device", deletedPath)); !os.IsNotExist(err) {
+		t.Error("backup copy of deleted file should be removed")
+	}
+	if _, exists := st.GetFileState(deletedPath); exists {
+		t.Error("state entry of deleted file should be removed")
+	}
+	if st.FileCount() != 1 {
+		t.Errorf("expected 1 file in state, got %d", st.FileCount())
+	}
+}
+
+func TestDeletionPolicyMove(t *testing.T) {
+	srcDir, dstDir, deletedPath, st := deletionFixture(t)
+
+	runWithPolicy(t, srcDir, dstDir, st, DeletionMove, 0)
+
+	if _, err := os.Stat(filepath.Join(dstDir, "test-device", deletedPath)); !os.IsNotExist(err) {
+		t.Error("backup copy of deleted file should be moved away")
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dstDir, "test-device"+DeletedDir, "*", deletedPath))
+	if len(matches) != 1 {
+		t.Errorf("expected deleted file under test-device%s/<timestamp>/, found %v", DeletedDir, matches)
+	}
+	if _, exists := st.GetFileState(deletedPath); exists {
+		t.Error("state entry of deleted file should be removed")
+	}
+}
+
+func TestDeletionPolicyKeep(t *testing.T) {
+	srcDir, dstDir, deletedPath, st := deletionFixture(t)
+
+	runWithPolicy(t, srcDir, dstDir, st, DeletionKeep, 0)
+
+	if _, err := os.Stat(filepath.Join(dstDir, "test-device", deletedPath)); err != nil {
+		t.Errorf("backup copy should be kept: %v", err)
+	}
+	if _, exists := st.GetFileState(deletedPath); exists {
+		t.Error("state entry of deleted file should be removed")
+	}
+}
+
+func TestDeletionGracePeriod(t *testing.T) {
+	srcDir, dstDir, deletedPath, st := deletionFixture(t)
+
+	runWithPolicy(t, srcDir, dstDir, st, DeletionDelete, time.Hour)
+
+	fileState, exists := st.GetFileState(deletedPath)
+	if !exists {
+		t.Fatal("state entry should be kept during the grace period")
+	}
+	if fileState.MissingSince == "" {
+		t.Error("state entry should be marked missing")
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "test-device", deletedPath)); err != nil {
+		t.Errorf("backup copy should be kept during the grace period: %v", err)
+	}
+
+	// The file comes back before the grace period ends
+	if err := os.WriteFile(deletedPath, []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to recreate file: %v", err)
+	}
+	runWithPolicy(t, srcDir, dstDir, st, DeletionDelete, time.Hour)
+
+	fileState, _ = st.GetFileState(deletedPath)
+	if fileState.MissingSince != "" {
+		t.Error("missing marker should be cleared once the file is seen again")
+	}
+}
+
+func TestDeletionSkipsUnavailableRoot(t *testing.T) {
+	srcDir, dstDir, _, st := deletionFixture(t)
+
+	// The whole source path disappears, e.g. an unmounted drive
+	if err := os.RemoveAll(srcDir); err != nil {
+		t.Fatalf("failed to remove source directory: %v", err)
+	}
+
+	runWithPolicy(t, srcDir, dstDir, st, DeletionDelete, 0)
+
+	if st.FileCount() != 2 {
+		t.Errorf("expected state to be untouched for an unavailable root, got %d files", st.FileCount())
+	}
+}
+
+func TestDeletionSkipsUnreadablePaths(t *testing.T) {
+	srcDir, dstDir, deletedPath, st := deletionFixture(t)
+
+	// As if the scan failed to read the file, e.g. permission denied
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), copier.NewLocalCopier(dstDir), st, "test-device")
+	b.SetDeletionPolicy(DeletionDelete, 0)
+	seen := map[string]bool{filepath.Join(srcDir, "kept.txt"): true}
+	result := newResult("test-device", []string{srcDir}, time.Now())
+	if removed := b.propagateDeletions([]string{srcDir}, seen, []string{deletedPath}, dstDir, time.Now(), result); removed != 0 {
+		t.Errorf("expected nothing removed under an unreadable path, got %d", removed)
+	}
+	if fileState, exists := st.GetFileState(deletedPath); !exists || fileState.MissingSince != "" {
+		t.Errorf("expected state entry to be untouched, got %+v (exists=%v)", fileState, exists)
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "test-device", deletedPath)); err != nil {
+		t.Errorf("backup copy should be kept: %v", err)
+	}
+
+	if removed := b.propagateDeletions([]string{srcDir}, seen, nil, dstDir, time.Now(), result); removed != 1 {
+		t.Errorf("expected the deleted file to be removed once readable, got %d", removed)
+	}
+}
+
+func TestParseDeletionPolicy(t *testing.T) {
+	for _, valid := range []string{"keep", "move", "delete", ""} {
+		if _, err := ParseDeletionPolicy(valid); err != nil {
+			t.Errorf("ParseDeletionPolicy(%q) returned error: %v", valid, err)
+		}
+	}
+	if _, err := ParseDeletionPolicy("shred"); err == nil {
+		t.Error("expected error for unknown policy, got nil")
+	}
+}
@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/scanner"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+// processLink backs up a symlink the scanner preserved. The link is recreated
+// at the destination, or recorded in the sidecar when the copier can't store
+// links. It only counts as changed when it points somewhere else.
+func (b *Backup) processLink(file scanner.FileInfo, run *fileRun) fileResult {
+	symlinker, canLink := b.copier.(copier.Symlinker)
+	if !canLink {
+		run.sidecar.SetLink(file.Path, file.LinkTarget)
+	}
+
+	fileState, exists, err := b.state.Get(file.Path)
+	if err != nil {
+		slog.Warn("failed to read state, treating link as new", "path", file.Path, "error", err)
+		exists = false
+	}
+	unchanged := exists && fileState.LinkTarget == file.LinkTarget
+
+	// A snapshot gets the link again, which is as cheap as linking the
+	// previous snapshot's
+	if canLink && (!unchanged || run.snapshot != nil) {
+		destPath := filepath.Join(run.destRoot, file.Path)
+		if err := symlinker.Symlink(file.LinkTarget, destPath); err != nil {
+			slog.Error("failed to link file", "path", file.Path, "target", file.LinkTarget, "error", err)
+			return fileResult{outcome: outcomeFailed, op: "symlink", err: err}
+		}
+	}
+
+	if unchanged {
+		slog.Debug("link unchanged, skipping", "path", file.Path)
+		if fileState.MissingSince != "" {
+			fileState.MissingSince = ""
+			if err := b.state.Put(file.Path, fileState); err != nil {
+				slog.Warn("failed to update state", "path", file.Path, "error", err)
+			}
+		}
+		return fileResult{outcome: outcomeSkipped}
+	}
+
+	updated := state.FileState{
+		Size:       file.Size,
+		ModTime:    file.ModTime,
+		BackedUp:   time.Now().Format(time.RFC3339),
+		LinkTarget: file.LinkTarget,
+	}
+	if err := b.state.Put(file.Path, updated); err != nil {
+		slog.Error("failed to update state", "path", file.Path, "error", err)
+		return fileResult{outcome: outcomeFailed, op: "state", err: err}
+	}
+	return fileResult{outcome: outcomeCopied}
+}
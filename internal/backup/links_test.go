@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/scanner"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+// plainCopier hides everything but copying, like a destination that can't
+// hold links
+type plainCopier struct {
+	c *copier.LocalCopier
+}
+
+func (p plainCopier) Copy(ctx context.Context, src, dst string) (int64, error) {
+	return p.c.Copy(ctx, src, dst)
+}
+
+func (p plainCopier) Close() error {
+	return p.c.Close()
+}
+
+// linkTree creates src/real.txt and src/current pointing at it
+func linkTree(t *testing.T, tmpDir string) (srcDir, link string) {
+	t.Helper()
+	srcDir = filepath.Join(tmpDir, "src")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "real.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link = filepath.Join(srcDir, "current")
+	if err := os.Symlink("real.txt", link); err != nil {
+		t.Skip("symlink creation not supported on this platform")
+	}
+	return srcDir, link
+}
+
+func TestPreservedLinksAreRecreated(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir, link := linkTree(t, tmpDir)
+
+	s := scanner.New([]string{})
+	s.SetSymlinks(scanner.SymlinksPreserve)
+	dstDir := filepath.Join(tmpDir, "backup")
+	c := copier.NewLocalCopier(dstDir)
+	st := state.New()
+	b := New(s, detector.NewSizeDetector(), c, st, "test-device")
+
+	backedUpLink := filepath.Join(dstDir, "test-device", link)
+	run := func() *Result {
+		t.Helper()
+		result, err := b.Run(context.Background(), []string{srcDir}, dstDir)
+		if err != nil {
+			t.Fatalf("backup failed: %v", err)
+		}
+		return result
+	}
+
+	if result := run(); result.Counts.Copied != 2 {
+		t.Errorf("expected file and link to be backed up, got %+v", result.Counts)
+	}
+	if target, err := os.Readlink(backedUpLink); err != nil || target != "real.txt" {
+		t.Errorf("expected link to real.txt in backup, got %q, %v", target, err)
+	}
+	if fileState, _, _ := st.Get(link); fileState.LinkTarget != "real.txt" {
+		t.Errorf("expected link target in state, got %+v", fileState)
+	}
+
+	if result := run(); result.Counts.Skipped != 2 {
+		t.Errorf("expected unchanged link to be skipped, got %+v", result.Counts)
+	}
+
+	// Pointing the link elsewhere changes it, whatever its size and time
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real.old", link); err != nil {
+		t.Fatal(err)
+	}
+	if result := run(); result.Counts.Copied != 1 {
+		t.Errorf("expected repointed link to be backed up, got %+v", result.Counts)
+	}
+	if target, _ := os.Readlink(backedUpLink); target != "real.old" {
+		t.Errorf("expected link to real.old in backup, got %q", target)
+	}
+}
+
+func TestPreservedLinksGoToSidecarWithoutLinkSupport(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir, link := linkTree(t, tmpDir)
+
+	s := scanner.New([]string{})
+	s.SetSymlinks(scanner.SymlinksPreserve)
+	dstDir := filepath.Join(tmpDir, "backup")
+	local := copier.NewLocalCopier(dstDir)
+	b := New(s, detector.NewSizeDetector(), plainCopier{c: local}, state.New(), "test-device")
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	mirror := filepath.Join(dstDir, "test-device")
+	if _, err := os.Lstat(filepath.Join(mirror, link)); !os.IsNotExist(err) {
+		t.Errorf("expected nothing at the link's path, got %v", err)
+	}
+	sidecar, err := LoadSidecar(local, mirror)
+	if err != nil || sidecar == nil {
+		t.Fatalf("expected sidecar, got %v", err)
+	}
+	if target := sidecar.Link(link); target != "real.txt" {
+		t.Errorf("expected link in sidecar, got %q", target)
+	}
+	if sidecar.Get(link) != nil {
+		t.Error("expected no metadata without preserve_metadata")
+	}
+}
+
+func TestFollowedLinksKeepTheirPath(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	dataDir := filepath.Join(tmpDir, "data")
+	for _, dir := range []string{srcDir, dataDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "a.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dataDir, filepath.Join(srcDir, "data")); err != nil {
+		t.Skip("symlink creation not supported on this platform")
+	}
+
+	dstDir := filepath.Join(tmpDir, "backup")
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), copier.NewLocalCopier(dstDir), state.New(), "test-device")
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	mirror := filepath.Join(dstDir, "test-device")
+	info, err := os.Lstat(filepath.Join(mirror, srcDir, "data", "a.txt"))
+	if err != nil || !info.Mode().IsRegular() {
+		t.Errorf("expected the target's file under the link's path, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mirror, dataDir)); !os.IsNotExist(err) {
+		t.Errorf("expected nothing under the target's path, got %v", err)
+	}
+}
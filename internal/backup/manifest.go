@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/scanner"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+const manifestFile = "manifest.json"
+
+// Version is reported in manifests, set at build time with
+// -ldflags "-X github.com/mackeper/m_backuper/internal/backup.Version=..."
+var Version = "dev"
+
+// Manifest describes the run that last wrote a mirror or snapshot and lists
+// the files it holds with their state entries, so the destination can be
+// understood, restored and turned back into state without walking it.
+//
+//nolint:govet // fieldalignment: field order optimized for JSON readability
+type Manifest struct {
+	RunID       string    `json:"run_id"`
+	DeviceID    string    `json:"device_id"`
+	Snapshot    string    `json:"snapshot,omitempty"`
+	Version     string    `json:"version"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	Interrupted bool      `json:"interrupted,omitempty"`
+	// Complete is set when Files lists everything in the mirror or snapshot.
+	// A mirror written before manifests existed may hold files no run listed.
+	Complete bool                       `json:"complete"`
+	Counts   Counts                     `json:"counts"`
+	Files    map[string]state.FileState `json:"files"` // keyed by source path
+}
+
+// ManifestPath returns the manifest of a mirror or snapshot root
+func ManifestPath(root string) string {
+	return filepath.Join(MetaRoot(root), manifestFile)
+}
+
+// LoadManifest reads the manifest of a mirror or snapshot root. It returns nil
+// when the backup was made before manifests were written.
+func LoadManifest(r copier.Restorer, root string) (*Manifest, error) {
+	manifestPath := ManifestPath(root)
+	f, err := r.Open(manifestPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("failed to close manifest", "path", manifestPath, "error", err)
+		}
+	}()
+
+	var m Manifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]state.FileState)
+	}
+	return &m, nil
+}
+
+// startManifest begins the manifest of a run. A mirror carries over the files
+// its previous manifest listed, a snapshot only holds what this run puts in it.
+func (b *Backup) startManifest(run *fileRun, startTime time.Time) *Manifest {
+	m := &Manifest{
+		RunID:    startTime.UTC().Format(timestampFormat),
+		DeviceID: b.deviceID,
+		Version:  Version,
+		Started:  startTime,
+		Complete: true,
+		Files:    make(map[string]state.FileState),
+	}
+	if run.snapshot != nil {
+		m.RunID = run.snapshot.name
+		m.Snapshot = run.snapshot.name
+		// An unfinished snapshot may hold files of sources deleted since
+		m.Complete = !run.snapshot.resumed
+		return m
+	}
+
+	restorer, ok := b.copier.(copier.Restorer)
+	if !ok {
+		m.Complete = false
+		return m
+	}
+	prev, err := LoadManifest(restorer, run.destRoot)
+	if err != nil {
+		slog.Warn("failed to load previous manifest", "error", err)
+	}
+	if prev != nil {
+		run.prevManifest = prev
+		m.Complete = prev.Complete
+		return m
+	}
+	// Without a manifest only an empty mirror is fully known
+	if _, err := restorer.Stat(run.destRoot); !errors.Is(err, fs.ErrNotExist) {
+		m.Complete = false
+	}
+	return m
+}
+
+// writeManifest fills in the files of the run and writes the manifest.
+// extra are files the run didn't process but that are in the tree anyway,
+// e.g. linked into an interrupted snapshot.
+func (b *Backup) writeManifest(run *fileRun, extra []scanner.FileInfo) error {
+	m := run.manifest
+	m.Finished = time.Now()
+
+	add := func(path string) {
+		fileState, exists, err := b.state.Get(path)
+		if err != nil {
+			slog.Warn("failed to read state for manifest", "path", path, "error", err)
+			m.Complete = false
+			return
+		}
+		if exists {
+			fileState.MissingSince = ""
+			m.Files[path] = fileState
+		}
+	}
+	for _, path := range run.placed {
+		add(path)
+	}
+	for _, file := range extra {
+		add(file.Path)
+	}
+
+	// Earlier copies stay in the mirror until a deletion policy removes them
+	if run.prevManifest != nil {
+		restorer, _ := b.copier.(copier.Restorer)
+		for path, fileState := range run.prevManifest.Files {
+			if _, listed := m.Files[path]; listed {
+				continue
+			}
+			if _, err := restorer.Stat(filepath.Join(run.destRoot, path)); err == nil {
+				m.Files[path] = fileState
+			}
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return b.writeFile(ManifestPath(run.destRoot), data)
+}
@@ -0,0 +1,110 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+func loadManifest(t *testing.T, root string) *Manifest {
+	t.Helper()
+	m, err := LoadManifest(copier.NewLocalCopier(root), root)
+	if err != nil {
+		t.Fatalf("failed to load manifest: %v", err)
+	}
+	if m == nil {
+		t.Fatalf("expected a manifest in %s", root)
+	}
+	return m
+}
+
+func TestManifestDescribesMirror(t *testing.T) {
+	srcDir, dstDir, deletedPath, st := deletionFixture(t)
+	deviceRoot := filepath.Join(dstDir, "test-device")
+	kept := filepath.Join(srcDir, "kept.txt")
+
+	first := loadManifest(t, deviceRoot)
+	if !first.Complete || first.DeviceID != "test-device" || first.Version != Version {
+		t.Errorf("unexpected manifest header %+v", first)
+	}
+	if first.Counts.Copied != 2 || first.Counts.Bytes != int64(2*len("content")) {
+		t.Errorf("unexpected counts %+v", first.Counts)
+	}
+	if len(first.Files) != 2 || first.Files[kept].Size != int64(len("content")) {
+		t.Errorf("expected both files listed, got %v", first.Files)
+	}
+
+	// With the keep policy the deleted file's copy stays, and so does its entry
+	runWithPolicy(t, srcDir, dstDir, st, DeletionKeep, 0)
+	second := loadManifest(t, deviceRoot)
+	if second.Counts.Skipped != 1 || second.Counts.Deleted != 1 {
+		t.Errorf("unexpected counts %+v", second.Counts)
+	}
+	if _, listed := second.Files[deletedPath]; !listed || !second.Complete {
+		t.Error("expected the kept copy to stay in a complete manifest")
+	}
+
+	// Once the copy is removed it drops out
+	if err := os.WriteFile(deletedPath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runWithPolicy(t, srcDir, dstDir, st, DeletionKeep, 0)
+	if err := os.Remove(deletedPath); err != nil {
+		t.Fatal(err)
+	}
+	runWithPolicy(t, srcDir, dstDir, st, DeletionDelete, 0)
+	if _, listed := loadManifest(t, deviceRoot).Files[deletedPath]; listed {
+		t.Error("expected the removed copy to drop out of the manifest")
+	}
+}
+
+func TestManifestOfMirrorWithoutOneIsIncomplete(t *testing.T) {
+	srcDir, dstDir, _, st := deletionFixture(t)
+	deviceRoot := filepath.Join(dstDir, "test-device")
+
+	// As left by a version that didn't write manifests
+	if err := os.Remove(ManifestPath(deviceRoot)); err != nil {
+		t.Fatal(err)
+	}
+	runWithPolicy(t, srcDir, dstDir, st, DeletionKeep, 0)
+
+	if loadManifest(t, deviceRoot).Complete {
+		t.Error("expected manifest of a mirror with unknown files to be incomplete")
+	}
+}
+
+func TestManifestDescribesSnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	dstDir := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	deleted := filepath.Join(srcDir, "deleted.txt")
+	for _, path := range []string{deleted, filepath.Join(srcDir, "kept.txt")} {
+		if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := state.New()
+	first := runSnapshot(t, srcDir, dstDir, st)
+	if err := os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+	second := runSnapshot(t, srcDir, dstDir, st)
+
+	m := loadManifest(t, SnapshotRoot(dstDir, "test-device", second))
+	if m.Snapshot != second || m.RunID != second || !m.Complete {
+		t.Errorf("unexpected manifest header %+v", m)
+	}
+	if len(m.Files) != 1 {
+		t.Errorf("expected only the kept file in the new snapshot, got %v", m.Files)
+	}
+	if len(loadManifest(t, SnapshotRoot(dstDir, "test-device", first)).Files) != 2 {
+		t.Error("expected the older snapshot's manifest to keep both files")
+	}
+}
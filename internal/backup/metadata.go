@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/metadata"
+)
+
+// MetaDir holds m_backuper's own files for the mirror and every snapshot. It
+// sits next to them rather than inside, so it can't collide with a backed up
+// path: <backup_root>/.m_backuper/<device_id> for the mirror and
+// <device_id>.snapshots/.m_backuper/<name> for a snapshot.
+const MetaDir = ".m_backuper"
+
+const sidecarFile = "metadata.json"
+
+// SetPreserveMetadata records mode, times, ownership and extended attributes
+// of every file in a sidecar, so a restore can reapply them even when the
+// destination couldn't hold them
+func (b *Backup) SetPreserveMetadata(enabled bool) {
+	b.preserveMetadata = enabled
+}
+
+// MetaRoot returns the directory holding m_backuper's own files for a mirror
+// or snapshot root
+func MetaRoot(root string) string {
+	return filepath.Join(filepath.Dir(root), MetaDir, filepath.Base(root))
+}
+
+// SidecarPath returns the metadata sidecar of a mirror or snapshot root
+func SidecarPath(root string) string {
+	return filepath.Join(MetaRoot(root), sidecarFile)
+}
+
+// LoadSidecar reads the metadata sidecar of a mirror or snapshot root. It
+// returns nil when the backup was made without preserve_metadata and has no
+// links the destination couldn't store.
+func LoadSidecar(r copier.Restorer, root string) (*metadata.Sidecar, error) {
+	sidecarPath := SidecarPath(root)
+	f, err := r.Open(sidecarPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata sidecar: %w", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("failed to close metadata sidecar", "path", sidecarPath, "error", err)
+		}
+	}()
+	return metadata.ReadSidecar(f)
+}
+
+// captureMetadata adds a file's metadata to the sidecar of this run
+func captureMetadata(sidecar *metadata.Sidecar, path string, info fs.FileInfo) {
+	m, err := metadata.Capture(path, info)
+	if err != nil {
+		slog.Debug("failed to read some metadata", "path", path, "error", err)
+	}
+	if m != nil {
+		sidecar.Set(path, m)
+	}
+}
+
+func (b *Backup) writeSidecar(root string, sidecar *metadata.Sidecar) error {
+	data, err := sidecar.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata sidecar: %w", err)
+	}
+	return b.writeFile(SidecarPath(root), data)
+}
@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// Result summarizes a run for reports and scripts
+//
+//nolint:govet // fieldalignment: field order optimized for JSON readability
+type Result struct {
+	RunID        string        `json:"run_id"`
+	DeviceID     string        `json:"device_id"`
+	Snapshot     string        `json:"snapshot,omitempty"`
+	Started      time.Time     `json:"started"`
+	Finished     time.Time     `json:"finished"`
+	Duration     time.Duration `json:"duration_ns"`
+	Interrupted  bool          `json:"interrupted,omitempty"`
+	Remaining    int           `json:"remaining,omitempty"` // files found that an interrupted run didn't get to
+	Counts       Counts        `json:"counts"`
+	Roots        []RootResult  `json:"roots"`
+	Errors       []FileError   `json:"errors"`
+	SkippedPaths []SkippedPath `json:"skipped_paths"` // passed over by the scan, unlike unchanged files counted as skipped
+}
+
+//nolint:govet // fieldalignment: field order optimized for JSON readability
+type Counts struct {
+	Total   int   `json:"total"`
+	Copied  int   `json:"copied"`
+	Skipped int   `json:"skipped"`
+	Failed  int   `json:"failed"`
+	Deleted int   `json:"deleted"`
+	Bytes   int64 `json:"bytes"` // copied this run
+}
+
+// RootResult is the share of a run of one of the paths to back up
+//
+//nolint:govet // fieldalignment: field order optimized for JSON readability
+type RootResult struct {
+	Path    string `json:"path"`
+	Total   int    `json:"total"`
+	Copied  int    `json:"copied"`
+	Skipped int    `json:"skipped"`
+	Failed  int    `json:"failed"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// SkippedPath is something the scan found but couldn't back up
+type SkippedPath struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"` // e.g. "fifo" or "other_filesystem"
+}
+
+// FileError is a single failure of a run
+type FileError struct {
+	Path  string `json:"path"`
+	Op    string `json:"op"` // what failed, e.g. "copy" or "deletion"
+	Error string `json:"error"`
+}
+
+func newResult(deviceID string, paths []string, started time.Time) *Result {
+	r := &Result{
+		RunID:        started.UTC().Format(timestampFormat),
+		DeviceID:     deviceID,
+		Started:      started,
+		Roots:        make([]RootResult, len(paths)),
+		Errors:       []FileError{},
+		SkippedPaths: []SkippedPath{},
+	}
+	for i, path := range paths {
+		r.Roots[i].Path = path
+	}
+	return r
+}
+
+func (r *Result) addError(path, op string, err error) {
+	r.Errors = append(r.Errors, FileError{Path: path, Op: op, Error: err.Error()})
+}
+
+func (r *Result) finish() {
+	r.Finished = time.Now()
+	r.Duration = r.Finished.Sub(r.Started)
+}
+
+// rootIndex finds which of the paths to back up a scanned file belongs to
+type rootIndex struct {
+	prefixes []string // cleaned, per root
+}
+
+func newRootIndex(paths []string) *rootIndex {
+	idx := &rootIndex{prefixes: make([]string, len(paths))}
+	for i, path := range paths {
+		idx.prefixes[i] = filepath.Clean(path)
+	}
+	return idx
+}
+
+// of returns the index of the root holding path, preferring the deepest one,
+// or -1 when none does
+func (idx *rootIndex) of(path string) int {
+	best, bestLen := -1, -1
+	for i, prefix := range idx.prefixes {
+		if len(prefix) > bestLen && underAny(path, []string{prefix}) {
+			best, bestLen = i, len(prefix)
+		}
+	}
+	return best
+}
@@ -0,0 +1,271 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/scanner"
+)
+
+// SnapshotsDir is appended to the device ID to name the directory holding one
+// directory per run in snapshot mode, <backup_root>/<device_id>.snapshots. It
+// sits next to the mirror so it can't collide with a backed up path.
+// Snapshots are named by their UTC start time in RFC3339 form with ':' replaced
+// by '-' (see timestampFormat), so names sort chronologically.
+const SnapshotsDir = ".snapshots"
+
+// LatestFile holds the name of the newest snapshot, in the snapshots directory.
+// It is a plain file rather than a symlink so it also works on SMB shares.
+const LatestFile = "latest"
+
+// snapshotRun tracks where the current run writes and where it links from
+type snapshotRun struct {
+	name     string
+	root     string // <device_id>.snapshots/<name>
+	prevRoot string // previous snapshot, empty for the first one
+	resumed  bool   // root was started by a run that didn't finish
+}
+
+// SetSnapshots switches between updating a single mirror in place and writing
+// every run to a new snapshot that hard-links unchanged files from the previous one
+func (b *Backup) SetSnapshots(enabled bool) {
+	b.snapshots = enabled
+}
+
+// SnapshotsRoot returns the directory holding the snapshots of a device
+func SnapshotsRoot(backupRoot, deviceID string) string {
+	return filepath.Join(backupRoot, deviceID+SnapshotsDir)
+}
+
+// SnapshotRoot returns the directory holding the files of a snapshot
+func SnapshotRoot(backupRoot, deviceID, name string) string {
+	return filepath.Join(SnapshotsRoot(backupRoot, deviceID), name)
+}
+
+// ParseSnapshotTime returns the start time encoded in a snapshot name,
+// ignoring the "-N" suffix added when two runs start within the same second
+func ParseSnapshotTime(name string) (time.Time, error) {
+	if len(name) > len(timestampFormat) && name[len(timestampFormat)] == '-' {
+		name = name[:len(timestampFormat)]
+	}
+	t, err := time.Parse(timestampFormat, name)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid snapshot name %q: %w", name, err)
+	}
+	return t, nil
+}
+
+// LatestSnapshot reads the latest pointer of a device. It returns "" when no
+// snapshot has been written yet.
+func LatestSnapshot(r copier.Restorer, backupRoot, deviceID string) (string, error) {
+	latestPath := filepath.Join(SnapshotsRoot(backupRoot, deviceID), LatestFile)
+	f, err := r.Open(latestPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open latest pointer: %w", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("failed to close latest pointer", "path", latestPath, "error", err)
+		}
+	}()
+
+	data, err := io.ReadAll(io.LimitReader(f, 256))
+	if err != nil {
+		return "", fmt.Errorf("failed to read latest pointer: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// UnfinishedSnapshot returns the newest snapshot when it is newer than latest,
+// i.e. its run crashed or was interrupted before pointing latest at it. State
+// may already record files only that snapshot holds, so the next run resumes
+// it instead of starting a new one. It returns "" when there is none.
+func UnfinishedSnapshot(names []string, latest string) string {
+	newest := ""
+	for _, name := range names {
+		if _, err := ParseSnapshotTime(name); err == nil && name > newest {
+			newest = name
+		}
+	}
+	if newest > latest {
+		return newest
+	}
+	return ""
+}
+
+// ListSnapshots returns the snapshot names of a device, oldest first
+func ListSnapshots(r copier.Restorer, backupRoot, deviceID string) ([]string, error) {
+	snapshotsDir := SnapshotsRoot(backupRoot, deviceID)
+	entries, err := r.ReadDir(snapshotsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots in %s: %w", snapshotsDir, err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		// Dot directories hold metadata or snapshots being pruned
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// startSnapshot picks the directory for this run and finds the previous
+// snapshot to link unchanged files from
+func (b *Backup) startSnapshot(backupRoot string, now time.Time) *snapshotRun {
+	run := &snapshotRun{name: now.UTC().Format(timestampFormat)}
+
+	reader, ok := b.copier.(copier.Restorer)
+	if !ok {
+		slog.Warn("backup root can't be read back, every snapshot is a full copy")
+	} else {
+		prev, err := LatestSnapshot(reader, backupRoot, b.deviceID)
+		if err != nil {
+			slog.Warn("failed to read latest snapshot, every file will be copied", "error", err)
+		} else if prev != "" {
+			run.prevRoot = SnapshotRoot(backupRoot, b.deviceID, prev)
+		}
+
+		names, err := ListSnapshots(reader, backupRoot, b.deviceID)
+		if err != nil {
+			slog.Warn("failed to list snapshots", "error", err)
+		}
+		if unfinished := UnfinishedSnapshot(names, prev); err == nil && unfinished != "" {
+			slog.Info("resuming unfinished snapshot", "snapshot", unfinished)
+			run.name = unfinished
+			run.resumed = true
+		} else {
+			// Two runs within the same second must not share a directory
+			base := run.name
+			for i := 2; ; i++ {
+				if _, err := reader.Stat(SnapshotRoot(backupRoot, b.deviceID, run.name)); err != nil {
+					break
+				}
+				run.name = fmt.Sprintf("%s-%d", base, i)
+			}
+		}
+	}
+
+	if _, ok := b.copier.(copier.Linker); !ok {
+		slog.Warn("copier can't hard-link, unchanged files are copied again into every snapshot",
+			"copier", fmt.Sprintf("%T", b.copier))
+	}
+
+	run.root = SnapshotRoot(backupRoot, b.deviceID, run.name)
+	slog.Info("writing snapshot", "snapshot", run.name, "previous", run.prevRoot)
+	return run
+}
+
+// carryOver puts an unchanged file into the new snapshot, hard-linking the
+// previous snapshot's copy when possible and copying from the source otherwise
+func (b *Backup) carryOver(ctx context.Context, run *snapshotRun, srcPath, destPath string) error {
+	// A resumed snapshot already holds what the unfinished run put there
+	if run.resumed {
+		if reader, ok := b.copier.(copier.Restorer); ok {
+			if _, err := reader.Stat(destPath); err == nil {
+				return nil
+			}
+		}
+	}
+
+	if linker, ok := b.copier.(copier.Linker); ok && run.prevRoot != "" {
+		err := linker.Link(filepath.Join(run.prevRoot, srcPath), destPath)
+		if err == nil {
+			return nil
+		}
+		slog.Debug("failed to link from previous snapshot, copying", "path", srcPath, "error", err)
+	}
+
+	_, err := b.copier.Copy(ctx, srcPath, destPath)
+	return err
+}
+
+// completeSnapshot links the files an interrupted run didn't get to from the
+// previous snapshot and reports whether latest may point at the new one.
+// Without hard links that would take a full copy, so the snapshot is left
+// unfinished for the next run to resume.
+func (b *Backup) completeSnapshot(run *fileRun, remaining []scanner.FileInfo) bool {
+	linker, ok := b.copier.(copier.Linker)
+	if !ok {
+		return false
+	}
+	if run.snapshot.prevRoot == "" {
+		return true
+	}
+
+	for _, file := range remaining {
+		destPath := filepath.Join(run.destRoot, file.Path)
+		if err := linker.Link(filepath.Join(run.snapshot.prevRoot, file.Path), destPath); err != nil {
+			// Files that were never backed up aren't in the previous snapshot
+			slog.Debug("failed to link from previous snapshot", "path", file.Path, "error", err)
+			continue
+		}
+		if b.preserveMetadata {
+			if info, err := os.Stat(file.Path); err == nil {
+				captureMetadata(run.sidecar, file.Path, info)
+			}
+		}
+	}
+	return true
+}
+
+// unscannedFiles returns the files of the previous snapshot that this run
+// neither processed nor found before its scan was cut short, from the
+// previous snapshot's manifest. It reports false when they can't be known.
+func (b *Backup) unscannedFiles(run *fileRun, remaining []scanner.FileInfo) ([]scanner.FileInfo, bool) {
+	if run.snapshot.prevRoot == "" {
+		return nil, true
+	}
+	restorer, ok := b.copier.(copier.Restorer)
+	if !ok {
+		return nil, false
+	}
+	prev, err := LoadManifest(restorer, run.snapshot.prevRoot)
+	if err != nil {
+		slog.Warn("failed to load manifest of previous snapshot", "error", err)
+	}
+	if prev == nil || !prev.Complete {
+		return nil, false
+	}
+
+	reached := make(map[string]bool, len(run.placed)+len(remaining))
+	for _, path := range run.placed {
+		reached[path] = true
+	}
+	for _, file := range remaining {
+		reached[file.Path] = true
+	}
+	var unscanned []scanner.FileInfo
+	for path := range prev.Files {
+		if !reached[path] {
+			unscanned = append(unscanned, scanner.FileInfo{Path: path})
+		}
+	}
+	return unscanned, true
+}
+
+// finishSnapshot points latest at the snapshot written by this run
+func (b *Backup) finishSnapshot(backupRoot string, run *snapshotRun) error {
+	if err := b.writeFile(filepath.Join(SnapshotsRoot(backupRoot, b.deviceID), LatestFile), []byte(run.name+"\n")); err != nil {
+		return fmt.Errorf("failed to update latest pointer: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/scanner"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+func runSnapshot(t *testing.T, srcDir, dstDir string, st *state.State) string {
+	t.Helper()
+
+	c := copier.NewLocalCopier(dstDir)
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), c, st, "test-device")
+	b.SetSnapshots(true)
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	latest, err := LatestSnapshot(c, dstDir, "test-device")
+	if err != nil {
+		t.Fatalf("failed to read latest snapshot: %v", err)
+	}
+	if latest == "" {
+		t.Fatal("expected latest pointer to be written")
+	}
+	return latest
+}
+
+func TestSnapshotsLinkUnchangedFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	dstDir := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatalf("failed to create source directory: %v", err)
+	}
+
+	unchanged := filepath.Join(srcDir, "unchanged.txt")
+	changed := filepath.Join(srcDir, "changed.txt")
+	if err := os.WriteFile(unchanged, []byte("same"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(changed, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	st := state.New()
+	first := runSnapshot(t, srcDir, dstDir, st)
+
+	if err := os.WriteFile(changed, []byte("version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	second := runSnapshot(t, srcDir, dstDir, st)
+
+	if first == second {
+		t.Fatalf("expected a new snapshot, both runs wrote %s", first)
+	}
+
+	firstRoot := SnapshotRoot(dstDir, "test-device", first)
+	secondRoot := SnapshotRoot(dstDir, "test-device", second)
+
+	// The unchanged file is shared between snapshots
+	firstInfo, err := os.Stat(filepath.Join(firstRoot, unchanged))
+	if err != nil {
+		t.Fatalf("unchanged file missing from first snapshot: %v", err)
+	}
+	secondInfo, err := os.Stat(filepath.Join(secondRoot, unchanged))
+	if err != nil {
+		t.Fatalf("unchanged file missing from second snapshot: %v", err)
+	}
+	if !os.SameFile(firstInfo, secondInfo) {
+		t.Error("expected unchanged file to be hard-linked between snapshots")
+	}
+
+	// The old snapshot keeps the old version
+	if content, _ := os.ReadFile(filepath.Join(firstRoot, changed)); string(content) != "v1" {
+		t.Errorf("first snapshot should keep the old version, got %q", content)
+	}
+	if content, _ := os.ReadFile(filepath.Join(secondRoot, changed)); string(content) != "version 2" {
+		t.Errorf("second snapshot should have the new version, got %q", content)
+	}
+
+	// The mirror is not written in snapshot mode
+	if _, err := os.Stat(filepath.Join(dstDir, "test-device", changed)); !os.IsNotExist(err) {
+		t.Error("expected no mirror copy in snapshot mode")
+	}
+
+	names, err := ListSnapshots(copier.NewLocalCopier(dstDir), dstDir, "test-device")
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if len(names) != 2 || names[0] != first || names[1] != second {
+		t.Errorf("expected snapshots [%s %s], got %v", first, second, names)
+	}
+}
+
+func TestSnapshotsLeaveOutDeletedFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	dstDir := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatalf("failed to create source directory: %v", err)
+	}
+
+	deletedPath := filepath.Join(srcDir, "deleted.txt")
+	for _, path := range []string{deletedPath, filepath.Join(srcDir, "kept.txt")} {
+		if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := state.New()
+	first := runSnapshot(t, srcDir, dstDir, st)
+	if err := os.Remove(deletedPath); err != nil {
+		t.Fatal(err)
+	}
+
+	c := copier.NewLocalCopier(dstDir)
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), c, st, "test-device")
+	b.SetSnapshots(true)
+	b.SetDeletionPolicy(DeletionDelete, 0)
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	second, _ := LatestSnapshot(c, dstDir, "test-device")
+
+	if _, err := os.Stat(filepath.Join(SnapshotRoot(dstDir, "test-device", first), deletedPath)); err != nil {
+		t.Errorf("older snapshot should keep the deleted file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(SnapshotRoot(dstDir, "test-device", second), deletedPath)); !os.IsNotExist(err) {
+		t.Error("new snapshot should not contain the deleted file")
+	}
+}
+
+func TestStartSnapshotAvoidsExistingDirectory(t *testing.T) {
+	dstDir := t.TempDir()
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), copier.NewLocalCopier(dstDir), state.New(), "test-device")
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.MkdirAll(SnapshotRoot(dstDir, "test-device", now.Format(timestampFormat)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.finishSnapshot(dstDir, &snapshotRun{name: now.Format(timestampFormat)}); err != nil {
+		t.Fatal(err)
+	}
+
+	run := b.startSnapshot(dstDir, now)
+	if run.name != "2024-05-01T12-00-00Z-2" {
+		t.Errorf("expected a suffixed snapshot name, got %s", run.name)
+	}
+}
+
+func TestStartSnapshotResumesUnfinishedSnapshot(t *testing.T) {
+	dstDir := t.TempDir()
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), copier.NewLocalCopier(dstDir), state.New(), "test-device")
+
+	for _, name := range []string{"2024-05-01T12-00-00Z", "2024-05-02T12-00-00Z"} {
+		if err := os.MkdirAll(SnapshotRoot(dstDir, "test-device", name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.finishSnapshot(dstDir, &snapshotRun{name: "2024-05-01T12-00-00Z"}); err != nil {
+		t.Fatal(err)
+	}
+
+	run := b.startSnapshot(dstDir, time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC))
+	if run.name != "2024-05-02T12-00-00Z" || !run.resumed {
+		t.Errorf("expected to resume the unfinished snapshot, got %s", run.name)
+	}
+	if run.prevRoot != SnapshotRoot(dstDir, "test-device", "2024-05-01T12-00-00Z") {
+		t.Errorf("expected to link from latest, got %s", run.prevRoot)
+	}
+}
+
+func TestUnfinishedSnapshot(t *testing.T) {
+	names := []string{"2024-05-01T12-00-00Z", "2024-05-02T12-00-00Z", "manual-copy"}
+	if got := UnfinishedSnapshot(names, "2024-05-02T12-00-00Z"); got != "" {
+		t.Errorf("expected no unfinished snapshot, got %s", got)
+	}
+	if got := UnfinishedSnapshot(names, "2024-05-01T12-00-00Z"); got != "2024-05-02T12-00-00Z" {
+		t.Errorf("expected newest snapshot to be unfinished, got %s", got)
+	}
+	if got := UnfinishedSnapshot(names, ""); got != "2024-05-02T12-00-00Z" {
+		t.Errorf("expected snapshot without latest to be unfinished, got %s", got)
+	}
+}
+
+func TestParseSnapshotTime(t *testing.T) {
+	want := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"2024-05-01T12-00-00Z", "2024-05-01T12-00-00Z-2"} {
+		got, err := ParseSnapshotTime(name)
+		if err != nil {
+			t.Errorf("ParseSnapshotTime(%q) returned error: %v", name, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("ParseSnapshotTime(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	if _, err := ParseSnapshotTime("manual-copy"); err == nil {
+		t.Error("expected error for non-timestamp name, got nil")
+	}
+}
+
+func TestInterruptedSnapshotLinksRemainingFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	dstDir := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	changed := filepath.Join(srcDir, "a.txt")
+	unchanged := filepath.Join(srcDir, "b.txt")
+	for _, path := range []string{changed, unchanged} {
+		if err := os.WriteFile(path, []byte("v1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := state.New()
+	first := runSnapshot(t, srcDir, dstDir, st)
+	if err := os.WriteFile(changed, []byte("version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &cancelingCopier{LocalCopier: copier.NewLocalCopier(dstDir), cancel: cancel}
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), c, st, "test-device")
+	b.SetSnapshots(true)
+	if _, err := b.Run(ctx, []string{srcDir}, dstDir); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected interrupted backup, got %v", err)
+	}
+
+	// State records the new version, so latest must hold it too
+	second, err := LatestSnapshot(c, dstDir, "test-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("expected latest to point at the interrupted snapshot")
+	}
+	secondRoot := SnapshotRoot(dstDir, "test-device", second)
+	if data, err := os.ReadFile(filepath.Join(secondRoot, changed)); err != nil || string(data) != "version 2" {
+		t.Errorf("expected copied file in interrupted snapshot, got %q (%v)", data, err)
+	}
+
+	// The file the run didn't reach is linked from the previous snapshot
+	firstInfo, err := os.Stat(filepath.Join(SnapshotRoot(dstDir, "test-device", first), unchanged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondInfo, err := os.Stat(filepath.Join(secondRoot, unchanged))
+	if err != nil {
+		t.Fatalf("expected remaining file in interrupted snapshot: %v", err)
+	}
+	if !os.SameFile(firstInfo, secondInfo) {
+		t.Error("expected remaining file to be hard-linked from the previous snapshot")
+	}
+}
+
+func TestSnapshotInterruptedDuringScanLinksUnscannedFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	dstDir := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// More files than the scan may be ahead, so it is still running when
+	// the first copy cancels the run
+	var paths []string
+	for i := range scanAhead + 50 {
+		path := filepath.Join(srcDir, fmt.Sprintf("%04d.txt", i))
+		if err := os.WriteFile(path, []byte("v1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	st := state.New()
+	first := runSnapshot(t, srcDir, dstDir, st)
+	if err := os.WriteFile(paths[0], []byte("version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &cancelingCopier{LocalCopier: copier.NewLocalCopier(dstDir), cancel: cancel}
+	b := New(scanner.New([]string{}), detector.NewSizeDetector(), c, st, "test-device")
+	b.SetSnapshots(true)
+	result, err := b.Run(ctx, []string{srcDir}, dstDir)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected interrupted backup, got %v", err)
+	}
+	if found := result.Counts.Total + result.Remaining; found >= len(paths) {
+		t.Fatalf("expected the scan to be cut short, found %d files", found)
+	}
+
+	second, err := LatestSnapshot(c, dstDir, "test-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("expected latest to point at the interrupted snapshot")
+	}
+	last := paths[len(paths)-1]
+	firstInfo, err := os.Stat(filepath.Join(SnapshotRoot(dstDir, "test-device", first), last))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondInfo, err := os.Stat(filepath.Join(SnapshotRoot(dstDir, "test-device", second), last))
+	if err != nil {
+		t.Fatalf("expected unscanned file in interrupted snapshot: %v", err)
+	}
+	if !os.SameFile(firstInfo, secondInfo) {
+		t.Error("expected unscanned file to be hard-linked from the previous snapshot")
+	}
+}
@@ -2,20 +2,165 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/mackeper/m_backuper/internal/pathutil"
 )
 
 //nolint:govet // fieldalignment: field order optimized for JSON readability
 type Config struct {
-	BackupRoot            string   `json:"backup_root"`
-	DeviceID              string   `json:"device_id"`
-	PathsToBackup         []string `json:"paths_to_backup"`
-	FilesToIgnorePatterns []string `json:"files_to_ignore_patterns"`
-	SMBUser               string   `json:"smb_user,omitempty"`
-	SMBPassword           string   `json:"smb_password,omitempty"`
+	BackupRoot            string       `json:"backup_root"`
+	DeviceID              string       `json:"device_id"`
+	Profile               string       `json:"profile,omitempty"` // names the state file, default is per backup root and device
+	PathsToBackup         []BackupPath `json:"paths_to_backup"`
+	FilesToIgnorePatterns []string     `json:"files_to_ignore_patterns"`
+	ExcludeCaches         bool         `json:"exclude_caches"`            // skip directories with a valid CACHEDIR.TAG
+	ExcludeMarkers        []string     `json:"exclude_markers,omitempty"` // skip directories holding one of these files, e.g. ".nobackup"
+	Symlinks              string       `json:"symlinks"`                  // follow, preserve or skip
+	OneFileSystem         bool         `json:"one_file_system"`           // don't descend into other mounted filesystems
+	ChangeDetection       string       `json:"change_detection"`          // "size", "mtime" and/or "hash" joined by "+"
+	HashAlgorithm         string       `json:"hash_algorithm,omitempty"`  // md5, sha1, sha256 (default) or sha512
+	DeletionPolicy        string       `json:"deletion_policy"`           // keep, move or delete
+	DeletionGracePeriod   string       `json:"deletion_grace_period"`     // e.g. "168h"
+	Snapshots             bool         `json:"snapshots"`                 // write each run to its own snapshot directory
+	Retention             Retention    `json:"retention"`                 // which snapshots prune keeps
+	PreserveMetadata      bool         `json:"preserve_metadata"`         // keep mode, times, owner and xattrs
+	Concurrency           int          `json:"concurrency"`               // files checked and copied at the same time
+	ScanConcurrency       int          `json:"scan_concurrency"`          // directories read at the same time while scanning
+	CheckpointFiles       int          `json:"checkpoint_files"`          // save state every N files, 0 to disable
+	CheckpointInterval    string       `json:"checkpoint_interval"`       // save state at least this often, e.g. "5m"
+	StateBackend          string       `json:"state_backend"`             // json or bolt
+	SMBUser               string       `json:"smb_user,omitempty"`
+	SMBPassword           string       `json:"smb_password,omitempty"`
+}
+
+// BackupPath is an entry of paths_to_backup. In the config file it's either a
+// plain path or an object with rules for what is backed up below the path.
+// Patterns use gitignore syntax and are relative to the path.
+//
+//nolint:govet // fieldalignment: field order optimized for JSON readability
+type BackupPath struct {
+	Path            string   `json:"path"`
+	Include         []string `json:"include,omitempty"`          // only back up files matching one of these
+	Exclude         []string `json:"exclude,omitempty"`          // ignored on top of files_to_ignore_patterns
+	MaxDepth        int      `json:"max_depth,omitempty"`        // directory levels to descend, 1 for the files in path only
+	ChangeDetection string   `json:"change_detection,omitempty"` // overrides change_detection for these files
+}
+
+func (p BackupPath) hasRules() bool {
+	return len(p.Include) > 0 || len(p.Exclude) > 0 || p.MaxDepth != 0 || p.ChangeDetection != ""
+}
+
+// MarshalJSON writes a path without rules in the plain string form
+func (p BackupPath) MarshalJSON() ([]byte, error) {
+	if !p.hasRules() {
+		return json.Marshal(p.Path)
+	}
+	type object BackupPath
+	return json.Marshal(object(p))
+}
+
+func (p *BackupPath) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*p = BackupPath{Path: path}
+		return nil
+	}
+
+	type object BackupPath
+	var o object
+	if err := json.Unmarshal(data, &o); err != nil {
+		return fmt.Errorf("paths_to_backup entries must be a path or an object: %w", err)
+	}
+	if o.Path == "" {
+		return errors.New("paths_to_backup entry without path")
+	}
+	if o.MaxDepth < 0 {
+		return fmt.Errorf("invalid max_depth %d for %s", o.MaxDepth, o.Path)
+	}
+	*p = BackupPath(o)
+	return nil
+}
+
+func (p BackupPath) String() string {
+	var rules []string
+	if len(p.Include) > 0 {
+		rules = append(rules, "include "+strings.Join(p.Include, " "))
+	}
+	if len(p.Exclude) > 0 {
+		rules = append(rules, "exclude "+strings.Join(p.Exclude, " "))
+	}
+	if p.MaxDepth > 0 {
+		rules = append(rules, fmt.Sprintf("max depth %d", p.MaxDepth))
+	}
+	if p.ChangeDetection != "" {
+		rules = append(rules, "change detection "+p.ChangeDetection)
+	}
+	if len(rules) == 0 {
+		return p.Path
+	}
+	return p.Path + " (" + strings.Join(rules, ", ") + ")"
+}
+
+// Paths returns the paths to back up without their rules
+func (c Config) Paths() []string {
+	paths := make([]string, len(c.PathsToBackup))
+	for i, p := range c.PathsToBackup {
+		paths[i] = p.Path
+	}
+	return paths
+}
+
+// Retention configures which snapshots `m_backuper prune` keeps. Rules add up;
+// with no rules set prune refuses to run.
+type Retention struct {
+	KeepLast    int    `json:"keep_last,omitempty"`
+	KeepDaily   int    `json:"keep_daily,omitempty"`
+	KeepWeekly  int    `json:"keep_weekly,omitempty"`
+	KeepMonthly int    `json:"keep_monthly,omitempty"`
+	KeepWithin  string `json:"keep_within,omitempty"` // e.g. "720h"
+}
+
+func (r Retention) String() string {
+	var rules []string
+	for _, rule := range []struct {
+		name  string
+		count int
+	}{
+		{"last", r.KeepLast},
+		{"daily", r.KeepDaily},
+		{"weekly", r.KeepWeekly},
+		{"monthly", r.KeepMonthly},
+	} {
+		if rule.count > 0 {
+			rules = append(rules, fmt.Sprintf("%s %d", rule.name, rule.count))
+		}
+	}
+	if r.KeepWithin != "" {
+		rules = append(rules, "within "+r.KeepWithin)
+	}
+	if len(rules) == 0 {
+		return "none"
+	}
+	return "keep " + strings.Join(rules, ", ")
+}
+
+// snapshotsString tells whether snapshots are on, and that an SMB backup root
+// can't hard-link unchanged files into them
+func (c Config) snapshotsString() string {
+	switch {
+	case !c.Snapshots:
+		return "false"
+	case pathutil.IsUNCPath(c.BackupRoot):
+		return "true (full copy every run, SMB can't hard-link unchanged files)"
+	default:
+		return "true"
+	}
 }
 
 func Default() Config {
@@ -27,8 +172,17 @@ func Default() Config {
 	return Config{
 		BackupRoot:            "//192.168.1.100/backups/m_backuper",
 		DeviceID:              hostname,
-		PathsToBackup:         []string{},
+		PathsToBackup:         []BackupPath{},
 		FilesToIgnorePatterns: []string{"*.tmp", ".cache/*"},
+		Symlinks:              "follow",
+		ChangeDetection:       "size+mtime",
+		DeletionPolicy:        "keep",
+		DeletionGracePeriod:   "168h",
+		Concurrency:           4,
+		ScanConcurrency:       4,
+		CheckpointFiles:       1000,
+		CheckpointInterval:    "5m",
+		StateBackend:          "json",
 	}
 }
 
@@ -122,14 +276,42 @@ func (c Config) String() string {
 	return fmt.Sprintf(`Configuration:
   Backup Root: %s
   Device ID: %s
+  Profile: %s
   Paths to Backup: %v
   Ignore Patterns: %v
+  Exclude Caches: %t (markers %v)
+  Symlinks: %s
+  One File System: %t
+  Change Detection: %s
+  Deletion Policy: %s (grace period %s)
+  Snapshots: %s
+  Retention: %s
+  Preserve Metadata: %t
+  Concurrency: %d (scanning %d)
+  Checkpoint: every %d files or %s
+  State Backend: %s
   SMB User: %s
   SMB Password: %s`,
 		c.BackupRoot,
 		c.DeviceID,
+		c.Profile,
 		c.PathsToBackup,
 		c.FilesToIgnorePatterns,
+		c.ExcludeCaches,
+		c.ExcludeMarkers,
+		c.Symlinks,
+		c.OneFileSystem,
+		c.ChangeDetection,
+		c.DeletionPolicy,
+		c.DeletionGracePeriod,
+		c.snapshotsString(),
+		c.Retention,
+		c.PreserveMetadata,
+		c.Concurrency,
+		c.ScanConcurrency,
+		c.CheckpointFiles,
+		c.CheckpointInterval,
+		c.StateBackend,
 		c.SMBUser,
 		password,
 	)
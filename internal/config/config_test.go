@@ -22,6 +22,9 @@ func TestDefault(t *testing.T) {
 	if cfg.FilesToIgnorePatterns == nil {
 		t.Error("ignore patterns should be initialized")
 	}
+	if cfg.ChangeDetection != "size+mtime" {
+		t.Errorf("expected default change detection 'size+mtime', got '%s'", cfg.ChangeDetection)
+	}
 }
 
 func TestLoadFromValidFile(t *testing.T) {
@@ -32,7 +35,7 @@ func TestLoadFromValidFile(t *testing.T) {
 	testConfig := Config{
 		BackupRoot:            "//test-server/backups",
 		DeviceID:              "test-device",
-		PathsToBackup:         []string{"/test/path1", "/test/path2"},
+		PathsToBackup:         []BackupPath{{Path: "/test/path1"}, {Path: "/test/path2"}},
 		FilesToIgnorePatterns: []string{"*.log", "*.tmp"},
 		SMBUser:               "testuser",
 	}
@@ -69,6 +72,53 @@ func TestLoadFromValidFile(t *testing.T) {
 	}
 }
 
+func TestPathsToBackupAcceptsPlainPathsAndRules(t *testing.T) {
+	data := []byte(`{"paths_to_backup": [
+		"/home/me/Music",
+		{"path": "/home/me/Documents", "include": ["*.pdf", "*.docx"], "max_depth": 2},
+		{"path": "/home/me/src", "exclude": ["build/"], "change_detection": "hash"}
+	]}`)
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("failed to unmarshal config: %v", err)
+	}
+
+	want := []string{"/home/me/Music", "/home/me/Documents", "/home/me/src"}
+	paths := cfg.Paths()
+	if len(paths) != len(want) {
+		t.Fatalf("expected paths %v, got %v", want, paths)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Errorf("expected paths %v, got %v", want, paths)
+		}
+	}
+	docs := cfg.PathsToBackup[1]
+	if len(docs.Include) != 2 || docs.MaxDepth != 2 {
+		t.Errorf("unexpected rules %+v", docs)
+	}
+	if src := cfg.PathsToBackup[2]; len(src.Exclude) != 1 || src.ChangeDetection != "hash" {
+		t.Errorf("unexpected rules %+v", src)
+	}
+
+	// Paths without rules are written back as plain strings
+	out, err := json.Marshal(cfg.PathsToBackup[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(out); got != `["/home/me/Music",{"path":"/home/me/Documents","include":["*.pdf","*.docx"],"max_depth":2}]` {
+		t.Errorf("unexpected encoding %s", got)
+	}
+
+	for _, invalid := range []string{`{"include": ["*.pdf"]}`, `{"path": "/x", "max_depth": -1}`, `42`} {
+		var p BackupPath
+		if err := json.Unmarshal([]byte(invalid), &p); err == nil {
+			t.Errorf("expected error for %s", invalid)
+		}
+	}
+}
+
 func TestEnvironmentVariableOverride(t *testing.T) {
 	// Set environment variables
 	if err := os.Setenv("M_BACKUPER_SMB_USER", "envuser"); err != nil {
@@ -155,7 +205,7 @@ func TestSave(t *testing.T) {
 	testConfig := Config{
 		BackupRoot:            "//test-server/backups",
 		DeviceID:              "test-device",
-		PathsToBackup:         []string{"/test/path"},
+		PathsToBackup:         []BackupPath{{Path: "/test/path"}},
 		FilesToIgnorePatterns: []string{"*.tmp"},
 	}
 
@@ -193,7 +243,7 @@ func TestConfigString(t *testing.T) {
 	cfg := Config{
 		BackupRoot:    "//test/backup",
 		DeviceID:      "test-device",
-		PathsToBackup: []string{"/test"},
+		PathsToBackup: []BackupPath{{Path: "/test"}},
 		SMBUser:       "user",
 		SMBPassword:   "secret",
 	}
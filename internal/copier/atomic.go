@@ -0,0 +1,87 @@
+package copier
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mackeper/m_backuper/internal/metadata"
+)
+
+// tempMarker is part of the name of every temp file a copier writes, so
+// leftovers of an interrupted run can be told apart from backed up files
+const tempMarker = ".m_backuper-tmp-"
+
+// IsTempFile reports whether a file name belongs to an unfinished copy
+func IsTempFile(name string) bool {
+	return strings.Contains(filepath.Base(name), tempMarker)
+}
+
+// writeLocalAtomic writes to a temp file next to dst, fsyncs it and renames it
+// over dst, so dst is always either the previous version or the complete new
+// one. Renaming also gives dst a new inode instead of truncating one that
+// may be hard-linked from an older snapshot. When meta is set it is applied
+// before the rename, as far as the filesystem allows.
+func writeLocalAtomic(dst string, meta *metadata.Metadata, write func(w io.Writer) (int64, error)) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+tempMarker+"*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		_ = tmp.Close() // may already be closed
+		if err := os.Remove(tmp.Name()); err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to remove temp file", "path", tmp.Name(), "error", err)
+		}
+	}()
+
+	if err := tmp.Chmod(0o644); err != nil { //nolint:gosec // same permissions os.Create gave backed up files
+		return 0, fmt.Errorf("failed to set temp file permissions: %w", err)
+	}
+
+	n, err := write(tmp)
+	if err != nil {
+		return n, fmt.Errorf("failed to copy file contents: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return n, fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return n, fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if meta != nil {
+		// Mounted shares often can't hold everything, the sidecar keeps the rest
+		if err := metadata.Apply(tmp.Name(), meta); err != nil {
+			slog.Debug("failed to preserve some metadata", "dst", dst, "error", err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return n, fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	committed = true
+	return n, nil
+}
+
+// removeLocalTempFiles deletes temp files left in dir by an interrupted run
+func removeLocalTempFiles(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !IsTempFile(entry.Name()) {
+			continue
+		}
+		leftover := filepath.Join(dir, entry.Name())
+		slog.Info("removing leftover temp file", "path", leftover)
+		if err := os.Remove(leftover); err != nil {
+			slog.Warn("failed to remove leftover temp file", "path", leftover, "error", err)
+		}
+	}
+}
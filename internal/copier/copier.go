@@ -1,6 +1,52 @@
 package copier
 
+import (
+	"context"
+	"io"
+	"io/fs"
+)
+
+// Copier writes files to the backup root. Copy stops with ctx's error when
+// ctx is cancelled mid-file, leaving the previous version of dst in place.
 type Copier interface {
-	Copy(src, dst string) (int64, error)
+	Copy(ctx context.Context, src, dst string) (int64, error)
 	Close() error
 }
+
+// TeeCopier is implemented by copiers that can pass what they write on to w
+// as well, e.g. to hash a file without reading it twice
+type TeeCopier interface {
+	CopyTee(ctx context.Context, src, dst string, w io.Writer) (int64, error)
+}
+
+// WalkFunc is called for every file found under a backup root
+type WalkFunc func(path string, info fs.FileInfo) error
+
+// Restorer is implemented by copiers that can read files back from the backup root
+type Restorer interface {
+	Walk(root string, fn WalkFunc) error
+	Stat(path string) (fs.FileInfo, error)
+	ReadDir(path string) ([]fs.FileInfo, error)
+	Open(path string) (io.ReadCloser, error)
+	Restore(src, dst string) (int64, error)
+}
+
+// Remover is implemented by copiers that can delete or move files under the backup root
+type Remover interface {
+	Remove(path string) error
+	RemoveAll(path string) error
+	Rename(oldPath, newPath string) error
+}
+
+// Linker is implemented by copiers that can hard-link files already in the
+// backup root, so unchanged files can be shared between snapshots
+type Linker interface {
+	Link(oldPath, newPath string) error
+}
+
+// Symlinker is implemented by copiers that can store symlinks as links under
+// the backup root. For the others the links are kept in the metadata sidecar.
+type Symlinker interface {
+	Symlink(target, dst string) error
+	Readlink(path string) (string, error)
+}
@@ -2,9 +2,14 @@ package copier
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestLocalCopierCopyFile(t *testing.T) {
@@ -28,7 +33,7 @@ func TestLocalCopierCopyFile(t *testing.T) {
 
 	// Copy file
 	dstFile := filepath.Join(dstRoot, "test.txt")
-	bytesCopied, err := copier.Copy(srcFile, dstFile)
+	bytesCopied, err := copier.Copy(context.Background(), srcFile, dstFile)
 	if err != nil {
 		t.Fatalf("failed to copy file: %v", err)
 	}
@@ -75,7 +80,7 @@ func TestLocalCopierPreserveDirectoryStructure(t *testing.T) {
 
 	// Copy file to destination with same nested structure
 	dstFile := filepath.Join(dstRoot, "level1", "level2", "test.txt")
-	_, err := copier.Copy(srcFile, dstFile)
+	_, err := copier.Copy(context.Background(), srcFile, dstFile)
 	if err != nil {
 		t.Fatalf("failed to copy file: %v", err)
 	}
@@ -97,7 +102,7 @@ func TestLocalCopierHandleCopyErrors(t *testing.T) {
 
 	// Try to copy non-existent file
 	copier := NewLocalCopier(tmpDir)
-	_, err := copier.Copy("/nonexistent/file.txt", filepath.Join(tmpDir, "dst.txt"))
+	_, err := copier.Copy(context.Background(), "/nonexistent/file.txt", filepath.Join(tmpDir, "dst.txt"))
 	if err == nil {
 		t.Error("expected error when copying non-existent file, got nil")
 	}
@@ -119,7 +124,7 @@ func TestLocalCopierCreateDestinationDirectories(t *testing.T) {
 
 	// Copy to destination in non-existent nested directory
 	dstFile := filepath.Join(dstRoot, "new", "nested", "dir", "file.txt")
-	_, err := copier.Copy(srcFile, dstFile)
+	_, err := copier.Copy(context.Background(), srcFile, dstFile)
 	if err != nil {
 		t.Fatalf("failed to copy file: %v", err)
 	}
@@ -134,6 +139,287 @@ func TestLocalCopierCreateDestinationDirectories(t *testing.T) {
 func TestLocalCopierImplementsCopierInterface(t *testing.T) {
 	// Verify LocalCopier implements Copier interface
 	var _ Copier = (*LocalCopier)(nil)
+	var _ Restorer = (*LocalCopier)(nil)
+	var _ Remover = (*LocalCopier)(nil)
+	var _ Linker = (*LocalCopier)(nil)
+}
+
+func TestLocalCopierWalkAndRestore(t *testing.T) {
+	tmpDir := t.TempDir()
+	dstRoot := filepath.Join(tmpDir, "dst")
+
+	backedUp := []string{"a.txt", filepath.Join("nested", "b.txt")}
+	for _, name := range backedUp {
+		path := filepath.Join(dstRoot, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+	}
+
+	copier := NewLocalCopier(dstRoot)
+
+	var walked []string
+	err := copier.Walk(dstRoot, func(path string, info fs.FileInfo) error {
+		walked = append(walked, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	if len(walked) != len(backedUp) {
+		t.Fatalf("expected %d files walked, got %d: %v", len(backedUp), len(walked), walked)
+	}
+
+	restored := filepath.Join(tmpDir, "restored", "b.txt")
+	if _, err := copier.Restore(filepath.Join(dstRoot, "nested", "b.txt"), restored); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if content, _ := os.ReadFile(restored); string(content) != backedUp[1] {
+		t.Errorf("restored content mismatch: got %q", content)
+	}
+}
+
+func TestLocalCopierRenameAndRemove(t *testing.T) {
+	tmpDir := t.TempDir()
+	copier := NewLocalCopier(tmpDir)
+
+	src := filepath.Join(tmpDir, "file.txt")
+	if err := os.WriteFile(src, []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	moved := filepath.Join(tmpDir, "new", "dir", "file.txt")
+	if err := copier.Rename(src, moved); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if _, err := os.Stat(moved); err != nil {
+		t.Errorf("renamed file not found: %v", err)
+	}
+
+	if err := copier.Remove(moved); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := os.Stat(moved); !os.IsNotExist(err) {
+		t.Error("removed file still exists")
+	}
+}
+
+func TestLocalCopierLinkAndReadDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	copier := NewLocalCopier(tmpDir)
+
+	src := filepath.Join(tmpDir, "old", "file.txt")
+	if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(src, []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	linked := filepath.Join(tmpDir, "new", "dir", "file.txt")
+	if err := copier.Link(src, linked); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	srcInfo, _ := os.Stat(src)
+	linkedInfo, err := os.Stat(linked)
+	if err != nil {
+		t.Fatalf("linked file not found: %v", err)
+	}
+	if !os.SameFile(srcInfo, linkedInfo) {
+		t.Error("expected linked file to share the original's inode")
+	}
+
+	entries, err := copier.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(entries))
+	}
+}
+
+func TestLocalCopierFailedCopyKeepsPreviousVersion(t *testing.T) {
+	tmpDir := t.TempDir()
+	dst := filepath.Join(tmpDir, "dst", "file.txt")
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, []byte("good version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading a directory fails halfway through the copy
+	copier := NewLocalCopier(filepath.Join(tmpDir, "dst"))
+	if _, err := copier.Copy(context.Background(), tmpDir, dst); err == nil {
+		t.Fatal("expected copy of a directory to fail")
+	}
+
+	if content, _ := os.ReadFile(dst); string(content) != "good version" {
+		t.Errorf("previous version was damaged: %q", content)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(dst))
+	if len(entries) != 1 {
+		t.Errorf("expected temp file to be cleaned up, found %d entries", len(entries))
+	}
+}
+
+func TestLocalCopierCanceledCopyKeepsPreviousVersion(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src.txt")
+	dst := filepath.Join(tmpDir, "dst", "file.txt")
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte("new version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, []byte("good version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewLocalCopier(tmpDir).Copy(ctx, src, dst); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled copy, got %v", err)
+	}
+
+	if content, _ := os.ReadFile(dst); string(content) != "good version" {
+		t.Errorf("previous version was damaged: %q", content)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(dst))
+	if len(entries) != 1 {
+		t.Errorf("expected temp file to be cleaned up, found %d entries", len(entries))
+	}
+}
+
+func TestLocalCopierDoesNotWriteThroughHardLinks(t *testing.T) {
+	tmpDir := t.TempDir()
+	older := filepath.Join(tmpDir, "older.txt")
+	dst := filepath.Join(tmpDir, "dst.txt")
+	src := filepath.Join(tmpDir, "src.txt")
+	if err := os.WriteFile(older, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(older, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLocalCopier(tmpDir).Copy(context.Background(), src, dst); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	if content, _ := os.ReadFile(older); string(content) != "old" {
+		t.Errorf("copy wrote through a hard link, older file now has %q", content)
+	}
+	if content, _ := os.ReadFile(dst); string(content) != "new" {
+		t.Errorf("expected new content at destination, got %q", content)
+	}
+}
+
+func TestLocalCopierRemovesLeftoverTempFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	dstDir := filepath.Join(tmpDir, "dst")
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	leftover := filepath.Join(dstDir, "big.iso"+tempMarker+"123")
+	if err := os.WriteFile(leftover, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	copier := NewLocalCopier(dstDir)
+
+	// Unfinished copies are not reported as backed up files
+	err := copier.Walk(dstDir, func(path string, info fs.FileInfo) error {
+		t.Errorf("Walk reported temp file %s", path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+
+	src := filepath.Join(tmpDir, "file.txt")
+	if err := os.WriteFile(src, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copier.Copy(context.Background(), src, filepath.Join(dstDir, "file.txt")); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error("expected leftover temp file to be removed")
+	}
+}
+
+func TestLocalCopierRestoreLeavesTargetDirectoryAlone(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "dst", "file.txt")
+	if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A user's file that merely looks like a temp file
+	targetDir := filepath.Join(tmpDir, "restored")
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	lookalike := filepath.Join(targetDir, "notes"+tempMarker+"1")
+	if err := os.WriteFile(lookalike, []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLocalCopier(filepath.Dir(src)).Restore(src, filepath.Join(targetDir, "file.txt")); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if _, err := os.Stat(lookalike); err != nil {
+		t.Errorf("expected restore to leave other files alone: %v", err)
+	}
+}
+
+func TestLocalCopierPreservesMetadata(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not preserved on Windows")
+	}
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "run.sh")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.WriteFile(src, []byte("#!/bin/sh"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(src, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	copier := NewLocalCopier(tmpDir)
+	copier.SetPreserveMetadata(true)
+	dst := filepath.Join(tmpDir, "backup", "run.sh")
+	if _, err := copier.Copy(context.Background(), src, dst); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o755 {
+		t.Errorf("mode %v not preserved, want 0755", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("mtime %v not preserved, want %v", info.ModTime(), mtime)
+	}
 }
 
 func TestLocalCopierClose(t *testing.T) {
@@ -144,3 +430,36 @@ func TestLocalCopierClose(t *testing.T) {
 		t.Errorf("Close() returned unexpected error: %v", err)
 	}
 }
+
+func TestSMBCopierImplementsCopierInterface(t *testing.T) {
+	// Verify SMBCopier implements Copier interface
+	var _ Copier = (*SMBCopier)(nil)
+	var _ Restorer = (*SMBCopier)(nil)
+	var _ Remover = (*SMBCopier)(nil)
+}
+
+func TestNewSMBCopierRejectsNonUNCRoot(t *testing.T) {
+	if _, err := NewSMBCopier("/mnt/backups", "user", "pass"); err == nil {
+		t.Error("expected error for non-UNC backup root, got nil")
+	}
+}
+
+func TestSMBCopierSharePath(t *testing.T) {
+	c := &SMBCopier{host: "nas", shareDir: "m_backuper"}
+
+	tests := []struct {
+		dst  string
+		want string
+	}{
+		{"//nas/backups/m_backuper/laptop/home/user/file.txt", "m_backuper/laptop/home/user/file.txt"},
+		{"/nas/backups/m_backuper/laptop/home/user/file.txt", "m_backuper/laptop/home/user/file.txt"},
+		{`\\nas\backups\m_backuper\laptop\C:\Users\file.txt`, "m_backuper/laptop/C/Users/file.txt"},
+		{"laptop/home/user/file.txt", "m_backuper/laptop/home/user/file.txt"},
+	}
+
+	for _, tt := range tests {
+		if got := c.sharePath(tt.dst); got != tt.want {
+			t.Errorf("sharePath(%q) = %q, want %q", tt.dst, got, tt.want)
+		}
+	}
+}
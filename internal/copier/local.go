@@ -1,35 +1,70 @@
 package copier
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"sync"
+
+	"github.com/mackeper/m_backuper/internal/ctxio"
+	"github.com/mackeper/m_backuper/internal/metadata"
 )
 
 type LocalCopier struct {
-	destRoot string
+	destRoot         string
+	cleaned          map[string]bool // directories already swept for leftover temp files
+	preserveMetadata bool
+	mu               sync.Mutex
 }
 
 func NewLocalCopier(destRoot string) *LocalCopier {
 	return &LocalCopier{
 		destRoot: destRoot,
+		cleaned:  make(map[string]bool),
 	}
 }
 
-func (c *LocalCopier) Copy(src, dst string) (int64, error) {
+func (c *LocalCopier) Copy(ctx context.Context, src, dst string) (int64, error) {
+	return c.CopyTee(ctx, src, dst, nil)
+}
+
+// CopyTee is Copy that also writes the copied bytes to w, when set
+func (c *LocalCopier) CopyTee(ctx context.Context, src, dst string, w io.Writer) (int64, error) {
 	slog.Debug("copying file", "src", src, "dst", dst)
 
+	bytesCopied, err := c.copyFile(ctx, src, dst, w, true)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("failed to copy file", "src", src, "dst", dst, "error", err)
+		}
+		return bytesCopied, err
+	}
+
+	slog.Info("copied file", "src", src, "dst", dst, "bytes", bytesCopied)
+	return bytesCopied, nil
+}
+
+// copyFile writes src to dst through a temp file, so a failed copy leaves the
+// previous version in place, and passes the bytes on to w when set. sweep
+// first removes leftovers of interrupted copies from dst's directory, which
+// is only done under the backup root.
+func (c *LocalCopier) copyFile(ctx context.Context, src, dst string, w io.Writer, sweep bool) (int64, error) {
 	// Create destination directory if it doesn't exist
 	dstDir := filepath.Dir(dst)
 	if err := os.MkdirAll(dstDir, 0o750); err != nil {
 		slog.Error("failed to create destination directory", "dir", dstDir, "error", err)
 		return 0, fmt.Errorf("failed to create destination directory: %w", err)
 	}
+	if sweep {
+		c.removeTempFiles(dstDir)
+	}
 
 	// Open source file
-	srcFile, err := os.Open(src) //nolint:gosec // src path is from filesystem scan
+	srcFile, err := os.Open(src) //nolint:gosec // src path is from filesystem scan or the backup root
 	if err != nil {
 		slog.Error("failed to open source file", "src", src, "error", err)
 		return 0, fmt.Errorf("failed to open source file: %w", err)
@@ -40,30 +75,168 @@ func (c *LocalCopier) Copy(src, dst string) (int64, error) {
 		}
 	}()
 
-	// Create destination file
-	dstFile, err := os.Create(dst) //nolint:gosec // dst path is constructed from config
-	if err != nil {
-		slog.Error("failed to create destination file", "dst", dst, "error", err)
-		return 0, fmt.Errorf("failed to create destination file: %w", err)
-	}
-	defer func() {
-		if err := dstFile.Close(); err != nil {
-			slog.Warn("failed to close destination file", "dst", dst, "error", err)
+	var meta *metadata.Metadata
+	if c.preserveMetadata {
+		meta, err = c.captureMetadata(srcFile)
+		if err != nil {
+			slog.Warn("failed to read source metadata", "src", src, "error", err)
 		}
-	}()
+	}
+
+	var r io.Reader = ctxio.NewReader(ctx, srcFile)
+	if w != nil {
+		r = io.TeeReader(r, w)
+	}
+	return writeLocalAtomic(dst, meta, func(tmp io.Writer) (int64, error) {
+		return io.Copy(tmp, r)
+	})
+}
 
-	// Copy file contents
-	bytesCopied, err := io.Copy(dstFile, srcFile)
+// captureMetadata reads the metadata of an open source file. A partial result
+// (e.g. without xattrs) is still returned alongside the error.
+func (c *LocalCopier) captureMetadata(f *os.File) (*metadata.Metadata, error) {
+	info, err := f.Stat()
 	if err != nil {
-		slog.Error("failed to copy file contents", "src", src, "dst", dst, "error", err)
-		return bytesCopied, fmt.Errorf("failed to copy file contents: %w", err)
+		return nil, err
 	}
+	return metadata.Capture(f.Name(), info)
+}
 
-	slog.Info("copied file", "src", src, "dst", dst, "bytes", bytesCopied)
-	return bytesCopied, nil
+// removeTempFiles sweeps dir for leftovers of an interrupted run the first time
+// a file is copied into it. The sweep happens under the lock so it can't race
+// with a copy into the same directory.
+func (c *LocalCopier) removeTempFiles(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cleaned[dir] {
+		return
+	}
+	c.cleaned[dir] = true
+	removeLocalTempFiles(dir)
+}
+
+// SetPreserveMetadata makes Copy carry over mode, times, ownership (as root)
+// and extended attributes from the source file
+func (c *LocalCopier) SetPreserveMetadata(enabled bool) {
+	c.preserveMetadata = enabled
 }
 
 // Close closes any open connections (no-op for local copier)
 func (c *LocalCopier) Close() error {
 	return nil
 }
+
+// Walk calls fn for every regular file under root, skipping unfinished copies
+func (c *LocalCopier) Walk(root string, fn WalkFunc) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || IsTempFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	})
+}
+
+// Stat returns file info for a path under the backup root
+func (c *LocalCopier) Stat(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
+
+// ReadDir lists the entries of a directory under the backup root
+func (c *LocalCopier) ReadDir(path string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Open opens a file under the backup root for reading
+func (c *LocalCopier) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path) //nolint:gosec // path is under the configured backup root
+}
+
+// Remove deletes a file under the backup root
+func (c *LocalCopier) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// RemoveAll deletes a directory tree under the backup root
+func (c *LocalCopier) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// Rename moves a file under the backup root, creating the target directory
+func (c *LocalCopier) Rename(oldPath, newPath string) error {
+	if err := os.MkdirAll(filepath.Dir(newPath), 0o750); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// Link hard-links a file under the backup root, creating the target directory
+func (c *LocalCopier) Link(oldPath, newPath string) error {
+	if err := os.MkdirAll(filepath.Dir(newPath), 0o750); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	return os.Link(oldPath, newPath)
+}
+
+// Symlink creates a link to target at dst, creating the directory and
+// replacing whatever was at dst in one step
+func (c *LocalCopier) Symlink(target, dst string) error {
+	dstDir := filepath.Dir(dst)
+	if err := os.MkdirAll(dstDir, 0o750); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	c.removeTempFiles(dstDir)
+
+	tmp := dst + tempMarker + "link"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove temp link: %w", err)
+	}
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("failed to create link: %w", err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to rename temp link: %w", err)
+	}
+	slog.Info("linked file", "dst", dst, "target", target)
+	return nil
+}
+
+// Readlink returns the target of a link under the backup root
+func (c *LocalCopier) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+// Restore copies a file from the backup root back to the local filesystem.
+// Unlike Copy it leaves other files next to dst alone, whatever their name.
+func (c *LocalCopier) Restore(src, dst string) (int64, error) {
+	slog.Debug("restoring file", "src", src, "dst", dst)
+
+	bytesCopied, err := c.copyFile(context.Background(), src, dst, nil, false)
+	if err != nil {
+		slog.Error("failed to restore file", "src", src, "dst", dst, "error", err)
+		return bytesCopied, err
+	}
+
+	slog.Info("restored file", "src", src, "dst", dst, "bytes", bytesCopied)
+	return bytesCopied, nil
+}
@@ -0,0 +1,347 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+
+	"github.com/mackeper/m_backuper/internal/ctxio"
+	"github.com/mackeper/m_backuper/internal/pathutil"
+)
+
+const (
+	defaultSMBPort = "445"
+	smbDialTimeout = 10 * time.Second
+)
+
+// SMBCopier writes files directly to an SMB2/3 share without requiring a mount
+type SMBCopier struct {
+	conn     net.Conn
+	session  *smb2.Session
+	share    *smb2.Share
+	host     string
+	shareDir string          // path of the backup root inside the share
+	cleaned  map[string]bool // remote directories already swept for leftover temp files
+	mu       sync.Mutex
+}
+
+// NewSMBCopier connects to the share named in destRoot (//host/share/path)
+// and authenticates with the given credentials
+func NewSMBCopier(destRoot, user, password string) (*SMBCopier, error) {
+	host, shareName, shareDir, err := pathutil.ParseUNC(destRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, defaultSMBPort)
+	}
+
+	slog.Info("connecting to SMB share", "addr", addr, "share", shareName, "user", user)
+	conn, err := net.DialTimeout("tcp", addr, smbDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SMB server %s: %w", addr, err)
+	}
+
+	dialer := &smb2.Dialer{
+		Initiator: &smb2.NTLMInitiator{
+			User:     user,
+			Password: password,
+		},
+	}
+	session, err := dialer.Dial(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to authenticate to SMB server %s: %w", addr, err)
+	}
+
+	share, err := session.Mount(shareName)
+	if err != nil {
+		_ = session.Logoff()
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to mount SMB share %s: %w", shareName, err)
+	}
+
+	return &SMBCopier{
+		conn:     conn,
+		session:  session,
+		share:    share,
+		host:     host,
+		shareDir: shareDir,
+		cleaned:  make(map[string]bool),
+	}, nil
+}
+
+func (c *SMBCopier) Copy(ctx context.Context, src, dst string) (int64, error) {
+	return c.CopyTee(ctx, src, dst, nil)
+}
+
+// CopyTee is Copy that also writes the copied bytes to w, when set
+func (c *SMBCopier) CopyTee(ctx context.Context, src, dst string, w io.Writer) (int64, error) {
+	slog.Debug("copying file over SMB", "src", src, "dst", dst)
+
+	remotePath := c.sharePath(dst)
+
+	// Create destination directory if it doesn't exist
+	if dir := path.Dir(remotePath); dir != "." {
+		if err := c.share.MkdirAll(dir, 0o750); err != nil {
+			slog.Error("failed to create remote directory", "dir", dir, "error", err)
+			return 0, fmt.Errorf("failed to create remote directory: %w", err)
+		}
+	}
+	c.removeTempFiles(path.Dir(remotePath))
+
+	// Open source file
+	srcFile, err := os.Open(src) //nolint:gosec // src path is from filesystem scan
+	if err != nil {
+		slog.Error("failed to open source file", "src", src, "error", err)
+		return 0, fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer func() {
+		if err := srcFile.Close(); err != nil {
+			slog.Warn("failed to close source file", "src", src, "error", err)
+		}
+	}()
+
+	// Stream file contents to a temp file next to the target so a failed
+	// copy leaves the previous version in place
+	//nolint:gosec // temp names only need to be unique, not unpredictable
+	tmpPath := fmt.Sprintf("%s%s%x", remotePath, tempMarker, rand.Uint64())
+	var r io.Reader = ctxio.NewReader(ctx, srcFile)
+	if w != nil {
+		r = io.TeeReader(r, w)
+	}
+	bytesCopied, err := c.writeRemote(tmpPath, r)
+	if err == nil {
+		err = c.replace(tmpPath, remotePath)
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("failed to copy file", "src", src, "dst", remotePath, "error", err)
+		}
+		if rmErr := c.share.Remove(tmpPath); rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) {
+			slog.Warn("failed to remove temp file", "path", tmpPath, "error", rmErr)
+		}
+		return bytesCopied, err
+	}
+
+	slog.Info("copied file", "src", src, "dst", remotePath, "bytes", bytesCopied)
+	return bytesCopied, nil
+}
+
+// writeRemote streams r into a new file on the share and flushes it
+func (c *SMBCopier) writeRemote(remotePath string, r io.Reader) (int64, error) {
+	f, err := c.share.Create(remotePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create remote file: %w", err)
+	}
+
+	n, err := f.ReadFrom(r)
+	if err != nil {
+		_ = f.Close()
+		return n, fmt.Errorf("failed to copy file contents: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return n, fmt.Errorf("failed to flush remote file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return n, fmt.Errorf("failed to close remote file: %w", err)
+	}
+	return n, nil
+}
+
+// replace renames a finished temp file over target. SMB renames can't replace
+// an existing file, so the previous version is removed right before the
+// rename, once the new one is complete on the share.
+func (c *SMBCopier) replace(tmpPath, target string) error {
+	err := c.share.Rename(tmpPath, target)
+	if err == nil {
+		return nil
+	}
+	if _, statErr := c.share.Stat(target); statErr != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	if err := c.share.Remove(target); err != nil {
+		return fmt.Errorf("failed to remove previous version: %w", err)
+	}
+	if err := c.share.Rename(tmpPath, target); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
+}
+
+// removeTempFiles sweeps a remote directory for leftovers of an interrupted
+// run the first time a file is copied into it
+func (c *SMBCopier) removeTempFiles(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cleaned[dir] {
+		return
+	}
+	c.cleaned[dir] = true
+
+	entries, err := c.share.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !IsTempFile(entry.Name()) {
+			continue
+		}
+		leftover := path.Join(dir, entry.Name())
+		slog.Info("removing leftover temp file", "path", leftover)
+		if err := c.share.Remove(leftover); err != nil {
+			slog.Warn("failed to remove leftover temp file", "path", leftover, "error", err)
+		}
+	}
+}
+
+// Walk calls fn for every file under root, skipping unfinished copies. Paths
+// passed to fn are built from root so they can be handed back to Restore.
+func (c *SMBCopier) Walk(root string, fn WalkFunc) error {
+	return c.walk(c.sharePath(root), root, fn)
+}
+
+func (c *SMBCopier) walk(remoteDir, localDir string, fn WalkFunc) error {
+	entries, err := c.share.ReadDir(remoteDir)
+	if err != nil {
+		return fmt.Errorf("failed to read remote directory %s: %w", remoteDir, err)
+	}
+
+	for _, entry := range entries {
+		remotePath := path.Join(remoteDir, entry.Name())
+		localPath := filepath.Join(localDir, entry.Name())
+		if entry.IsDir() {
+			if err := c.walk(remotePath, localPath, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if IsTempFile(entry.Name()) {
+			continue
+		}
+		if err := fn(localPath, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stat returns file info for a path on the share
+func (c *SMBCopier) Stat(name string) (fs.FileInfo, error) {
+	return c.share.Stat(c.sharePath(name))
+}
+
+// ReadDir lists the entries of a directory on the share
+func (c *SMBCopier) ReadDir(name string) ([]fs.FileInfo, error) {
+	return c.share.ReadDir(c.sharePath(name))
+}
+
+// Open opens a file on the share for reading
+func (c *SMBCopier) Open(name string) (io.ReadCloser, error) {
+	return c.share.Open(c.sharePath(name))
+}
+
+// Remove deletes a file on the share
+func (c *SMBCopier) Remove(name string) error {
+	return c.share.Remove(c.sharePath(name))
+}
+
+// RemoveAll deletes a directory tree on the share
+func (c *SMBCopier) RemoveAll(name string) error {
+	return c.share.RemoveAll(c.sharePath(name))
+}
+
+// Rename moves a file on the share, creating the target directory
+func (c *SMBCopier) Rename(oldPath, newPath string) error {
+	remoteNew := c.sharePath(newPath)
+	if dir := path.Dir(remoteNew); dir != "." {
+		if err := c.share.MkdirAll(dir, 0o750); err != nil {
+			return fmt.Errorf("failed to create remote directory: %w", err)
+		}
+	}
+	return c.share.Rename(c.sharePath(oldPath), remoteNew)
+}
+
+// Restore copies a file from the share back to the local filesystem
+func (c *SMBCopier) Restore(src, dst string) (int64, error) {
+	slog.Debug("restoring file over SMB", "src", src, "dst", dst)
+
+	remotePath := c.sharePath(src)
+
+	// Create local directory if it doesn't exist
+	dstDir := filepath.Dir(dst)
+	if err := os.MkdirAll(dstDir, 0o750); err != nil {
+		slog.Error("failed to create destination directory", "dir", dstDir, "error", err)
+		return 0, fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	// Open remote file
+	srcFile, err := c.share.Open(remotePath)
+	if err != nil {
+		slog.Error("failed to open remote file", "src", remotePath, "error", err)
+		return 0, fmt.Errorf("failed to open remote file: %w", err)
+	}
+	defer func() {
+		if err := srcFile.Close(); err != nil {
+			slog.Warn("failed to close remote file", "src", remotePath, "error", err)
+		}
+	}()
+
+	// Stream file contents through a temp file so an overwritten local file
+	// survives a failed restore
+	bytesCopied, err := writeLocalAtomic(dst, nil, srcFile.WriteTo)
+	if err != nil {
+		slog.Error("failed to restore file", "src", remotePath, "dst", dst, "error", err)
+		return bytesCopied, err
+	}
+
+	slog.Info("restored file", "src", remotePath, "dst", dst, "bytes", bytesCopied)
+	return bytesCopied, nil
+}
+
+// Close unmounts the share, logs off and closes the TCP connection
+func (c *SMBCopier) Close() error {
+	var firstErr error
+	if err := c.share.Umount(); err != nil {
+		firstErr = fmt.Errorf("failed to unmount SMB share: %w", err)
+	}
+	if err := c.session.Logoff(); err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("failed to log off SMB session: %w", err)
+	}
+	if err := c.conn.Close(); err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("failed to close SMB connection: %w", err)
+	}
+	return firstErr
+}
+
+// sharePath maps a destination path built from the UNC backup root to a path
+// relative to the share. filepath.Join collapses the leading "//" of the root,
+// so both "//host/share/x" and "/host/share/x" are accepted. Drive letter
+// colons from Windows source paths are dropped since SMB names can't hold them.
+func (c *SMBCopier) sharePath(dst string) string {
+	p := strings.TrimLeft(strings.ReplaceAll(dst, `\`, "/"), "/")
+	if rest, ok := strings.CutPrefix(p, c.host+"/"); ok {
+		_, p, _ = strings.Cut(rest, "/") // drop the share name
+	} else {
+		// Not rooted at the share, treat it as relative to the backup root
+		p = path.Join(c.shareDir, p)
+	}
+	return strings.ReplaceAll(path.Clean(p), ":", "")
+}
@@ -0,0 +1,24 @@
+package ctxio
+
+import (
+	"context"
+	"io"
+)
+
+// Reader fails reads once ctx is cancelled, so a long copy or hash can be
+// interrupted between chunks
+type Reader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func NewReader(ctx context.Context, r io.Reader) *Reader {
+	return &Reader{ctx: ctx, r: r}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
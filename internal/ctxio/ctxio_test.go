@@ -0,0 +1,24 @@
+package ctxio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReaderStopsOnceCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewReader(ctx, strings.NewReader("content"))
+
+	buf := make([]byte, 3)
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "con" {
+		t.Fatalf("expected first chunk, got %q (%v)", buf[:n], err)
+	}
+
+	cancel()
+	if _, err := io.ReadAll(r); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
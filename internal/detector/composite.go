@@ -0,0 +1,85 @@
+package detector
+
+import (
+	"context"
+	"io/fs"
+)
+
+// CompositeDetector combines detectors. In any-of mode a file has changed if
+// any detector says so; in all-of mode only if every detector does. Detectors
+// are evaluated in order and stop as soon as the result is known, so cheap
+// checks should come first.
+type CompositeDetector struct {
+	detectors []ChangeDetector
+	all       bool
+}
+
+// AnyOf reports a change when any detector reports one (rsync-style "size or mtime")
+func AnyOf(detectors ...ChangeDetector) *CompositeDetector {
+	return &CompositeDetector{detectors: detectors}
+}
+
+// AllOf reports a change only when every detector reports one. AllOf(AnyOf(size,
+// mtime), hash) only hashes files whose cheap checks are inconclusive.
+func AllOf(detectors ...ChangeDetector) *CompositeDetector {
+	return &CompositeDetector{detectors: detectors, all: true}
+}
+
+func (d *CompositeDetector) HasChanged(ctx context.Context, path string, info fs.FileInfo, state FileState) bool {
+	for _, detector := range d.detectors {
+		changed := detector.HasChanged(ctx, path, info, state)
+		if changed && !d.all {
+			return true
+		}
+		if !changed && d.all {
+			return false
+		}
+	}
+	return d.all && len(d.detectors) > 0
+}
+
+// Digest delegates to the first detector that computes digests. It returns
+// an empty digest if none does.
+func (d *CompositeDetector) Digest(ctx context.Context, path string) (string, error) {
+	if digester := d.digester(); digester != nil {
+		return digester.Digest(ctx, path)
+	}
+	return "", nil
+}
+
+func (d *CompositeDetector) CachedDigest(path string) (string, bool) {
+	if digester := d.digester(); digester != nil {
+		return digester.CachedDigest(path)
+	}
+	return "", false
+}
+
+func (d *CompositeDetector) Forget(path string) {
+	if digester := d.digester(); digester != nil {
+		digester.Forget(path)
+	}
+}
+
+// Algorithm returns "" if no detector computes digests
+func (d *CompositeDetector) Algorithm() string {
+	if digester := d.digester(); digester != nil {
+		return digester.Algorithm()
+	}
+	return ""
+}
+
+func (d *CompositeDetector) digester() Digester {
+	for _, detector := range d.detectors {
+		// Nested composites are Digesters too, look inside them instead
+		if composite, ok := detector.(*CompositeDetector); ok {
+			if digester := composite.digester(); digester != nil {
+				return digester
+			}
+			continue
+		}
+		if digester, ok := detector.(Digester); ok {
+			return digester
+		}
+	}
+	return nil
+}
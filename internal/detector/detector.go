@@ -1,12 +1,75 @@
 package detector
 
-import "io/fs"
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"strings"
+)
 
 type FileState struct {
 	Size    int64
-	ModTime int64 // Unix timestamp
+	ModTime int64  // Unix timestamp
+	Digest  string // "<algorithm>:<hex>", empty if never hashed
 }
 
+// ChangeDetector decides whether a file needs to be copied again. Detectors
+// that read file contents stop when ctx is cancelled and report a change.
 type ChangeDetector interface {
-	HasChanged(path string, info fs.FileInfo, state FileState) bool
+	HasChanged(ctx context.Context, path string, info fs.FileInfo, state FileState) bool
+}
+
+// Digester is implemented by detectors that compute content digests, so the
+// digest can be stored in state and compared on the next run
+type Digester interface {
+	// Digest returns the digest computed during HasChanged, hashing the file if needed
+	Digest(ctx context.Context, path string) (string, error)
+	// CachedDigest returns a digest computed during HasChanged without hashing
+	CachedDigest(path string) (string, bool)
+	// Forget drops what HasChanged cached for path, once path is done with
+	Forget(path string)
+	// Algorithm names the hash of the digests, see NewDigestWriter
+	Algorithm() string
+}
+
+// DefaultMethod is the rsync-style "size or mtime changed" check
+const DefaultMethod = "size+mtime"
+
+// New returns the detector selected by the change_detection config key: one
+// or more of "size", "mtime" and "hash" joined by "+". The cheap checks are
+// combined any-of; "hash" only runs when they report a change.
+func New(method, hashAlgorithm string) (ChangeDetector, error) {
+	if method == "" {
+		method = DefaultMethod
+	}
+
+	var cheap []ChangeDetector
+	var hashDetector *HashDetector
+	for _, name := range strings.Split(method, "+") {
+		switch strings.TrimSpace(name) {
+		case "size":
+			cheap = append(cheap, NewSizeDetector())
+		case "mtime":
+			cheap = append(cheap, NewModTimeDetector())
+		case "hash":
+			d, err := NewHashDetector(hashAlgorithm)
+			if err != nil {
+				return nil, err
+			}
+			hashDetector = d
+		default:
+			return nil, fmt.Errorf("unknown change detection method: %s", name)
+		}
+	}
+
+	switch {
+	case hashDetector == nil && len(cheap) == 1:
+		return cheap[0], nil
+	case hashDetector == nil:
+		return AnyOf(cheap...), nil
+	case len(cheap) == 0:
+		return hashDetector, nil
+	default:
+		return AllOf(AnyOf(cheap...), hashDetector), nil
+	}
 }
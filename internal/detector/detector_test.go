@@ -1,7 +1,11 @@
 package detector
 
 import (
+	"context"
+	"fmt"
 	"io/fs"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -40,7 +44,7 @@ func TestSizeDetectorReturnsTrueWhenSizeDiffers(t *testing.T) {
 		ModTime: time.Now().Unix(),
 	}
 
-	if !detector.HasChanged("test.txt", info, state) {
+	if !detector.HasChanged(context.Background(), "test.txt", info, state) {
 		t.Error("expected HasChanged to return true when size differs")
 	}
 }
@@ -61,7 +65,7 @@ func TestSizeDetectorReturnsFalseWhenSizeMatches(t *testing.T) {
 		ModTime: time.Now().Unix(),
 	}
 
-	if detector.HasChanged("test.txt", info, state) {
+	if detector.HasChanged(context.Background(), "test.txt", info, state) {
 		t.Error("expected HasChanged to return false when size matches")
 	}
 }
@@ -79,7 +83,7 @@ func TestSizeDetectorReturnsTrueForNewFile(t *testing.T) {
 	// Empty state (new file)
 	state := FileState{}
 
-	if !detector.HasChanged("test.txt", info, state) {
+	if !detector.HasChanged(context.Background(), "test.txt", info, state) {
 		t.Error("expected HasChanged to return true for new file (empty state)")
 	}
 }
@@ -87,6 +91,11 @@ func TestSizeDetectorReturnsTrueForNewFile(t *testing.T) {
 func TestInterfaceCanBeSwapped(t *testing.T) {
 	// Verify that SizeDetector implements ChangeDetector interface
 	var _ ChangeDetector = (*SizeDetector)(nil)
+	var _ ChangeDetector = (*HashDetector)(nil)
+	var _ Digester = (*HashDetector)(nil)
+	var _ ChangeDetector = (*ModTimeDetector)(nil)
+	var _ ChangeDetector = (*CompositeDetector)(nil)
+	var _ Digester = (*CompositeDetector)(nil)
 
 	// Create instances through interface
 	detector := ChangeDetector(NewSizeDetector())
@@ -103,7 +112,7 @@ func TestInterfaceCanBeSwapped(t *testing.T) {
 	}
 
 	// Should work through interface
-	if !detector.HasChanged("test.txt", info, state) {
+	if !detector.HasChanged(context.Background(), "test.txt", info, state) {
 		t.Error("expected HasChanged to work through interface")
 	}
 }
@@ -128,7 +137,289 @@ func TestSizeDetectorIgnoresModTime(t *testing.T) {
 	}
 
 	// Should return false because size hasn't changed (ignores mod time)
-	if detector.HasChanged("test.txt", info, state) {
+	if detector.HasChanged(context.Background(), "test.txt", info, state) {
 		t.Error("expected HasChanged to ignore mod time and only check size")
 	}
 }
+
+// writeTestFile creates a file and returns its path and info
+func writeTestFile(t *testing.T, content string) (string, fs.FileInfo) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat test file: %v", err)
+	}
+	return path, info
+}
+
+func TestHashDetectorDetectsSameSizeEdit(t *testing.T) {
+	detector, err := NewHashDetector("")
+	if err != nil {
+		t.Fatalf("failed to create hash detector: %v", err)
+	}
+
+	path, _ := writeTestFile(t, "version 1")
+	oldDigest, err := FileDigest(path, DefaultHashAlgorithm)
+	if err != nil {
+		t.Fatalf("failed to hash file: %v", err)
+	}
+
+	// Same size, different content
+	if err := os.WriteFile(path, []byte("version 2"), 0644); err != nil {
+		t.Fatalf("failed to modify file: %v", err)
+	}
+	info, _ := os.Stat(path)
+
+	state := FileState{Size: info.Size(), Digest: oldDigest}
+	if !detector.HasChanged(context.Background(), path, info, state) {
+		t.Error("expected HasChanged to return true when content differs with the same size")
+	}
+}
+
+func TestHashDetectorReturnsFalseWhenDigestMatches(t *testing.T) {
+	detector, _ := NewHashDetector("sha256")
+
+	path, info := writeTestFile(t, "unchanged")
+	digest, _ := FileDigest(path, "sha256")
+
+	if detector.HasChanged(context.Background(), path, info, FileState{Size: info.Size(), Digest: digest}) {
+		t.Error("expected HasChanged to return false when digest matches")
+	}
+
+	// The digest computed during the check is handed out without rehashing
+	cached, err := detector.Digest(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Digest returned error: %v", err)
+	}
+	if cached != digest {
+		t.Errorf("expected cached digest %q, got %q", digest, cached)
+	}
+}
+
+func TestHashDetectorTreatsMissingDigestAsChanged(t *testing.T) {
+	detector, _ := NewHashDetector("")
+
+	path, info := writeTestFile(t, "content")
+	md5Digest, err := FileDigest(path, "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// State from a size-only run has no digest yet, nor can one of another
+	// algorithm tell whether the backup copy is current
+	for _, digest := range []string{"", md5Digest} {
+		if !detector.HasChanged(context.Background(), path, info, FileState{Size: info.Size(), Digest: digest}) {
+			t.Errorf("expected HasChanged to return true for recorded digest %q", digest)
+		}
+	}
+	if _, ok := detector.CachedDigest(path); ok {
+		t.Error("expected no digest cached without one to compare to")
+	}
+}
+
+func TestHashDetectorAlgorithms(t *testing.T) {
+	for _, algorithm := range []string{"md5", "sha1", "sha256", "sha512"} {
+		if _, err := NewHashDetector(algorithm); err != nil {
+			t.Errorf("NewHashDetector(%q) returned error: %v", algorithm, err)
+		}
+	}
+	if _, err := NewHashDetector("crc32"); err == nil {
+		t.Error("expected error for unsupported algorithm, got nil")
+	}
+}
+
+func TestHashDetectorForget(t *testing.T) {
+	d, err := NewHashDetector("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, info := writeTestFile(t, "content")
+	d.HasChanged(context.Background(), path, info, FileState{Size: info.Size(), Digest: "sha256:other"})
+
+	d.Forget(path)
+	if _, ok := d.CachedDigest(path); ok {
+		t.Error("expected Forget to drop the cached digest")
+	}
+}
+
+func TestDigestWriterMatchesFileDigest(t *testing.T) {
+	path, _ := writeTestFile(t, "content")
+	want, err := FileDigest(path, "sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewDigestWriter("sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Digest(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if _, err := NewDigestWriter("crc32"); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+}
+
+func TestDigestAlgorithm(t *testing.T) {
+	if got := DigestAlgorithm("sha1:abcdef"); got != "sha1" {
+		t.Errorf("expected sha1, got %q", got)
+	}
+	if got := DigestAlgorithm(""); got != "" {
+		t.Errorf("expected empty algorithm, got %q", got)
+	}
+}
+
+func TestNewSelectsDetector(t *testing.T) {
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{"size", "*detector.SizeDetector"},
+		{"mtime", "*detector.ModTimeDetector"},
+		{"hash", "*detector.HashDetector"},
+		{"size+mtime", "*detector.CompositeDetector"},
+		{"size+mtime+hash", "*detector.CompositeDetector"},
+		{"", "*detector.CompositeDetector"},
+	}
+
+	for _, tt := range tests {
+		d, err := New(tt.method, "")
+		if err != nil {
+			t.Errorf("New(%q) returned error: %v", tt.method, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", d); got != tt.want {
+			t.Errorf("New(%q) = %s, want %s", tt.method, got, tt.want)
+		}
+	}
+
+	if _, err := New("size+magic", ""); err == nil {
+		t.Error("expected error for unknown method, got nil")
+	}
+}
+
+func TestModTimeDetector(t *testing.T) {
+	detector := NewModTimeDetector()
+
+	now := time.Now()
+	info := mockFileInfo{name: "test.txt", size: 100, modTime: now}
+
+	if detector.HasChanged(context.Background(), "test.txt", info, FileState{Size: 100, ModTime: now.Unix()}) {
+		t.Error("expected HasChanged to return false when mtime matches")
+	}
+	if !detector.HasChanged(context.Background(), "test.txt", info, FileState{Size: 100, ModTime: now.Add(-time.Hour).Unix()}) {
+		t.Error("expected HasChanged to return true when mtime differs")
+	}
+	if !detector.HasChanged(context.Background(), "test.txt", info, FileState{}) {
+		t.Error("expected HasChanged to return true for new file (empty state)")
+	}
+	// State written before mtimes were recorded
+	if detector.HasChanged(context.Background(), "test.txt", info, FileState{Size: 100}) {
+		t.Error("expected HasChanged to return false when no mtime is recorded")
+	}
+}
+
+// fixedDetector always returns the same answer and counts calls
+type fixedDetector struct {
+	changed bool
+	calls   int
+}
+
+func (d *fixedDetector) HasChanged(context.Context, string, fs.FileInfo, FileState) bool {
+	d.calls++
+	return d.changed
+}
+
+func TestCompositeAnyOf(t *testing.T) {
+	info := mockFileInfo{name: "test.txt", size: 100}
+
+	yes, no := &fixedDetector{changed: true}, &fixedDetector{changed: false}
+	if !AnyOf(no, yes).HasChanged(context.Background(), "test.txt", info, FileState{}) {
+		t.Error("expected AnyOf to report a change when one detector does")
+	}
+	if AnyOf(no, no).HasChanged(context.Background(), "test.txt", info, FileState{}) {
+		t.Error("expected AnyOf to report no change when no detector does")
+	}
+
+	// Stops at the first change
+	first, second := &fixedDetector{changed: true}, &fixedDetector{changed: true}
+	AnyOf(first, second).HasChanged(context.Background(), "test.txt", info, FileState{})
+	if second.calls != 0 {
+		t.Error("expected AnyOf to short-circuit after the first change")
+	}
+}
+
+func TestCompositeAllOf(t *testing.T) {
+	info := mockFileInfo{name: "test.txt", size: 100}
+
+	yes, no := &fixedDetector{changed: true}, &fixedDetector{changed: false}
+	if AllOf(yes, no).HasChanged(context.Background(), "test.txt", info, FileState{}) {
+		t.Error("expected AllOf to report no change when one detector doesn't")
+	}
+	if !AllOf(yes, yes).HasChanged(context.Background(), "test.txt", info, FileState{}) {
+		t.Error("expected AllOf to report a change when every detector does")
+	}
+
+	// The expensive detector is skipped once the cheap one says unchanged
+	expensive := &fixedDetector{changed: true}
+	AllOf(&fixedDetector{changed: false}, expensive).HasChanged(context.Background(), "test.txt", info, FileState{})
+	if expensive.calls != 0 {
+		t.Error("expected AllOf to short-circuit after the first unchanged result")
+	}
+}
+
+func TestTieredDetectorOnlyHashesInconclusiveFiles(t *testing.T) {
+	d, err := New("size+mtime+hash", "")
+	if err != nil {
+		t.Fatalf("failed to create detector: %v", err)
+	}
+	digester, ok := d.(Digester)
+	if !ok {
+		t.Fatal("expected tiered detector to implement Digester")
+	}
+
+	path, info := writeTestFile(t, "content")
+	digest, _ := FileDigest(path, DefaultHashAlgorithm)
+
+	// Size and mtime match: unchanged, nothing hashed
+	state := FileState{Size: info.Size(), ModTime: info.ModTime().Unix(), Digest: digest}
+	if d.HasChanged(context.Background(), path, info, state) {
+		t.Error("expected no change when size and mtime match")
+	}
+	if _, ok := digester.CachedDigest(path); ok {
+		t.Error("expected no hashing when the cheap checks are conclusive")
+	}
+
+	// Touched but identical: hashed, reported unchanged
+	state.ModTime = info.ModTime().Add(-time.Hour).Unix()
+	if d.HasChanged(context.Background(), path, info, state) {
+		t.Error("expected no change when only the mtime differs and the digest matches")
+	}
+	if cached, ok := digester.CachedDigest(path); !ok || cached != digest {
+		t.Errorf("expected the digest to be computed, got %q (%v)", cached, ok)
+	}
+}
+
+func TestTieredDetectorHashesTouchedFileWithoutDigest(t *testing.T) {
+	d, err := New("size+mtime+hash", "")
+	if err != nil {
+		t.Fatalf("failed to create detector: %v", err)
+	}
+
+	path, info := writeTestFile(t, "content")
+
+	// A same-size edit with a newer mtime, recorded by a run without hashing
+	state := FileState{Size: info.Size(), ModTime: info.ModTime().Add(-time.Hour).Unix()}
+	if !d.HasChanged(context.Background(), path, info, state) {
+		t.Error("expected a change when the mtime differs and no digest is recorded")
+	}
+}
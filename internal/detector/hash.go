@@ -0,0 +1,175 @@
+package detector
+
+import (
+	"context"
+	"crypto/md5"  //nolint:gosec // offered for speed, not security
+	"crypto/sha1" //nolint:gosec // offered for speed, not security
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mackeper/m_backuper/internal/ctxio"
+)
+
+const DefaultHashAlgorithm = "sha256"
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// HashDetector compares a content digest. Sizes are compared first so files
+// with a different size are never hashed.
+type HashDetector struct {
+	digests   map[string]string // computed by HasChanged, handed out by Digest
+	algorithm string
+	mu        sync.Mutex
+}
+
+func NewHashDetector(algorithm string) (*HashDetector, error) {
+	if algorithm == "" {
+		algorithm = DefaultHashAlgorithm
+	}
+	if _, ok := hashAlgorithms[algorithm]; !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+	}
+	return &HashDetector{
+		digests:   make(map[string]string),
+		algorithm: algorithm,
+	}, nil
+}
+
+func (d *HashDetector) HasChanged(ctx context.Context, path string, info fs.FileInfo, state FileState) bool {
+	// If state has zero values, this is a new file
+	if state.Size == 0 && state.ModTime == 0 && state.Digest == "" {
+		return true
+	}
+
+	if info.Size() != state.Size {
+		return true
+	}
+
+	// Without a digest of this algorithm there is nothing to tell the backup
+	// copy is current, so the file is copied again and its digest taken from
+	// the bytes written
+	if DigestAlgorithm(state.Digest) != d.algorithm {
+		return true
+	}
+
+	digest, err := fileDigest(ctx, path, d.algorithm)
+	if err != nil {
+		slog.Warn("failed to hash file, treating as changed", "path", path, "error", err)
+		return true
+	}
+
+	d.mu.Lock()
+	d.digests[path] = digest
+	d.mu.Unlock()
+
+	return digest != state.Digest
+}
+
+// Digest returns the digest computed by the last HasChanged call for path,
+// hashing the file only if HasChanged didn't
+func (d *HashDetector) Digest(ctx context.Context, path string) (string, error) {
+	if digest, ok := d.CachedDigest(path); ok {
+		return digest, nil
+	}
+	return fileDigest(ctx, path, d.algorithm)
+}
+
+// CachedDigest returns and forgets the digest computed by HasChanged, if any
+func (d *HashDetector) CachedDigest(path string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	digest, ok := d.digests[path]
+	delete(d.digests, path)
+	return digest, ok
+}
+
+// Forget drops the digest computed by HasChanged, e.g. when the copy it was
+// meant for failed
+func (d *HashDetector) Forget(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.digests, path)
+}
+
+func (d *HashDetector) Algorithm() string {
+	return d.algorithm
+}
+
+// FileDigest hashes a file and returns "<algorithm>:<hex>"
+func FileDigest(path, algorithm string) (string, error) {
+	return fileDigest(context.Background(), path, algorithm)
+}
+
+// fileDigest is FileDigest that gives up between chunks once ctx is cancelled
+func fileDigest(ctx context.Context, path, algorithm string) (string, error) {
+	f, err := os.Open(path) //nolint:gosec // path is from filesystem scan
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("failed to close file", "path", path, "error", err)
+		}
+	}()
+	return ReaderDigest(ctxio.NewReader(ctx, f), algorithm)
+}
+
+// ReaderDigest hashes everything read from r and returns "<algorithm>:<hex>"
+func ReaderDigest(r io.Reader, algorithm string) (string, error) {
+	w, err := NewDigestWriter(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return "", fmt.Errorf("failed to hash contents: %w", err)
+	}
+	return w.Digest(), nil
+}
+
+// DigestWriter hashes everything written to it, so a file can be hashed while
+// it is copied
+type DigestWriter struct {
+	hash      hash.Hash
+	algorithm string
+}
+
+func NewDigestWriter(algorithm string) (*DigestWriter, error) {
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+	}
+	return &DigestWriter{hash: newHash(), algorithm: algorithm}, nil
+}
+
+func (w *DigestWriter) Write(p []byte) (int, error) {
+	return w.hash.Write(p)
+}
+
+// Digest returns "<algorithm>:<hex>" of what was written so far
+func (w *DigestWriter) Digest() string {
+	return w.algorithm + ":" + hex.EncodeToString(w.hash.Sum(nil))
+}
+
+// DigestAlgorithm returns the algorithm prefix of a digest, or "" if there is none
+func DigestAlgorithm(digest string) string {
+	algorithm, _, found := strings.Cut(digest, ":")
+	if !found {
+		return ""
+	}
+	return algorithm
+}
@@ -0,0 +1,27 @@
+package detector
+
+import (
+	"context"
+	"io/fs"
+)
+
+type ModTimeDetector struct{}
+
+func NewModTimeDetector() *ModTimeDetector {
+	return &ModTimeDetector{}
+}
+
+func (d *ModTimeDetector) HasChanged(_ context.Context, path string, info fs.FileInfo, state FileState) bool {
+	// If state has zero values, this is a new file
+	if state.Size == 0 && state.ModTime == 0 {
+		return true
+	}
+
+	// State written before mtimes were recorded: don't force a full recopy,
+	// the mtime is stored on this run
+	if state.ModTime == 0 {
+		return false
+	}
+
+	return info.ModTime().Unix() != state.ModTime
+}
@@ -1,6 +1,9 @@
 package detector
 
-import "io/fs"
+import (
+	"context"
+	"io/fs"
+)
 
 type SizeDetector struct{}
 
@@ -8,7 +11,7 @@ func NewSizeDetector() *SizeDetector {
 	return &SizeDetector{}
 }
 
-func (d *SizeDetector) HasChanged(path string, info fs.FileInfo, state FileState) bool {
+func (d *SizeDetector) HasChanged(_ context.Context, path string, info fs.FileInfo, state FileState) bool {
 	// If state has zero values, this is a new file
 	if state.Size == 0 && state.ModTime == 0 {
 		return true
@@ -0,0 +1,237 @@
+package ignore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileName is the ignore file picked up in every directory that is scanned.
+// Its rules apply to the directory's contents, like a .gitignore.
+const FileName = ".m_backuperignore"
+
+// rule is one pattern in gitignore syntax
+type rule struct {
+	segments []string // pattern split on "/", a "**" segment matches any number of them
+	negate   bool
+	dirOnly  bool
+}
+
+// Matcher holds the rules of one ignore file, or those of the config
+type Matcher struct {
+	base  string // directory the rules are relative to, "" for absolute paths
+	rules []rule
+}
+
+// New returns a matcher for the config's ignore patterns. They follow
+// gitignore syntax, except that a pattern only anchors when it starts with
+// "/", which makes it an absolute path. Any other pattern matches at any
+// depth, e.g. ".cache/*" ignores the contents of every .cache directory.
+func New(patterns []string) *Matcher {
+	m := &Matcher{}
+	for _, pattern := range patterns {
+		m.add(pattern, true)
+	}
+	return m
+}
+
+// NewAt returns a matcher for patterns as if they were in an ignore file in
+// base, so a pattern with a slash at the start or in the middle is anchored
+// to base and any other matches at any depth below it
+func NewAt(base string, patterns []string) *Matcher {
+	m := &Matcher{base: base}
+	for _, pattern := range patterns {
+		m.add(pattern, false)
+	}
+	return m
+}
+
+// ReadFile returns the lines of dir's ignore file, or nil when there is none
+func ReadFile(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, FileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ignore file: %w", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("failed to close ignore file", "dir", dir, "error", err)
+		}
+	}()
+
+	patterns := []string{}
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		patterns = append(patterns, lines.Text())
+	}
+	if err := lines.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %w", err)
+	}
+	return patterns, nil
+}
+
+// add parses a pattern and appends its rule. Blank lines and comments add
+// nothing. A pattern with a slash at the start or in the middle is anchored
+// to the base, unless floating is set.
+func (m *Matcher) add(pattern string, floating bool) {
+	pattern = trimTrailingSpaces(strings.TrimSuffix(pattern, "\r"))
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return
+	}
+
+	var r rule
+	switch {
+	case strings.HasPrefix(pattern, "!"):
+		r.negate = true
+		pattern = pattern[1:]
+	case strings.HasPrefix(pattern, `\!`), strings.HasPrefix(pattern, `\#`):
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return
+	}
+
+	anchored := strings.Contains(pattern, "/")
+	if floating {
+		anchored = strings.HasPrefix(pattern, "/")
+	}
+	pattern = strings.TrimLeft(pattern, "/")
+	if !anchored {
+		pattern = "**/" + pattern
+	}
+
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == "**" && len(r.segments) > 0 && r.segments[len(r.segments)-1] == "**" {
+			continue
+		}
+		segment = bracketNegation(segment)
+		if _, err := path.Match(segment, ""); err != nil {
+			slog.Warn("skipping malformed ignore pattern", "pattern", pattern, "base", m.base)
+			return
+		}
+		r.segments = append(r.segments, segment)
+	}
+	m.rules = append(m.rules, r)
+}
+
+// Match reports whether path is ignored, and whether any rule matched it at
+// all. The last matching rule decides. Only path itself is checked, callers
+// walking a tree are expected not to descend into ignored directories.
+func (m *Matcher) Match(path string, isDir bool) (ignored, matched bool) {
+	rel, ok := m.relative(path)
+	if !ok {
+		return false, false
+	}
+	segments := strings.Split(rel, "/")
+
+	for i := len(m.rules) - 1; i >= 0; i-- {
+		r := m.rules[i]
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(r.segments, segments) {
+			return !r.negate, true
+		}
+	}
+	return false, false
+}
+
+// relative returns path relative to the base with forward slashes, or false
+// when it isn't below it
+func (m *Matcher) relative(p string) (string, bool) {
+	if m.base == "" {
+		p = filepath.ToSlash(strings.TrimPrefix(p, filepath.VolumeName(p)))
+		p = strings.Trim(p, "/")
+		return p, p != ""
+	}
+	rel, err := filepath.Rel(m.base, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// Chain is the ignore files in effect in a directory, the config's first and
+// the directory's own last. A deeper file overrides the ones above it.
+type Chain []*Matcher
+
+// With returns the chain extended by m, leaving c as it is
+func (c Chain) With(m *Matcher) Chain {
+	return append(c[:len(c):len(c)], m)
+}
+
+// Ignored reports whether path is ignored by the chain
+func (c Chain) Ignored(path string, isDir bool) bool {
+	for i := len(c) - 1; i >= 0; i-- {
+		if ignored, matched := c[i].Match(path, isDir); matched {
+			return ignored
+		}
+	}
+	return false
+}
+
+// matchSegments matches path segments against pattern segments. A "**"
+// matches zero or more segments, except at the end, where it matches
+// everything inside a directory but not the directory itself.
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				return len(segments) > 0
+			}
+			for i := range len(segments) + 1 {
+				if matchSegments(rest, segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// trimTrailingSpaces drops trailing spaces that aren't escaped with a backslash
+func trimTrailingSpaces(s string) string {
+	for strings.HasSuffix(s, " ") && !strings.HasSuffix(s, `\ `) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// bracketNegation rewrites gitignore's "[!...]" to the "[^...]" path.Match expects
+func bracketNegation(segment string) string {
+	var b strings.Builder
+	for i := 0; i < len(segment); i++ {
+		c := segment[i]
+		b.WriteByte(c)
+		switch {
+		case c == '\\' && i+1 < len(segment):
+			i++
+			b.WriteByte(segment[i])
+		case c == '[' && i+1 < len(segment) && segment[i+1] == '!':
+			i++
+			b.WriteByte('^')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,116 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigPatterns(t *testing.T) {
+	tests := []struct {
+		path    string
+		pattern string
+		isDir   bool
+		want    bool
+	}{
+		{"/path/to/file.tmp", "*.tmp", false, true},
+		{"/path/to/file.txt", "*.tmp", false, false},
+		{"/path/.cache/data", ".cache/*", false, true},
+		{"/path/cache/data", ".cache/*", false, false},
+		{"/path/to/node_modules/lib.js", "**/node_modules/**", false, true},
+		{"/path/to/lib.js", "**/node_modules/**", false, false},
+		{"/path/my_node_modules_backup/lib.js", "**/node_modules/**", false, false},
+		{"/path/to/node_modules", "**/node_modules/**", true, false},
+		{"/path/to/node_modules", "node_modules/", true, true},
+		{"/path/to/node_modules", "node_modules/", false, false},
+		{"/home/me/secret/key", "/home/me/secret/*", false, true},
+		{"/other/home/me/secret/key", "/home/me/secret/*", false, false},
+		{"/a/x/b/y/z/c.log", "a/**/b/**/*.log", false, true},
+		{"/a/b/c.log", "a/**/b/**/*.log", false, true},
+		{"/a/b/c.txt", "a/**/b/**/*.log", false, false},
+		{"/path/file1", "file[!0-9]", false, false},
+		{"/path/fileA", "file[!0-9]", false, true},
+		{"/path/#notes", `\#notes`, false, true},
+		{"/path/#notes", "#notes", false, false},
+	}
+
+	for _, tt := range tests {
+		got, _ := New([]string{tt.pattern}).Match(tt.path, tt.isDir)
+		if got != tt.want {
+			t.Errorf("Match(%q) with %q = %v, want %v", tt.path, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestLastMatchingRuleWins(t *testing.T) {
+	m := New([]string{"*.log", "!keep.log"})
+
+	tests := []struct {
+		path    string
+		want    bool
+		matched bool
+	}{
+		{"/var/debug.log", true, true},
+		{"/var/keep.log", false, true},
+		{"/var/notes.txt", false, false},
+	}
+	for _, tt := range tests {
+		got, matched := m.Match(tt.path, false)
+		if got != tt.want || matched != tt.matched {
+			t.Errorf("Match(%q) = %v, %v, want %v, %v", tt.path, got, matched, tt.want, tt.matched)
+		}
+	}
+}
+
+func TestIgnoreFileScopesRulesToDirectory(t *testing.T) {
+	dir := t.TempDir()
+	content := "# build output\nbuild/\n/top.txt\nsub/*.tmp\ntrailing.txt   \n"
+	if err := os.WriteFile(filepath.Join(dir, FileName), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns, err := ReadFile(dir)
+	if err != nil {
+		t.Fatalf("failed to read ignore file: %v", err)
+	}
+	m := NewAt(dir, patterns)
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{filepath.Join(dir, "build"), true, true},
+		{filepath.Join(dir, "x", "build"), true, true},
+		{filepath.Join(dir, "top.txt"), false, true},
+		{filepath.Join(dir, "x", "top.txt"), false, false}, // anchored to dir
+		{filepath.Join(dir, "sub", "a.tmp"), false, true},
+		{filepath.Join(dir, "x", "sub", "a.tmp"), false, false}, // a middle slash anchors too
+		{filepath.Join(dir, "trailing.txt"), false, true},
+		{filepath.Join(filepath.Dir(dir), "top.txt"), false, false}, // outside dir
+	}
+	for _, tt := range tests {
+		if got, _ := m.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	if patterns, err := ReadFile(filepath.Join(dir, "build")); patterns != nil || err != nil {
+		t.Errorf("expected nothing for a directory without ignore file, got %v, %v", patterns, err)
+	}
+}
+
+func TestChainDeeperFileOverrides(t *testing.T) {
+	sub := filepath.Join(t.TempDir(), "sub")
+	chain := Chain{New([]string{"*.log"})}
+	deeper := chain.With(NewAt(sub, []string{"!important.log"}))
+	if !chain.Ignored(filepath.Join(sub, "important.log"), false) {
+		t.Error("expected config pattern to apply on its own")
+	}
+	if deeper.Ignored(filepath.Join(sub, "important.log"), false) {
+		t.Error("expected deeper ignore file to re-include the file")
+	}
+	if !deeper.Ignored(filepath.Join(sub, "other.log"), false) {
+		t.Error("expected config pattern to still apply to other files")
+	}
+}
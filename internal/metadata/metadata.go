@@ -0,0 +1,148 @@
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// modeBits are the parts of a file mode that are preserved
+const modeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// Metadata is what a plain copy loses: permission bits, timestamps, ownership
+// and extended attributes
+type Metadata struct {
+	Mode       fs.FileMode       `json:"mode"`
+	ModTime    time.Time         `json:"mtime"`
+	AccessTime time.Time         `json:"atime"`
+	UID        int               `json:"uid"` // -1 when the platform has no owner IDs
+	GID        int               `json:"gid"`
+	Xattrs     map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// Capture reads the metadata of path. info is the result of an earlier stat,
+// so the caller doesn't pay for a second one.
+func Capture(path string, info fs.FileInfo) (*Metadata, error) {
+	m := &Metadata{
+		Mode:       info.Mode() & modeBits,
+		ModTime:    info.ModTime(),
+		AccessTime: info.ModTime(),
+		UID:        -1,
+		GID:        -1,
+	}
+	captureSys(m, info)
+
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return m, fmt.Errorf("failed to read extended attributes: %w", err)
+	}
+	m.Xattrs = xattrs
+	return m, nil
+}
+
+// Apply sets the metadata on path as far as the filesystem and the current
+// user allow. Ownership is only changed when running as root. All steps are
+// attempted and their errors joined.
+func Apply(path string, m *Metadata) error {
+	var errs []error
+
+	// chown clears setuid/setgid bits, so it has to come before chmod
+	if m.UID >= 0 && os.Geteuid() == 0 {
+		if err := os.Lchown(path, m.UID, m.GID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set owner: %w", err))
+		}
+	}
+	if err := os.Chmod(path, m.Mode); err != nil {
+		errs = append(errs, fmt.Errorf("failed to set mode: %w", err))
+	}
+	if err := writeXattrs(path, m.Xattrs); err != nil {
+		errs = append(errs, fmt.Errorf("failed to set extended attributes: %w", err))
+	}
+	// Times go last, the other steps may touch them
+	if err := os.Chtimes(path, m.AccessTime, m.ModTime); err != nil {
+		errs = append(errs, fmt.Errorf("failed to set times: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// Sidecar maps source paths to their metadata. It is stored as JSON with the
+// backed up files so destinations that can't hold metadata themselves (like
+// SMB shares) don't lose it. Symlinks they can't hold are kept as well.
+type Sidecar struct {
+	Files map[string]*Metadata `json:"files"`
+	Links map[string]string    `json:"links,omitempty"` // link targets by source path
+	mu    sync.Mutex
+}
+
+func NewSidecar() *Sidecar {
+	return &Sidecar{
+		Files: make(map[string]*Metadata),
+		Links: make(map[string]string),
+	}
+}
+
+func (s *Sidecar) Set(path string, m *Metadata) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Files[path] = m
+}
+
+// SetLink records that path is a symlink to target
+func (s *Sidecar) SetLink(path, target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Links[path] = target
+}
+
+// Link returns the target recorded for path, or "". A nil Sidecar has no entries.
+func (s *Sidecar) Link(path string) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Links[path]
+}
+
+// Get returns the metadata recorded for path, or nil. A nil Sidecar has no entries.
+func (s *Sidecar) Get(path string) *Metadata {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Files[path]
+}
+
+// Len returns the number of recorded files and links
+func (s *Sidecar) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.Files) + len(s.Links)
+}
+
+func (s *Sidecar) Marshal() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Marshal(s)
+}
+
+// ReadSidecar decodes a sidecar written by Marshal
+func ReadSidecar(r io.Reader) (*Sidecar, error) {
+	s := NewSidecar()
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata sidecar: %w", err)
+	}
+	if s.Files == nil {
+		s.Files = make(map[string]*Metadata)
+	}
+	if s.Links == nil {
+		s.Links = make(map[string]string)
+	}
+	return s, nil
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestXattrsArePreserved(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src.txt")
+	dst := filepath.Join(tmpDir, "dst.txt")
+	info := writeTestFile(t, src, 0o644, time.Now())
+	writeTestFile(t, dst, 0o644, time.Now())
+
+	if err := syscall.Setxattr(src, "user.m_backuper_test", []byte("value"), 0); err != nil {
+		t.Skipf("filesystem does not support user xattrs: %v", err)
+	}
+
+	m, err := Capture(src, info)
+	if err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	if string(m.Xattrs["user.m_backuper_test"]) != "value" {
+		t.Fatalf("expected xattr to be captured, got %v", m.Xattrs)
+	}
+
+	if err := Apply(dst, m); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	buf := make([]byte, 16)
+	n, err := syscall.Getxattr(dst, "user.m_backuper_test", buf)
+	if err != nil || string(buf[:n]) != "value" {
+		t.Errorf("xattr not applied: %q, %v", buf[:n], err)
+	}
+}
+
+func TestCaptureOwnerAndAccessTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	atime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	info := writeTestFile(t, path, 0o644, time.Now())
+	if err := os.Chtimes(path, atime, info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Stat(path)
+
+	m, err := Capture(path, info)
+	if err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	if m.UID != os.Getuid() || m.GID != os.Getgid() {
+		t.Errorf("captured owner %d:%d, want %d:%d", m.UID, m.GID, os.Getuid(), os.Getgid())
+	}
+	if !m.AccessTime.Equal(atime) {
+		t.Errorf("captured atime %v, want %v", m.AccessTime, atime)
+	}
+}
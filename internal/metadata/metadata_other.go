@@ -0,0 +1,23 @@
+//go:build !linux
+
+package metadata
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// captureSys has nothing to add where owner IDs and access times aren't
+// exposed portably; the access time falls back to the modification time
+func captureSys(_ *Metadata, _ fs.FileInfo) {}
+
+func readXattrs(_ string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattrs(_ string, xattrs map[string][]byte) error {
+	if len(xattrs) > 0 {
+		return errors.New("extended attributes are not supported on this platform")
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package metadata
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, path string, mode os.FileMode, mtime time.Time) os.FileInfo {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte("content"), 0o600); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatalf("failed to chmod test file: %v", err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("failed to set test file times: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat test file: %v", err)
+	}
+	return info
+}
+
+func TestCaptureAndApply(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not preserved on Windows")
+	}
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src.sh")
+	dst := filepath.Join(tmpDir, "dst.sh")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	info := writeTestFile(t, src, 0o750, mtime)
+	writeTestFile(t, dst, 0o600, time.Now())
+
+	m, err := Capture(src, info)
+	if err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	if m.Mode != 0o750 {
+		t.Errorf("captured mode %v, want 0750", m.Mode)
+	}
+
+	if err := Apply(dst, m); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	got, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Mode().Perm() != 0o750 {
+		t.Errorf("applied mode %v, want 0750", got.Mode().Perm())
+	}
+	if !got.ModTime().Equal(mtime) {
+		t.Errorf("applied mtime %v, want %v", got.ModTime(), mtime)
+	}
+}
+
+func TestSidecarRoundTrip(t *testing.T) {
+	sidecar := NewSidecar()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	sidecar.Set("/home/me/run.sh", &Metadata{
+		Mode:    0o755,
+		ModTime: mtime,
+		UID:     1000,
+		GID:     1000,
+		Xattrs:  map[string][]byte{"user.tag": []byte("blue")},
+	})
+	sidecar.SetLink("/home/me/current", "releases/v2")
+
+	data, err := sidecar.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	loaded, err := ReadSidecar(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadSidecar failed: %v", err)
+	}
+
+	m := loaded.Get("/home/me/run.sh")
+	if m == nil {
+		t.Fatal("expected entry to survive the round trip")
+	}
+	if m.Mode != 0o755 || !m.ModTime.Equal(mtime) || m.UID != 1000 || string(m.Xattrs["user.tag"]) != "blue" {
+		t.Errorf("entry changed in the round trip: %+v", m)
+	}
+	if target := loaded.Link("/home/me/current"); target != "releases/v2" {
+		t.Errorf("expected link target to survive the round trip, got %q", target)
+	}
+
+	var missing *Sidecar
+	if missing.Get("/anything") != nil || missing.Link("/anything") != "" {
+		t.Error("expected nil sidecar to have no entries")
+	}
+}
@@ -84,3 +84,30 @@ func GetPathType(path string) string {
 	}
 	return "local path"
 }
+
+// IsUNCPath checks if the path is a UNC share path (//server/share or \\server\share)
+// regardless of the current OS
+func IsUNCPath(path string) bool {
+	return strings.HasPrefix(path, `\\`) || strings.HasPrefix(path, `//`)
+}
+
+// ParseUNC splits a UNC path into host, share and the path inside the share.
+// The host may include a port (//server:4445/share). The returned path uses
+// forward slashes and has no leading slash.
+func ParseUNC(path string) (host, share, rest string, err error) {
+	if !IsUNCPath(path) {
+		return "", "", "", fmt.Errorf("not a UNC path: %s", path)
+	}
+
+	trimmed := strings.TrimLeft(strings.ReplaceAll(path, `\`, "/"), "/")
+	parts := strings.SplitN(trimmed, "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", fmt.Errorf("UNC path must contain a server and a share: %s", path)
+	}
+
+	host, share = parts[0], parts[1]
+	if len(parts) == 3 {
+		rest = strings.Trim(parts[2], "/")
+	}
+	return host, share, rest, nil
+}
@@ -274,6 +274,82 @@ func TestGetPathType(t *testing.T) {
 	}
 }
 
+func TestIsUNCPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expected bool
+	}{
+		{name: "forward slashes", path: "//server/share/backup", expected: true},
+		{name: "backslashes", path: `\\server\share\backup`, expected: true},
+		{name: "absolute unix path", path: "/mnt/smb/backup", expected: false},
+		{name: "windows drive path", path: `C:\Users\test`, expected: false},
+		{name: "relative path", path: "backup", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsUNCPath(tt.path); got != tt.expected {
+				t.Errorf("IsUNCPath(%q) = %v, expected %v", tt.path, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseUNC(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		wantHost  string
+		wantShare string
+		wantRest  string
+		wantErr   bool
+	}{
+		{
+			name:      "share with nested path",
+			path:      "//192.168.1.100/backups/m_backuper",
+			wantHost:  "192.168.1.100",
+			wantShare: "backups",
+			wantRest:  "m_backuper",
+		},
+		{
+			name:      "backslashes",
+			path:      `\\nas\backups\m_backuper\laptop`,
+			wantHost:  "nas",
+			wantShare: "backups",
+			wantRest:  "m_backuper/laptop",
+		},
+		{
+			name:      "share root with trailing slash",
+			path:      "//nas:4445/backups/",
+			wantHost:  "nas:4445",
+			wantShare: "backups",
+			wantRest:  "",
+		},
+		{name: "missing share", path: "//nas", wantErr: true},
+		{name: "not a UNC path", path: "/mnt/backups", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, share, rest, err := ParseUNC(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseUNC(%q) expected error, got nil", tt.path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseUNC(%q) returned error: %v", tt.path, err)
+			}
+			if host != tt.wantHost || share != tt.wantShare || rest != tt.wantRest {
+				t.Errorf("ParseUNC(%q) = (%q, %q, %q), expected (%q, %q, %q)",
+					tt.path, host, share, rest, tt.wantHost, tt.wantShare, tt.wantRest)
+			}
+		})
+	}
+}
+
 // Helper function
 func contains(s, substr string) bool {
 	return s != "" && substr != "" && (s == substr || len(s) >= len(substr) && containsIgnoreCase(s, substr))
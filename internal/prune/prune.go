@@ -0,0 +1,229 @@
+package prune
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/backup"
+	"github.com/mackeper/m_backuper/internal/copier"
+)
+
+// pruningPrefix marks a snapshot directory that is being deleted. ListSnapshots
+// skips dot directories, so a prune interrupted halfway never leaves behind
+// something that looks like a complete snapshot.
+const pruningPrefix = ".prune-"
+
+// Policy says which snapshots to keep. Every rule adds to the kept set, and a
+// zero Policy keeps everything.
+//
+//nolint:govet // fieldalignment: field order optimized for readability
+type Policy struct {
+	KeepLast    int           // newest N snapshots
+	KeepDaily   int           // newest snapshot of each of the last N days
+	KeepWeekly  int           // newest snapshot of each of the last N ISO weeks
+	KeepMonthly int           // newest snapshot of each of the last N months
+	KeepWithin  time.Duration // every snapshot younger than this
+}
+
+// IsZero reports whether the policy has no rules
+func (p Policy) IsZero() bool {
+	return p == Policy{}
+}
+
+// Decision is one snapshot in a plan
+type Decision struct {
+	Name    string
+	Time    time.Time
+	Reasons []string // why the snapshot is kept, empty when it is removed
+}
+
+type Plan struct {
+	Keep   []Decision // newest first, unrecognized names last
+	Remove []Decision // newest first
+}
+
+// NewPlan applies the policy to a device's snapshots. Days, weeks and months
+// are counted in UTC like the snapshot names. The latest snapshot is always
+// kept since the next backup links from it, an unfinished one since the next
+// backup resumes it, and so are names that don't parse.
+func NewPlan(names []string, latest string, policy Policy, now time.Time) *Plan {
+	decisions := make([]*Decision, 0, len(names))
+	var unrecognized []Decision
+	for _, name := range names {
+		t, err := backup.ParseSnapshotTime(name)
+		if err != nil {
+			slog.Warn("keeping snapshot with unrecognized name", "snapshot", name)
+			unrecognized = append(unrecognized, Decision{Name: name, Reasons: []string{"unrecognized name"}})
+			continue
+		}
+		decisions = append(decisions, &Decision{Name: name, Time: t})
+	}
+	sort.Slice(decisions, func(i, j int) bool {
+		if decisions[i].Time.Equal(decisions[j].Time) {
+			return decisions[i].Name > decisions[j].Name
+		}
+		return decisions[i].Time.After(decisions[j].Time)
+	})
+
+	rules := []struct {
+		reason string
+		count  int
+		bucket func(time.Time) string
+	}{
+		{"last", policy.KeepLast, nil},
+		{"daily", policy.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", policy.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{"monthly", policy.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	// Each rule keeps the newest snapshot of each bucket until it has kept count of them
+	for _, rule := range rules {
+		kept := 0
+		lastBucket := ""
+		for _, d := range decisions {
+			if kept >= rule.count {
+				break
+			}
+			bucket := d.Name
+			if rule.bucket != nil {
+				bucket = rule.bucket(d.Time.UTC())
+			}
+			if bucket == lastBucket {
+				continue
+			}
+			lastBucket = bucket
+			d.Reasons = append(d.Reasons, rule.reason)
+			kept++
+		}
+	}
+
+	unfinished := backup.UnfinishedSnapshot(names, latest)
+	plan := &Plan{}
+	for _, d := range decisions {
+		if policy.KeepWithin > 0 && now.Sub(d.Time) <= policy.KeepWithin {
+			d.Reasons = append(d.Reasons, "within "+policy.KeepWithin.String())
+		}
+		if d.Name == latest {
+			d.Reasons = append(d.Reasons, "latest")
+		}
+		if d.Name == unfinished {
+			// The next backup resumes it, see backup.UnfinishedSnapshot
+			d.Reasons = append(d.Reasons, "unfinished")
+		}
+
+		if len(d.Reasons) > 0 {
+			plan.Keep = append(plan.Keep, *d)
+		} else {
+			plan.Remove = append(plan.Remove, *d)
+		}
+	}
+	plan.Keep = append(plan.Keep, unrecognized...)
+	return plan
+}
+
+type Prune struct {
+	restorer   copier.Restorer
+	remover    copier.Remover
+	backupRoot string
+	deviceID   string
+}
+
+func New(r copier.Restorer, rm copier.Remover, backupRoot, deviceID string) *Prune {
+	return &Prune{
+		restorer:   r,
+		remover:    rm,
+		backupRoot: backupRoot,
+		deviceID:   deviceID,
+	}
+}
+
+// Run computes the plan for the device's snapshots and, unless dryRun is set,
+// deletes the snapshots it drops.
+//
+// Removing a snapshot only unlinks its own directory entries. Files that are
+// hard-linked from a kept snapshot live on through those links, so nothing a
+// kept snapshot refers to can be lost, and files are never opened for writing.
+func (p *Prune) Run(policy Policy, now time.Time, dryRun bool) (*Plan, error) {
+	if policy.IsZero() {
+		return nil, errors.New("no retention rules configured, refusing to prune")
+	}
+
+	names, err := backup.ListSnapshots(p.restorer, p.backupRoot, p.deviceID)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := backup.LatestSnapshot(p.restorer, p.backupRoot, p.deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := NewPlan(names, latest, policy, now)
+	slog.Info("prune plan", "device_id", p.deviceID, "keep", len(plan.Keep), "remove", len(plan.Remove), "dry_run", dryRun)
+	if dryRun {
+		return plan, nil
+	}
+
+	p.removeLeftovers()
+
+	errorCount := 0
+	for _, d := range plan.Remove {
+		if err := p.removeSnapshot(d.Name); err != nil {
+			slog.Error("failed to remove snapshot", "snapshot", d.Name, "error", err)
+			errorCount++
+			continue
+		}
+		slog.Info("removed snapshot", "snapshot", d.Name)
+	}
+
+	if errorCount > 0 {
+		return plan, fmt.Errorf("%d snapshots failed to be removed", errorCount)
+	}
+	return plan, nil
+}
+
+// removeSnapshot first renames the snapshot and its metadata out of the
+// listing, then deletes them
+func (p *Prune) removeSnapshot(name string) error {
+	root := backup.SnapshotRoot(p.backupRoot, p.deviceID, name)
+	staging := backup.SnapshotRoot(p.backupRoot, p.deviceID, pruningPrefix+name)
+	if err := p.remover.Rename(root, staging); err != nil {
+		return fmt.Errorf("failed to move snapshot aside: %w", err)
+	}
+	if err := p.remover.Rename(backup.MetaRoot(root), backup.MetaRoot(staging)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to move snapshot metadata aside: %w", err)
+	}
+	if err := p.remover.RemoveAll(backup.MetaRoot(staging)); err != nil {
+		return err
+	}
+	return p.remover.RemoveAll(staging)
+}
+
+// removeLeftovers finishes deleting snapshots from an interrupted prune
+func (p *Prune) removeLeftovers() {
+	snapshotsDir := backup.SnapshotsRoot(p.backupRoot, p.deviceID)
+	for _, dir := range []string{snapshotsDir, filepath.Join(snapshotsDir, backup.MetaDir)} {
+		entries, err := p.restorer.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || !strings.HasPrefix(entry.Name(), pruningPrefix) {
+				continue
+			}
+			leftover := filepath.Join(dir, entry.Name())
+			slog.Info("removing leftover of interrupted prune", "path", leftover)
+			if err := p.remover.RemoveAll(leftover); err != nil {
+				slog.Warn("failed to remove leftover of interrupted prune", "path", leftover, "error", err)
+			}
+		}
+	}
+}
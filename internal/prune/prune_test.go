@@ -0,0 +1,206 @@
+package prune
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/backup"
+	"github.com/mackeper/m_backuper/internal/copier"
+)
+
+const deviceID = "test-device"
+
+func names(decisions []Decision) []string {
+	out := make([]string, 0, len(decisions))
+	for _, d := range decisions {
+		out = append(out, d.Name)
+	}
+	return out
+}
+
+func TestNewPlan(t *testing.T) {
+	snapshots := []string{
+		"2024-03-01T10-00-00Z",
+		"2024-04-28T10-00-00Z",
+		"2024-05-06T10-00-00Z",
+		"2024-05-10T09-00-00Z",
+		"2024-05-10T18-00-00Z",
+		"2024-05-11T10-00-00Z",
+		"2024-05-11T10-00-00Z-2",
+	}
+	now := time.Date(2024, 5, 11, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		latest string // defaults to the newest snapshot
+		policy Policy
+		keep   []string
+	}{
+		{
+			name:   "keep last",
+			policy: Policy{KeepLast: 2},
+			keep:   []string{"2024-05-11T10-00-00Z-2", "2024-05-11T10-00-00Z"},
+		},
+		{
+			name:   "keep daily takes the newest of each day",
+			policy: Policy{KeepDaily: 2},
+			keep:   []string{"2024-05-11T10-00-00Z-2", "2024-05-10T18-00-00Z"},
+		},
+		{
+			name:   "keep weekly uses ISO weeks starting on monday",
+			policy: Policy{KeepWeekly: 2},
+			keep:   []string{"2024-05-11T10-00-00Z-2", "2024-04-28T10-00-00Z"},
+		},
+		{
+			name:   "keep monthly",
+			policy: Policy{KeepMonthly: 3},
+			keep:   []string{"2024-05-11T10-00-00Z-2", "2024-04-28T10-00-00Z", "2024-03-01T10-00-00Z"},
+		},
+		{
+			name:   "keep within",
+			policy: Policy{KeepWithin: 48 * time.Hour},
+			keep:   []string{"2024-05-11T10-00-00Z-2", "2024-05-11T10-00-00Z", "2024-05-10T18-00-00Z", "2024-05-10T09-00-00Z"},
+		},
+		{
+			name:   "latest is always kept",
+			latest: "2024-05-10T18-00-00Z",
+			policy: Policy{KeepMonthly: 1},
+			keep:   []string{"2024-05-11T10-00-00Z-2", "2024-05-10T18-00-00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			latest := tt.latest
+			if latest == "" {
+				latest = "2024-05-11T10-00-00Z-2"
+			}
+
+			plan := NewPlan(snapshots, latest, tt.policy, now)
+			if got := names(plan.Keep); !reflect.DeepEqual(got, tt.keep) {
+				t.Errorf("kept %v, want %v", got, tt.keep)
+			}
+			if len(plan.Keep)+len(plan.Remove) != len(snapshots) {
+				t.Errorf("plan covers %d snapshots, want %d", len(plan.Keep)+len(plan.Remove), len(snapshots))
+			}
+		})
+	}
+}
+
+func TestNewPlanKeepsUnfinishedSnapshot(t *testing.T) {
+	snapshots := []string{"2024-05-01T10-00-00Z", "2024-05-02T10-00-00Z", "2024-05-03T10-00-00Z"}
+	plan := NewPlan(snapshots, "2024-05-01T10-00-00Z", Policy{KeepWithin: time.Hour}, time.Now())
+
+	if got := names(plan.Keep); !reflect.DeepEqual(got, []string{"2024-05-03T10-00-00Z", "2024-05-01T10-00-00Z"}) {
+		t.Errorf("expected latest and the unfinished snapshot to be kept, kept %v", got)
+	}
+}
+
+func TestNewPlanKeepsUnrecognizedNames(t *testing.T) {
+	plan := NewPlan([]string{"2024-05-01T10-00-00Z", "manual-copy"}, "", Policy{KeepLast: 1}, time.Now())
+
+	if got := names(plan.Keep); !reflect.DeepEqual(got, []string{"2024-05-01T10-00-00Z", "manual-copy"}) {
+		t.Errorf("expected unrecognized snapshot to be kept, kept %v", got)
+	}
+	if len(plan.Remove) != 0 {
+		t.Errorf("expected nothing removed, got %v", names(plan.Remove))
+	}
+}
+
+// writeSnapshot creates a snapshot holding file.txt, hard-linked from linkFrom when given
+func writeSnapshot(t *testing.T, backupRoot, name, linkFrom string) string {
+	t.Helper()
+
+	path := filepath.Join(backup.SnapshotRoot(backupRoot, deviceID, name), "home", "file.txt")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if linkFrom != "" {
+		if err := os.Link(linkFrom, path); err != nil {
+			t.Fatal(err)
+		}
+	} else if err := os.WriteFile(path, []byte("shared content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunKeepsHardLinkedFiles(t *testing.T) {
+	backupRoot := t.TempDir()
+	oldFile := writeSnapshot(t, backupRoot, "2024-05-01T10-00-00Z", "")
+	newFile := writeSnapshot(t, backupRoot, "2024-05-02T10-00-00Z", oldFile)
+	if err := os.WriteFile(filepath.Join(backup.SnapshotsRoot(backupRoot, deviceID), backup.LatestFile), []byte("2024-05-02T10-00-00Z\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldManifest := backup.ManifestPath(backup.SnapshotRoot(backupRoot, deviceID, "2024-05-01T10-00-00Z"))
+	if err := os.MkdirAll(filepath.Dir(oldManifest), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(oldManifest, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := copier.NewLocalCopier(backupRoot)
+	p := New(c, c, backupRoot, deviceID)
+
+	// Dry run removes nothing
+	plan, err := p.Run(Policy{KeepLast: 1}, time.Now(), true)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if len(plan.Remove) != 1 {
+		t.Fatalf("expected 1 snapshot planned for removal, got %v", names(plan.Remove))
+	}
+	if _, err := os.Stat(oldFile); err != nil {
+		t.Fatalf("dry run removed the old snapshot: %v", err)
+	}
+
+	if _, err := p.Run(Policy{KeepLast: 1}, time.Now(), false); err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Dir(filepath.Dir(oldFile))); !os.IsNotExist(err) {
+		t.Error("expected old snapshot to be removed")
+	}
+	if _, err := os.Stat(filepath.Dir(oldManifest)); !os.IsNotExist(err) {
+		t.Error("expected metadata of old snapshot to be removed")
+	}
+	if content, err := os.ReadFile(newFile); err != nil || string(content) != "shared content" {
+		t.Errorf("hard-linked file in kept snapshot was lost: %q, %v", content, err)
+	}
+
+	remaining, err := backup.ListSnapshots(c, backupRoot, deviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(remaining, []string{"2024-05-02T10-00-00Z"}) {
+		t.Errorf("expected only the latest snapshot to remain, got %v", remaining)
+	}
+}
+
+func TestRunRemovesLeftoversOfInterruptedPrune(t *testing.T) {
+	backupRoot := t.TempDir()
+	writeSnapshot(t, backupRoot, "2024-05-02T10-00-00Z", "")
+	leftover := writeSnapshot(t, backupRoot, pruningPrefix+"2024-05-01T10-00-00Z", "")
+
+	c := copier.NewLocalCopier(backupRoot)
+	if _, err := New(c, c, backupRoot, deviceID).Run(Policy{KeepLast: 1}, time.Now(), false); err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error("expected leftover of interrupted prune to be removed")
+	}
+}
+
+func TestRunRefusesEmptyPolicy(t *testing.T) {
+	backupRoot := t.TempDir()
+	c := copier.NewLocalCopier(backupRoot)
+
+	if _, err := New(c, c, backupRoot, deviceID).Run(Policy{}, time.Now(), false); err == nil {
+		t.Error("expected error for empty retention policy, got nil")
+	}
+}
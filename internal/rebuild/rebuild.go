@@ -0,0 +1,241 @@
+package rebuild
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/backup"
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/restore"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+//nolint:govet // fieldalignment: field order optimized for readability
+type Result struct {
+	Scanned  int // files found at the destination
+	Added    int // files recorded in state, the next backup skips them
+	Changed  int // source differs from the backup copy or can't be confirmed
+	NoSource int // backup copies whose source no longer exists
+	Errors   int
+}
+
+//nolint:govet // fieldalignment: field order optimized for readability
+type Options struct {
+	// Snapshot reads the named snapshot instead of the mirror
+	Snapshot string
+	// HashAlgorithm confirms files by comparing the digests of both copies
+	// and records them. Empty compares sizes and modification times only.
+	HashAlgorithm string
+	DryRun        bool
+}
+
+// Rebuild recreates lost local state from what the destination already holds
+type Rebuild struct {
+	restorer   copier.Restorer
+	state      state.Store
+	backupRoot string
+	deviceID   string
+}
+
+func New(r copier.Restorer, st state.Store, backupRoot, deviceID string) *Rebuild {
+	return &Rebuild{
+		restorer:   r,
+		state:      st,
+		backupRoot: backupRoot,
+		deviceID:   deviceID,
+	}
+}
+
+// Run lists the files of the device's backup, maps each back to its source
+// path and records it in state when the source still matches it. Files that
+// don't match are left out, so the next backup copies them again.
+//
+// Without a hash algorithm a file matches when size and modification time
+// agree. A complete manifest provides both without walking the backup.
+// Otherwise the original time comes from the metadata sidecar when there is
+// one, or from the backup copy, which only keeps it with preserve_metadata.
+func (r *Rebuild) Run(opts Options) (*Result, error) {
+	deviceRoot := filepath.Join(r.backupRoot, r.deviceID)
+	if opts.Snapshot != "" {
+		deviceRoot = backup.SnapshotRoot(r.backupRoot, r.deviceID, opts.Snapshot)
+	}
+	slog.Info("starting state rebuild", "device_id", r.deviceID, "snapshot", opts.Snapshot,
+		"hash", opts.HashAlgorithm, "dry_run", opts.DryRun)
+
+	result := &Result{}
+	record := func(backupPath, sourcePath string, c candidate) {
+		result.Scanned++
+		fileState, outcome := r.match(backupPath, sourcePath, c, opts.HashAlgorithm)
+		switch outcome {
+		case outcomeChanged:
+			result.Changed++
+			return
+		case outcomeNoSource:
+			result.NoSource++
+			return
+		case outcomeFailed:
+			result.Errors++
+			return
+		}
+
+		if opts.DryRun {
+			fmt.Printf("would record %s (%d bytes)\n", sourcePath, fileState.Size)
+		} else if err := r.state.Put(sourcePath, fileState); err != nil {
+			slog.Error("failed to update state", "path", sourcePath, "error", err)
+			result.Errors++
+			return
+		}
+		result.Added++
+	}
+
+	manifest, err := backup.LoadManifest(r.restorer, deviceRoot)
+	if err != nil {
+		slog.Warn("failed to load manifest, walking the backup instead", "error", err)
+	}
+	if manifest != nil && manifest.Complete {
+		slog.Info("using manifest", "run_id", manifest.RunID, "files", len(manifest.Files))
+		for sourcePath, fileState := range manifest.Files {
+			record(filepath.Join(deviceRoot, sourcePath), sourcePath, candidate{
+				size:     fileState.Size,
+				modTime:  time.Unix(fileState.ModTime, 0),
+				backedUp: fileState.BackedUp,
+				digest:   fileState.Digest,
+			})
+		}
+	} else if err := r.walk(deviceRoot, record, result); err != nil {
+		return nil, err
+	}
+
+	if !opts.DryRun {
+		if err := r.state.Save(); err != nil {
+			return nil, err
+		}
+	}
+
+	slog.Info("state rebuild complete",
+		"scanned", result.Scanned,
+		"added", result.Added,
+		"changed", result.Changed,
+		"no_source", result.NoSource,
+		"errors", result.Errors,
+		"dry_run", opts.DryRun,
+	)
+	return result, nil
+}
+
+// walk reads the backup itself when there is no complete manifest
+func (r *Rebuild) walk(deviceRoot string, record func(string, string, candidate), result *Result) error {
+	sidecar, err := backup.LoadSidecar(r.restorer, deviceRoot)
+	if err != nil {
+		slog.Warn("failed to load metadata sidecar, using backup times", "error", err)
+	}
+
+	err = r.restorer.Walk(deviceRoot, func(backupPath string, info fs.FileInfo) error {
+		rel, err := filepath.Rel(deviceRoot, backupPath)
+		if err != nil {
+			slog.Warn("failed to map backup path", "path", backupPath, "error", err)
+			result.Errors++
+			return nil
+		}
+		sourcePath := restore.OriginalPath(rel)
+		c := candidate{
+			size:     info.Size(),
+			modTime:  info.ModTime(),
+			backedUp: info.ModTime().Format(time.RFC3339),
+		}
+		if m := sidecar.Get(sourcePath); m != nil {
+			c.modTime = m.ModTime
+		}
+		record(backupPath, sourcePath, c)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to walk backup %s: %w", deviceRoot, err)
+	}
+	return nil
+}
+
+// candidate is what is known about a backup copy before comparing it with
+// its source
+type candidate struct {
+	size     int64
+	modTime  time.Time // of the source when it was backed up
+	backedUp string
+	digest   string // from the manifest, if hashed
+}
+
+type matchOutcome int
+
+const (
+	outcomeMatched matchOutcome = iota
+	outcomeChanged
+	outcomeNoSource
+	outcomeFailed
+)
+
+// match compares a backup copy with its source and returns the state entry
+// to record when they are the same file
+func (r *Rebuild) match(backupPath, sourcePath string, c candidate, algorithm string) (state.FileState, matchOutcome) {
+	sourceInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("failed to stat source file", "path", sourcePath, "error", err)
+		}
+		return state.FileState{}, outcomeNoSource
+	}
+	if !sourceInfo.Mode().IsRegular() || sourceInfo.Size() != c.size {
+		return state.FileState{}, outcomeChanged
+	}
+
+	fileState := state.FileState{
+		Size:     sourceInfo.Size(),
+		ModTime:  sourceInfo.ModTime().Unix(),
+		BackedUp: c.backedUp,
+	}
+
+	if algorithm == "" {
+		if c.modTime.Unix() != fileState.ModTime {
+			return state.FileState{}, outcomeChanged
+		}
+		// Same size and time, so a recorded digest still holds
+		fileState.Digest = c.digest
+		return fileState, outcomeMatched
+	}
+
+	sourceDigest, err := detector.FileDigest(sourcePath, algorithm)
+	if err != nil {
+		slog.Warn("failed to hash source file", "path", sourcePath, "error", err)
+		return state.FileState{}, outcomeFailed
+	}
+	backupDigest := c.digest
+	if detector.DigestAlgorithm(backupDigest) != algorithm {
+		if backupDigest, err = r.backupDigest(backupPath, algorithm); err != nil {
+			slog.Warn("failed to hash backup file", "path", backupPath, "error", err)
+			return state.FileState{}, outcomeFailed
+		}
+	}
+	if sourceDigest != backupDigest {
+		return state.FileState{}, outcomeChanged
+	}
+	fileState.Digest = sourceDigest
+	return fileState, outcomeMatched
+}
+
+func (r *Rebuild) backupDigest(backupPath, algorithm string) (string, error) {
+	f, err := r.restorer.Open(backupPath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("failed to close backup file", "path", backupPath, "error", err)
+		}
+	}()
+	return detector.ReaderDigest(f, algorithm)
+}
@@ -0,0 +1,142 @@
+package rebuild
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/backup"
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/state"
+	"github.com/mackeper/m_backuper/internal/testutil"
+)
+
+const deviceID = "test-device"
+
+// freshState stands in for the state lost on a reinstall
+func freshState(t *testing.T) *state.State {
+	t.Helper()
+	st, err := state.LoadFrom(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestRebuildWithHashRecordsIdenticalFiles(t *testing.T) {
+	srcDir, backupRoot, _ := testutil.SetupBackup(t, deviceID, map[string]string{
+		"same.txt":       "unchanged",
+		"sub/nested.txt": "nested",
+		"edited.txt":     "version 1",
+		"deleted.txt":    "gone soon",
+	}, false)
+	if err := os.WriteFile(filepath.Join(srcDir, "edited.txt"), []byte("version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(srcDir, "deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	st := freshState(t)
+	result, err := New(copier.NewLocalCopier(backupRoot), st, backupRoot, deviceID).Run(Options{HashAlgorithm: "sha256"})
+	if err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+
+	if result.Scanned != 4 || result.Added != 2 || result.Changed != 1 || result.NoSource != 1 || result.Errors != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	same := filepath.Join(srcDir, "same.txt")
+	fileState, exists := st.GetFileState(same)
+	if !exists {
+		t.Fatal("expected identical file in rebuilt state")
+	}
+	want, _ := detector.FileDigest(same, "sha256")
+	if fileState.Digest != want || fileState.Size != int64(len("unchanged")) {
+		t.Errorf("unexpected state entry %+v", fileState)
+	}
+	if _, exists := st.GetFileState(filepath.Join(srcDir, "sub", "nested.txt")); !exists {
+		t.Error("expected nested file in rebuilt state")
+	}
+	if _, exists := st.GetFileState(filepath.Join(srcDir, "edited.txt")); exists {
+		t.Error("expected edited file to be left for the next backup")
+	}
+}
+
+func TestRebuildComparesTimesFromSidecar(t *testing.T) {
+	srcDir, backupRoot, _ := testutil.SetupBackup(t, deviceID, map[string]string{
+		"same.txt":    "unchanged",
+		"touched.txt": "same size",
+	}, true)
+	// As left by a version that didn't write manifests
+	if err := os.Remove(backup.ManifestPath(filepath.Join(backupRoot, deviceID))); err != nil {
+		t.Fatal(err)
+	}
+	touched := filepath.Join(srcDir, "touched.txt")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(touched, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	st := freshState(t)
+	result, err := New(copier.NewLocalCopier(backupRoot), st, backupRoot, deviceID).Run(Options{})
+	if err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+
+	if result.Added != 1 || result.Changed != 1 {
+		t.Errorf("expected 1 added and 1 changed, got %+v", result)
+	}
+	if _, exists := st.GetFileState(filepath.Join(srcDir, "same.txt")); !exists {
+		t.Error("expected file with matching time in rebuilt state")
+	}
+}
+
+func TestRebuildUsesManifest(t *testing.T) {
+	srcDir, backupRoot, _ := testutil.SetupBackup(t, deviceID, map[string]string{
+		"same.txt":    "unchanged",
+		"touched.txt": "same size",
+	}, false)
+	touched := filepath.Join(srcDir, "touched.txt")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(touched, later, later); err != nil {
+		t.Fatal(err)
+	}
+	// Files the manifest doesn't list aren't looked at
+	stray := filepath.Join(backupRoot, deviceID, srcDir, "stray.txt")
+	if err := os.WriteFile(stray, []byte("stray"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest knows the source times even though the copies don't keep them
+	st := freshState(t)
+	result, err := New(copier.NewLocalCopier(backupRoot), st, backupRoot, deviceID).Run(Options{})
+	if err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if result.Scanned != 2 || result.Added != 1 || result.Changed != 1 {
+		t.Errorf("expected 2 scanned, 1 added and 1 changed, got %+v", result)
+	}
+	if _, exists := st.GetFileState(filepath.Join(srcDir, "same.txt")); !exists {
+		t.Error("expected unchanged file in rebuilt state")
+	}
+}
+
+func TestRebuildDryRunLeavesStateAlone(t *testing.T) {
+	_, backupRoot, _ := testutil.SetupBackup(t, deviceID, map[string]string{"file.txt": "content"}, false)
+
+	st := freshState(t)
+	result, err := New(copier.NewLocalCopier(backupRoot), st, backupRoot, deviceID).Run(Options{HashAlgorithm: "sha256", DryRun: true})
+	if err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if result.Added != 1 {
+		t.Errorf("expected 1 file to be reported, got %+v", result)
+	}
+	if st.FileCount() != 0 {
+		t.Errorf("expected dry run to leave state empty, got %d entries", st.FileCount())
+	}
+}
@@ -0,0 +1,284 @@
+package restore
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mackeper/m_backuper/internal/backup"
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/metadata"
+)
+
+// Policy decides what happens when a restored file already exists at its target
+type Policy string
+
+const (
+	PolicySkip      Policy = "skip"
+	PolicyOverwrite Policy = "overwrite"
+	PolicyRename    Policy = "rename"
+)
+
+// ParsePolicy validates a policy name from the command line
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicySkip, PolicyOverwrite, PolicyRename:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overwrite policy %q (expected skip, overwrite or rename)", s)
+	}
+}
+
+//nolint:govet // fieldalignment: field order optimized for readability
+type Options struct {
+	DeviceID string // device whose backup is restored
+	Snapshot string // snapshot to restore from; empty restores the mirror
+	Pattern  string // optional path prefix or glob matched against original paths
+	Target   string // directory to restore into; empty restores to the original location
+	Policy   Policy
+	DryRun   bool
+}
+
+type Restore struct {
+	restorer   copier.Restorer
+	backupRoot string
+}
+
+func New(r copier.Restorer, backupRoot string) *Restore {
+	return &Restore{
+		restorer:   r,
+		backupRoot: backupRoot,
+	}
+}
+
+func (r *Restore) Run(opts Options) error {
+	deviceRoot := filepath.Join(r.backupRoot, opts.DeviceID)
+	if opts.Snapshot != "" {
+		deviceRoot = backup.SnapshotRoot(r.backupRoot, opts.DeviceID, opts.Snapshot)
+	}
+	slog.Info("starting restore", "device_id", opts.DeviceID, "snapshot", opts.Snapshot, "pattern", opts.Pattern,
+		"target", opts.Target, "policy", opts.Policy, "dry_run", opts.DryRun)
+
+	// Metadata the destination couldn't hold is reapplied from the sidecar
+	sidecar, err := backup.LoadSidecar(r.restorer, deviceRoot)
+	if err != nil {
+		slog.Warn("failed to load metadata sidecar, restoring without it", "error", err)
+	}
+
+	restoredCount := 0
+	skippedCount := 0
+	errorCount := 0
+
+	// linkTarget is set for a symlink backed up as a link
+	restoreFile := func(backupPath, rel string, size int64, linkTarget string) {
+		originalPath := OriginalPath(rel)
+		if !Match(originalPath, opts.Pattern) {
+			return
+		}
+
+		targetPath := originalPath
+		if opts.Target != "" {
+			targetPath = filepath.Join(opts.Target, rel)
+		}
+
+		targetPath, ok := resolveTarget(targetPath, opts.Policy)
+		if !ok {
+			slog.Debug("target exists, skipping", "path", targetPath)
+			skippedCount++
+			return
+		}
+
+		if linkTarget != "" {
+			if opts.DryRun {
+				fmt.Printf("would restore link %s -> %s (to %s)\n", originalPath, targetPath, linkTarget)
+			} else if err := restoreLink(linkTarget, targetPath); err != nil {
+				slog.Error("failed to restore link", "path", originalPath, "error", err)
+				errorCount++
+				return
+			}
+			restoredCount++
+			return
+		}
+
+		if opts.DryRun {
+			fmt.Printf("would restore %s -> %s (%d bytes)\n", originalPath, targetPath, size)
+			restoredCount++
+			return
+		}
+
+		if _, err := r.restorer.Restore(backupPath, targetPath); err != nil {
+			slog.Error("failed to restore file", "path", originalPath, "error", err)
+			errorCount++
+			return
+		}
+		if m := sidecar.Get(originalPath); m != nil {
+			if err := metadata.Apply(targetPath, m); err != nil {
+				slog.Warn("failed to restore metadata", "path", targetPath, "error", err)
+			}
+		}
+		restoredCount++
+	}
+
+	// A complete manifest lists every file, which saves walking a remote tree
+	manifest, err := backup.LoadManifest(r.restorer, deviceRoot)
+	if err != nil {
+		slog.Warn("failed to load manifest, walking the backup instead", "error", err)
+	}
+	if manifest != nil && manifest.Complete {
+		slog.Info("restoring files listed in manifest", "run_id", manifest.RunID, "files", len(manifest.Files))
+		for _, path := range sortedPaths(manifest.Files) {
+			backupPath := filepath.Join(deviceRoot, path)
+			rel, err := filepath.Rel(deviceRoot, backupPath)
+			if err != nil {
+				slog.Warn("failed to map backup path", "path", backupPath, "error", err)
+				errorCount++
+				continue
+			}
+			fileState := manifest.Files[path]
+			restoreFile(backupPath, rel, fileState.Size, fileState.LinkTarget)
+		}
+	} else {
+		err = r.restorer.Walk(deviceRoot, func(backupPath string, info fs.FileInfo) error {
+			rel, err := filepath.Rel(deviceRoot, backupPath)
+			if err != nil {
+				slog.Warn("failed to map backup path", "path", backupPath, "error", err)
+				errorCount++
+				return nil
+			}
+			linkTarget := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				if linkTarget, err = r.readlink(backupPath); err != nil {
+					slog.Warn("failed to read link", "path", backupPath, "error", err)
+					errorCount++
+					return nil
+				}
+			}
+			restoreFile(backupPath, rel, info.Size(), linkTarget)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to walk backup %s: %w", deviceRoot, err)
+		}
+
+		// Links the destination couldn't store are only in the sidecar
+		if sidecar != nil {
+			for _, path := range sortedPaths(sidecar.Links) {
+				backupPath := filepath.Join(deviceRoot, path)
+				rel, err := filepath.Rel(deviceRoot, backupPath)
+				if err != nil {
+					slog.Warn("failed to map backup path", "path", backupPath, "error", err)
+					errorCount++
+					continue
+				}
+				restoreFile(backupPath, rel, 0, sidecar.Links[path])
+			}
+		}
+	}
+
+	slog.Info("restore complete",
+		"restored", restoredCount,
+		"skipped", skippedCount,
+		"errors", errorCount,
+		"dry_run", opts.DryRun,
+	)
+
+	if errorCount > 0 {
+		return fmt.Errorf("%d files failed to restore", errorCount)
+	}
+	return nil
+}
+
+func sortedPaths[V any](files map[string]V) []string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// readlink returns the target of a link in the backup
+func (r *Restore) readlink(backupPath string) (string, error) {
+	symlinker, ok := r.restorer.(copier.Symlinker)
+	if !ok {
+		return "", fmt.Errorf("backup root can't hold links")
+	}
+	return symlinker.Readlink(backupPath)
+}
+
+// restoreLink recreates a symlink at path, replacing what is there when the
+// overwrite policy let it through
+func restoreLink(target, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to replace existing file: %w", err)
+	}
+	return os.Symlink(target, path)
+}
+
+// OriginalPath maps a path relative to <backup_root>/<device_id> back to the
+// source path it was backed up from (the inverse of the join in backup.Run)
+func OriginalPath(rel string) string {
+	if filepath.VolumeName(rel) != "" {
+		return rel
+	}
+	return string(filepath.Separator) + rel
+}
+
+// Match reports whether an original path is selected by a prefix or glob pattern.
+// Globs match the full path or any of its parent directories.
+func Match(originalPath, pattern string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	pattern = filepath.Clean(pattern)
+	if !strings.ContainsAny(pattern, "*?[") {
+		return originalPath == pattern ||
+			strings.HasPrefix(originalPath, strings.TrimSuffix(pattern, string(filepath.Separator))+string(filepath.Separator))
+	}
+
+	for p := originalPath; ; p = filepath.Dir(p) {
+		if matched, err := filepath.Match(pattern, p); err == nil && matched {
+			return true
+		}
+		if filepath.Dir(p) == p {
+			return false
+		}
+	}
+}
+
+// resolveTarget applies the overwrite policy to an existing target path. It
+// returns the path to write to and false when the file should be skipped.
+func resolveTarget(targetPath string, policy Policy) (string, bool) {
+	if _, err := os.Lstat(targetPath); os.IsNotExist(err) {
+		return targetPath, true
+	}
+
+	switch policy {
+	case PolicyOverwrite:
+		return targetPath, true
+	case PolicyRename:
+		ext := filepath.Ext(targetPath)
+		base := strings.TrimSuffix(targetPath, ext)
+		for i := 1; ; i++ {
+			suffix := ".restored"
+			if i > 1 {
+				suffix += "-" + strconv.Itoa(i)
+			}
+			candidate := base + suffix + ext
+			if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+				return candidate, true
+			}
+		}
+	default:
+		return targetPath, false
+	}
+}
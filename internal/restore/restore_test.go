@@ -0,0 +1,360 @@
+package restore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/backup"
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/scanner"
+	"github.com/mackeper/m_backuper/internal/state"
+	"github.com/mackeper/m_backuper/internal/testutil"
+)
+
+func TestRestoreToTargetDirectory(t *testing.T) {
+	files := map[string]string{
+		"file1.txt":        "content 1",
+		"subdir/file2.txt": "content 2",
+	}
+	srcDir, backupRoot, _ := testutil.SetupBackup(t, "device-a", files, false)
+
+	target := filepath.Join(t.TempDir(), "restored")
+	r := New(copier.NewLocalCopier(backupRoot), backupRoot)
+	if err := r.Run(Options{DeviceID: "device-a", Target: target, Policy: PolicySkip}); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	for name, expected := range files {
+		rel, _ := filepath.Rel(string(filepath.Separator), filepath.Join(srcDir, name))
+		got, err := os.ReadFile(filepath.Join(target, rel))
+		if err != nil {
+			t.Errorf("file %s was not restored: %v", name, err)
+			continue
+		}
+		if string(got) != expected {
+			t.Errorf("content mismatch for %s: expected %q, got %q", name, expected, got)
+		}
+	}
+}
+
+func TestRestoreToOriginalLocation(t *testing.T) {
+	srcDir, backupRoot, _ := testutil.SetupBackup(t, "device-a", map[string]string{"file.txt": "original"}, false)
+
+	srcFile := filepath.Join(srcDir, "file.txt")
+	if err := os.Remove(srcFile); err != nil {
+		t.Fatalf("failed to remove source file: %v", err)
+	}
+
+	r := New(copier.NewLocalCopier(backupRoot), backupRoot)
+	if err := r.Run(Options{DeviceID: "device-a", Policy: PolicySkip}); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	got, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatalf("file was not restored to original location: %v", err)
+	}
+	if string(got) != "original" {
+		t.Errorf("expected %q, got %q", "original", got)
+	}
+}
+
+func TestRestoreOverwritePolicies(t *testing.T) {
+	tests := []struct {
+		policy       Policy
+		wantOriginal string
+		wantRenamed  bool
+	}{
+		{PolicySkip, "local edit", false},
+		{PolicyOverwrite, "backed up", false},
+		{PolicyRename, "local edit", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			srcDir, backupRoot, _ := testutil.SetupBackup(t, "device-a", map[string]string{"file.txt": "backed up"}, false)
+
+			srcFile := filepath.Join(srcDir, "file.txt")
+			if err := os.WriteFile(srcFile, []byte("local edit"), 0644); err != nil {
+				t.Fatalf("failed to modify source file: %v", err)
+			}
+
+			r := New(copier.NewLocalCopier(backupRoot), backupRoot)
+			if err := r.Run(Options{DeviceID: "device-a", Policy: tt.policy}); err != nil {
+				t.Fatalf("restore failed: %v", err)
+			}
+
+			got, _ := os.ReadFile(srcFile)
+			if string(got) != tt.wantOriginal {
+				t.Errorf("expected original file to contain %q, got %q", tt.wantOriginal, got)
+			}
+
+			renamed, err := os.ReadFile(filepath.Join(srcDir, "file.restored.txt"))
+			if tt.wantRenamed {
+				if err != nil {
+					t.Fatalf("renamed file was not created: %v", err)
+				}
+				if string(renamed) != "backed up" {
+					t.Errorf("expected renamed file to contain %q, got %q", "backed up", renamed)
+				}
+			} else if err == nil {
+				t.Error("renamed file should not exist")
+			}
+		})
+	}
+}
+
+func TestRestoreDryRunWritesNothing(t *testing.T) {
+	_, backupRoot, _ := testutil.SetupBackup(t, "device-a", map[string]string{"file.txt": "content"}, false)
+
+	target := filepath.Join(t.TempDir(), "restored")
+	r := New(copier.NewLocalCopier(backupRoot), backupRoot)
+	if err := r.Run(Options{DeviceID: "device-a", Target: target, Policy: PolicySkip, DryRun: true}); err != nil {
+		t.Fatalf("dry-run restore failed: %v", err)
+	}
+
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Error("dry-run should not create the target directory")
+	}
+}
+
+func TestRestoreOtherDeviceWithPattern(t *testing.T) {
+	files := map[string]string{
+		"docs/report.pdf": "pdf",
+		"docs/notes.txt":  "txt",
+		"photos/img.jpg":  "jpg",
+	}
+	srcDir, backupRoot, _ := testutil.SetupBackup(t, "other-device", files, false)
+
+	target := filepath.Join(t.TempDir(), "restored")
+	r := New(copier.NewLocalCopier(backupRoot), backupRoot)
+	opts := Options{
+		DeviceID: "other-device",
+		Pattern:  filepath.Join(srcDir, "docs", "*.pdf"),
+		Target:   target,
+		Policy:   PolicySkip,
+	}
+	if err := r.Run(opts); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	var restored []string
+	_ = filepath.WalkDir(target, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			restored = append(restored, filepath.Base(path))
+		}
+		return nil
+	})
+	if len(restored) != 1 || restored[0] != "report.pdf" {
+		t.Errorf("expected only report.pdf to be restored, got %v", restored)
+	}
+}
+
+func TestRestoreFromSnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	backupRoot := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	srcFile := filepath.Join(srcDir, "file.txt")
+	if err := os.WriteFile(srcFile, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := copier.NewLocalCopier(backupRoot)
+	st := state.New()
+	b := backup.New(scanner.New([]string{}), detector.NewSizeDetector(), c, st, "device-a")
+	b.SetSnapshots(true)
+	if _, err := b.Run(context.Background(), []string{srcDir}, backupRoot); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	first, _ := backup.LatestSnapshot(c, backupRoot, "device-a")
+
+	if err := os.WriteFile(srcFile, []byte("version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Run(context.Background(), []string{srcDir}, backupRoot); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	target := filepath.Join(t.TempDir(), "restored")
+	r := New(c, backupRoot)
+	if err := r.Run(Options{DeviceID: "device-a", Snapshot: first, Target: target, Policy: PolicySkip}); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	rel, _ := filepath.Rel(string(filepath.Separator), srcFile)
+	if content, _ := os.ReadFile(filepath.Join(target, rel)); string(content) != "v1" {
+		t.Errorf("expected the first snapshot's version, got %q", content)
+	}
+}
+
+func TestRestoreReappliesMetadataFromSidecar(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not preserved on Windows")
+	}
+
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	backupRoot := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	srcFile := filepath.Join(srcDir, "run.sh")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.WriteFile(srcFile, []byte("#!/bin/sh"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(srcFile, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(srcFile, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	// The copier doesn't preserve anything, like an SMB share
+	c := copier.NewLocalCopier(backupRoot)
+	b := backup.New(scanner.New([]string{}), detector.NewSizeDetector(), c, state.New(), "device-a")
+	b.SetPreserveMetadata(true)
+	if _, err := b.Run(context.Background(), []string{srcDir}, backupRoot); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	target := filepath.Join(t.TempDir(), "restored")
+	if err := New(c, backupRoot).Run(Options{DeviceID: "device-a", Target: target, Policy: PolicySkip}); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	rel, _ := filepath.Rel(string(filepath.Separator), srcFile)
+	info, err := os.Stat(filepath.Join(target, rel))
+	if err != nil {
+		t.Fatalf("file was not restored: %v", err)
+	}
+	if info.Mode().Perm() != 0o755 {
+		t.Errorf("restored mode %v, want 0755", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("restored mtime %v, want %v", info.ModTime(), mtime)
+	}
+
+	// The sidecar itself is not restored as a file
+	if _, err := os.Stat(filepath.Join(target, backup.MetaDir)); !os.IsNotExist(err) {
+		t.Error("sidecar directory should not be restored")
+	}
+}
+
+func TestRestoreUsesManifest(t *testing.T) {
+	srcDir, backupRoot, _ := testutil.SetupBackup(t, "device-a", map[string]string{"listed.txt": "listed"}, false)
+	deviceRoot := filepath.Join(backupRoot, "device-a")
+
+	// A file no run wrote isn't in the manifest, so restore doesn't see it
+	stray := filepath.Join(deviceRoot, srcDir, "stray.txt")
+	if err := os.WriteFile(stray, []byte("stray"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(t.TempDir(), "restored")
+	r := New(copier.NewLocalCopier(backupRoot), backupRoot)
+	if err := r.Run(Options{DeviceID: "device-a", Target: target, Policy: PolicySkip}); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	rel, _ := filepath.Rel(string(filepath.Separator), srcDir)
+	if _, err := os.Stat(filepath.Join(target, rel, "listed.txt")); err != nil {
+		t.Errorf("expected listed file to be restored: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, rel, "stray.txt")); !os.IsNotExist(err) {
+		t.Error("expected restore to follow the manifest instead of walking")
+	}
+
+	// Without a manifest the backup is walked
+	if err := os.Remove(backup.ManifestPath(deviceRoot)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(Options{DeviceID: "device-a", Target: target, Policy: PolicySkip}); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, rel, "stray.txt")); err != nil {
+		t.Errorf("expected walk to find the stray file: %v", err)
+	}
+}
+
+func TestRestoreRecreatesLinks(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	backupRoot := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "real.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real.txt", filepath.Join(srcDir, "current")); err != nil {
+		t.Skip("symlink creation not supported on this platform")
+	}
+
+	c := copier.NewLocalCopier(backupRoot)
+	s := scanner.New([]string{})
+	s.SetSymlinks(scanner.SymlinksPreserve)
+	b := backup.New(s, detector.NewSizeDetector(), c, state.New(), "device-a")
+	if _, err := b.Run(context.Background(), []string{srcDir}, backupRoot); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	rel, _ := filepath.Rel(string(filepath.Separator), srcDir)
+	restoreTo := func(target string) {
+		t.Helper()
+		if err := New(c, backupRoot).Run(Options{DeviceID: "device-a", Target: target, Policy: PolicySkip}); err != nil {
+			t.Fatalf("restore failed: %v", err)
+		}
+		if got, err := os.Readlink(filepath.Join(target, rel, "current")); err != nil || got != "real.txt" {
+			t.Errorf("expected link to real.txt, got %q, %v", got, err)
+		}
+	}
+
+	// From the manifest, then walking the backup
+	restoreTo(filepath.Join(t.TempDir(), "restored"))
+	if err := os.Remove(backup.ManifestPath(filepath.Join(backupRoot, "device-a"))); err != nil {
+		t.Fatal(err)
+	}
+	restoreTo(filepath.Join(t.TempDir(), "walked"))
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		path    string
+		pattern string
+		want    bool
+	}{
+		{"/home/user/docs/a.txt", "", true},
+		{"/home/user/docs/a.txt", "/home/user/docs", true},
+		{"/home/user/docs/a.txt", "/home/user/docs/", true},
+		{"/home/user/docs2/a.txt", "/home/user/docs", false},
+		{"/home/user/docs/a.txt", "/home/*/docs", true},
+		{"/home/user/docs/a.txt", "/home/user/docs/*.pdf", false},
+		{"/home/user/docs/a.pdf", "/home/user/docs/*.pdf", true},
+	}
+
+	for _, tt := range tests {
+		if got := Match(filepath.FromSlash(tt.path), filepath.FromSlash(tt.pattern)); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.path, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, valid := range []string{"skip", "overwrite", "rename"} {
+		if _, err := ParsePolicy(valid); err != nil {
+			t.Errorf("ParsePolicy(%q) returned error: %v", valid, err)
+		}
+	}
+	if _, err := ParsePolicy("merge"); err == nil {
+		t.Error("expected error for unknown policy, got nil")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package scanner
+
+import "os"
+
+// device can't tell filesystems apart where there are no device IDs, so
+// SetOneFileSystem has no effect there
+func device(_ os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -1,207 +1,497 @@
 package scanner
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
-	"strings"
+	"slices"
+
+	"github.com/mackeper/m_backuper/internal/ignore"
 )
 
 type FileInfo struct {
-	Path    string
-	Size    int64
-	ModTime int64 // Unix timestamp
-	IsDir   bool
+	Path       string // where the file was found, below a followed symlink too
+	Size       int64
+	ModTime    int64 // Unix timestamp
+	IsDir      bool
+	LinkTarget string // set for a symlink backed up as a link, see SymlinksPreserve
+}
+
+// SymlinkPolicy decides what happens to the symlinks found below the paths
+// to scan. A path to scan that is a symlink itself is always followed.
+type SymlinkPolicy string
+
+const (
+	SymlinksFollow   SymlinkPolicy = "follow"   // back up what the link points to, under the link's path
+	SymlinksPreserve SymlinkPolicy = "preserve" // back up the link itself
+	SymlinksSkip     SymlinkPolicy = "skip"     // leave links out
+)
+
+func ParseSymlinkPolicy(s string) (SymlinkPolicy, error) {
+	switch p := SymlinkPolicy(s); p {
+	case SymlinksFollow, SymlinksPreserve, SymlinksSkip:
+		return p, nil
+	case "":
+		return SymlinksFollow, nil
+	default:
+		return "", fmt.Errorf("unknown symlink policy %q (expected follow, preserve or skip)", s)
+	}
 }
 
+// Skipped is a path a walk passed over although no rule excludes it, like a
+// FIFO or a mount point
+type Skipped struct {
+	Path   string
+	Reason string // one of the Skip reasons
+}
+
+const (
+	SkipOtherFileSystem = "other_filesystem" // see SetOneFileSystem
+	SkipSocket          = "socket"
+	SkipFIFO            = "fifo"
+	SkipDevice          = "device"
+	SkipIrregular       = "irregular"  // any other file that isn't a regular one
+	SkipUnreadable      = "unreadable" // exists but couldn't be read, e.g. permission denied
+)
+
+// CacheDirTag marks a directory as a cache when its content starts with
+// CacheDirSignature, see https://bford.info/cachedir/
+const (
+	CacheDirTag       = "CACHEDIR.TAG"
+	CacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
 type Scanner struct {
-	ignorePatterns []string
+	ignore        *ignore.Matcher
+	rules         map[string]Rules // by cleaned path to scan
+	symlinks      SymlinkPolicy
+	oneFileSystem bool
+	excludeCaches bool
+	markers       map[string]bool // names of files that exclude their directory
+	onSkip        func(Skipped)
+	walkers       int  // directories read at the same time
+	ordered       bool // parallel walks report files in depth-first order
+}
+
+// Rules narrow down what is backed up below one of the paths to scan.
+// Patterns use gitignore syntax and are relative to that path.
+//
+//nolint:govet // fieldalignment: field order optimized for readability
+type Rules struct {
+	Include  []string // only files matching one of these, empty for all
+	Exclude  []string // ignored like in an ignore file at the path
+	MaxDepth int      // directory levels to descend, 1 for just the files in the path, 0 for no limit
+}
+
+// scope is what applies to a path while scanning
+type scope struct {
+	ignore   ignore.Chain
+	include  *ignore.Matcher // nil to include every file
+	depth    int             // below the path to scan, 0 for the path itself
+	maxDepth int
+	dirs     []string // real paths of the directories above, to catch symlink loops
+	device   uint64   // of the path to scan, when checkDev is set
+	checkDev bool
 }
 
+// New returns a scanner that skips paths matching ignorePatterns, see
+// ignore.New, and whatever the ignore files it comes across exclude
 func New(ignorePatterns []string) *Scanner {
 	return &Scanner{
-		ignorePatterns: ignorePatterns,
+		ignore:   ignore.New(ignorePatterns),
+		symlinks: SymlinksFollow,
+		walkers:  1,
 	}
 }
 
-func (s *Scanner) Scan(paths []string) ([]FileInfo, error) {
+// SetSymlinks sets what happens to symlinks below the paths to scan
+func (s *Scanner) SetSymlinks(policy SymlinkPolicy) {
+	s.symlinks = policy
+}
+
+// SetOneFileSystem keeps walks on the filesystem of each path to scan, so
+// mount points below it (like /proc, FUSE mounts or network shares) are
+// skipped. It has no effect on platforms without device IDs.
+func (s *Scanner) SetOneFileSystem(enabled bool) {
+	s.oneFileSystem = enabled
+}
+
+// SetExcludeCaches skips directories holding a valid CACHEDIR.TAG
+func (s *Scanner) SetExcludeCaches(enabled bool) {
+	s.excludeCaches = enabled
+}
+
+// SetExcludeMarkers skips directories holding a file with one of names,
+// e.g. ".nobackup". The paths to scan themselves are always scanned.
+func (s *Scanner) SetExcludeMarkers(names []string) {
+	s.markers = make(map[string]bool, len(names))
+	for _, name := range names {
+		s.markers[name] = true
+	}
+}
+
+// SetSkipHandler sets fn to be told about the paths in Skipped. With more
+// than one walker it may be called concurrently.
+func (s *Scanner) SetSkipHandler(fn func(Skipped)) {
+	s.onSkip = fn
+}
+
+// SetWalkers sets how many directories are read at the same time. This
+// speeds up scanning network shares and spinning disks with deep trees.
+func (s *Scanner) SetWalkers(n int) {
+	s.walkers = max(n, 1)
+}
+
+// SetOrdered makes parallel walks report files in the same order as a single
+// walker does: depth-first, each directory in name order. Directories are
+// still read ahead in parallel, so a slow consumer lets results pile up.
+func (s *Scanner) SetOrdered(ordered bool) {
+	s.ordered = ordered
+}
+
+// SetRules applies rules below path, one of the paths passed to Scan
+func (s *Scanner) SetRules(path string, rules Rules) {
+	if s.rules == nil {
+		s.rules = make(map[string]Rules)
+	}
+	s.rules[filepath.Clean(path)] = rules
+}
+
+// Scan walks paths and returns the files to back up. It stops with ctx's
+// error when ctx is cancelled.
+func (s *Scanner) Scan(ctx context.Context, paths []string) ([]FileInfo, error) {
 	var files []FileInfo
-	seen := make(map[string]bool) // Track visited paths to handle symlinks
+	err := s.Walk(ctx, paths, func(file FileInfo) error {
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
 
+// Walk calls fn for each file to back up as soon as it is found, so a slow
+// fn holds up the walk. fn is never called concurrently. It stops with fn's
+// error, or with ctx's error when ctx is cancelled.
+//
+// With more than one walker, see SetWalkers, directories are read in
+// parallel and files come in no particular order unless SetOrdered is set.
+func (s *Scanner) Walk(ctx context.Context, paths []string, fn func(FileInfo) error) error {
+	if s.walkers > 1 {
+		return s.walkParallel(ctx, paths, fn)
+	}
+
+	seen := newVisited()
 	for _, path := range paths {
-		s.scanPath(path, &files, seen)
+		if err := s.scanPath(ctx, path, path, fn, seen, s.rootScope(path)); err != nil {
+			return err
+		}
 	}
+	return ctx.Err()
+}
 
-	return files, nil
+// rootScope returns the scope of a path to scan
+func (s *Scanner) rootScope(path string) scope {
+	sc := scope{ignore: ignore.Chain{s.ignore}}
+	if s.oneFileSystem {
+		// A failed stat is logged when the path is visited
+		if info, err := os.Stat(path); err == nil {
+			sc.device, sc.checkDev = device(info)
+		}
+	}
+	rules, ok := s.rules[filepath.Clean(path)]
+	if !ok {
+		return sc
+	}
+	if len(rules.Exclude) > 0 {
+		sc.ignore = sc.ignore.With(ignore.NewAt(path, rules.Exclude))
+	}
+	if len(rules.Include) > 0 {
+		sc.include = ignore.NewAt(path, rules.Include)
+	}
+	sc.maxDepth = rules.MaxDepth
+	return sc
+}
+
+// scanPath calls fn for path, or the files below it, depth-first. treePath
+// is where path was found in the scanned tree, which differs from path below
+// a followed symlink. Only fn's error stops the walk, others are logged.
+func (s *Scanner) scanPath(ctx context.Context, path, treePath string, fn func(FileInfo) error, seen *visited, sc scope) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	f, ok := s.visit(path, treePath, seen, sc)
+	if !ok {
+		return nil
+	}
+	if !f.info.IsDir() {
+		return fn(f.fileInfo())
+	}
+
+	entries, entryScope, ok := s.readDir(f.path, f.treePath, sc)
+	if !ok {
+		return nil
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if err := s.scanPath(ctx, filepath.Join(f.path, name), filepath.Join(f.treePath, name), fn, seen, entryScope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// found is a path that passed the checks of visit
+type found struct {
+	path       string // symlinks resolved, unless preserved
+	treePath   string
+	info       os.FileInfo
+	linkTarget string
 }
 
-func (s *Scanner) scanPath(path string, files *[]FileInfo, seen map[string]bool) {
-	// Get absolute path to handle symlinks correctly
-	absPath, err := filepath.Abs(path)
+func (f found) fileInfo() FileInfo {
+	return FileInfo{
+		Path:       f.treePath,
+		Size:       f.info.Size(),
+		ModTime:    f.info.ModTime().Unix(),
+		IsDir:      false,
+		LinkTarget: f.linkTarget,
+	}
+}
+
+// visit resolves a path found while walking and checks it against the
+// visited paths and the rules of sc. It returns false when the path is
+// skipped, which has already been logged. Rules are matched against treePath.
+//
+//nolint:gocyclo // One pass over the checks a path goes through
+func (s *Scanner) visit(path, treePath string, seen *visited, sc scope) (found, bool) {
+	absPath, err := filepath.Abs(treePath)
 	if err != nil {
-		slog.Warn("failed to get absolute path", "path", path, "error", err)
-		return // Continue scanning other paths
+		slog.Warn("failed to get absolute path", "path", treePath, "error", err)
+		return found{}, false // Continue scanning other paths
 	}
 
-	// Check if we've already visited this path (symlink loop detection)
-	if seen[absPath] {
+	// Paths to scan may overlap, every path is only reported once
+	if !seen.add(absPath) {
 		slog.Debug("skipping already visited path", "path", absPath)
-		return
+		return found{}, false
 	}
-	seen[absPath] = true
 
 	// Get file info
 	info, err := os.Lstat(path) // Use Lstat to not follow symlinks
 	if err != nil {
 		if os.IsPermission(err) {
 			slog.Warn("permission denied", "path", path, "error", err)
-			return // Continue scanning other paths
+		} else {
+			slog.Error("failed to stat file", "path", path, "error", err)
 		}
-		slog.Error("failed to stat file", "path", path, "error", err)
-		return // Continue scanning other paths
+		s.unreadable(treePath, err)
+		return found{}, false // Continue scanning other paths
 	}
 
-	// Handle symlinks
-	if info.Mode()&os.ModeSymlink != 0 {
-		// Resolve symlink
-		realPath, err := filepath.EvalSymlinks(path)
-		if err != nil {
-			slog.Warn("failed to resolve symlink", "path", path, "error", err)
-			return // Skip broken symlinks
+	f := found{path: path, treePath: treePath, info: info}
+	target := "" // where a followed symlink points
+	switch {
+	case info.Mode()&os.ModeSymlink == 0:
+		if sc.depth == 0 {
+			// Read through the real path, like below followed symlinks, so
+			// loops back to it are caught
+			if realPath, err := filepath.EvalSymlinks(path); err == nil {
+				f.path = realPath
+			}
 		}
-
-		// Get info about the target
-		info, err = os.Stat(realPath)
-		if err != nil {
-			slog.Warn("failed to stat symlink target", "path", realPath, "error", err)
-			return
+	case sc.depth > 0 && s.symlinks == SymlinksSkip:
+		slog.Debug("skipping symlink", "path", treePath)
+		return found{}, false
+	case sc.depth > 0 && s.symlinks == SymlinksPreserve:
+		if f.linkTarget, err = os.Readlink(path); err != nil {
+			slog.Warn("failed to read symlink", "path", path, "error", err)
+			s.unreadable(treePath, err)
+			return found{}, false
 		}
-
-		// Use the real path for further processing
-		path = realPath
-		// Update absPath for symlink loop detection
-		if newAbsPath, err := filepath.Abs(realPath); err == nil {
-			absPath = newAbsPath
-			if seen[absPath] {
-				slog.Debug("skipping already visited symlink target", "path", absPath)
-				return
-			}
-			seen[absPath] = true
+	default:
+		if f.path, f.info, err = followSymlink(path); err != nil {
+			slog.Warn("failed to follow symlink", "path", path, "error", err)
+			return found{}, false // Skip broken symlinks
 		}
+		target = f.path
 	}
 
 	// Check if path should be ignored
-	if s.shouldIgnore(path) {
-		slog.Debug("ignoring path", "path", path)
-		return
-	}
-
-	// If it's a directory, walk it
-	if info.IsDir() {
-		entries, err := os.ReadDir(path)
-		if err != nil {
-			if os.IsPermission(err) {
-				slog.Warn("permission denied reading directory", "path", path, "error", err)
-				return
-			}
-			slog.Error("failed to read directory", "path", path, "error", err)
-			return
-		}
+	if s.shouldIgnore(sc, treePath, target, f.info.IsDir()) {
+		slog.Debug("ignoring path", "path", treePath)
+		return found{}, false
+	}
 
-		for _, entry := range entries {
-			entryPath := filepath.Join(path, entry.Name())
-			s.scanPath(entryPath, files, seen)
+	if f.info.IsDir() {
+		if sc.maxDepth > 0 && sc.depth >= sc.maxDepth {
+			slog.Debug("skipping directory below max depth", "path", treePath)
+			return found{}, false
+		}
+		if slices.Contains(sc.dirs, f.path) {
+			slog.Debug("skipping symlink loop", "path", treePath, "target", f.path)
+			return found{}, false
 		}
-	} else {
-		// It's a file, add it to the list
-		*files = append(*files, FileInfo{
-			Path:    path,
-			Size:    info.Size(),
-			ModTime: info.ModTime().Unix(),
-			IsDir:   false,
-		})
+	} else if sc.include != nil && sc.depth > 0 {
+		// A path to scan that is a file is backed up whatever the includes
+		if included, _ := sc.include.Match(treePath, false); !included {
+			slog.Debug("not included", "path", treePath)
+			return found{}, false
+		}
+	}
+
+	if reason := s.unsupported(f, sc); reason != "" {
+		slog.Debug("skipping path", "path", treePath, "reason", reason)
+		s.skip(treePath, reason)
+		return found{}, false
+	}
+	return f, true
+}
+
+func (s *Scanner) skip(treePath, reason string) {
+	if s.onSkip != nil {
+		s.onSkip(Skipped{Path: treePath, Reason: reason})
 	}
 }
 
-func (s *Scanner) shouldIgnore(path string) bool {
-	for _, pattern := range s.ignorePatterns {
-		if s.matchPattern(path, pattern) {
-			return true
+// unreadable reports a path that failed to be read, unless it is simply gone,
+// so what was backed up from it isn't taken for deleted
+func (s *Scanner) unreadable(treePath string, err error) {
+	if !errors.Is(err, fs.ErrNotExist) {
+		s.skip(treePath, SkipUnreadable)
+	}
+}
+
+// unsupported returns why a path that passed the rules can't be backed up
+// anyway, or "". Copying a FIFO or a device would block or read forever.
+func (s *Scanner) unsupported(f found, sc scope) string {
+	if sc.checkDev && sc.depth > 0 {
+		if dev, ok := device(f.info); ok && dev != sc.device {
+			return SkipOtherFileSystem
 		}
 	}
-	return false
+
+	mode := f.info.Mode()
+	switch {
+	case f.linkTarget != "" || mode.IsDir() || mode.IsRegular():
+		return ""
+	case mode&os.ModeSocket != 0:
+		return SkipSocket
+	case mode&os.ModeNamedPipe != 0:
+		return SkipFIFO
+	case mode&os.ModeDevice != 0:
+		return SkipDevice
+	default:
+		return SkipIrregular
+	}
 }
 
-// Supports patterns like *.tmp, .cache/*, **/node_modules/**
-//
-//nolint:gocyclo // Pattern matching requires multiple checks
-func (s *Scanner) matchPattern(path, pattern string) bool {
-	// Normalize path separators
-	path = filepath.ToSlash(path)
-	pattern = filepath.ToSlash(pattern)
-
-	// Handle ** patterns (match any number of directories)
-	if strings.Contains(pattern, "**") {
-		// Convert ** to a regex-like pattern
-		parts := strings.Split(pattern, "**")
-		if len(parts) == 2 {
-			prefix := parts[0]
-			suffix := parts[1]
-
-			// Remove leading/trailing slashes for matching
-			prefix = strings.TrimPrefix(prefix, "/")
-			suffix = strings.TrimSuffix(suffix, "/")
-			suffix = strings.TrimPrefix(suffix, "/")
-
-			if prefix != "" && !strings.Contains(path, prefix) {
-				return false
-			}
-			if suffix != "" && !strings.Contains(path, suffix) {
-				return false
-			}
-			return true
+// followSymlink returns the real path of a symlink and its target's info
+func followSymlink(path string) (string, os.FileInfo, error) {
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve symlink: %w", err)
+	}
+	info, err := os.Stat(realPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to stat symlink target: %w", err)
+	}
+	return realPath, info, nil
+}
+
+// readDir lists a directory visit returned, in name order, along with the
+// scope of its entries
+func (s *Scanner) readDir(path, treePath string, sc scope) ([]os.DirEntry, scope, bool) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if os.IsPermission(err) {
+			slog.Warn("permission denied reading directory", "path", path, "error", err)
+		} else {
+			slog.Error("failed to read directory", "path", path, "error", err)
+		}
+		s.unreadable(treePath, err)
+		return nil, scope{}, false
+	}
+	if sc.depth > 0 {
+		if reason := s.marked(path, entries); reason != "" {
+			slog.Info("skipping directory", "path", treePath, "reason", reason)
+			return nil, scope{}, false
 		}
 	}
 
-	// Try standard glob matching
-	matched, err := filepath.Match(pattern, filepath.Base(path))
-	if err == nil && matched {
-		return true
+	// The directory's ignore file applies to everything below it
+	entryScope := sc
+	entryScope.depth++
+	entryScope.dirs = append(sc.dirs[:len(sc.dirs):len(sc.dirs)], path)
+	if patterns, err := ignore.ReadFile(path); err != nil {
+		slog.Warn("failed to read ignore file", "dir", path, "error", err)
+	} else if patterns != nil {
+		entryScope.ignore = sc.ignore.With(ignore.NewAt(treePath, patterns))
 	}
+	return entries, entryScope, true
+}
 
-	// Try matching against the full path
-	matched, err = filepath.Match(pattern, path)
-	if err == nil && matched {
-		return true
+// marked returns why a directory is excluded by a file in it, or ""
+func (s *Scanner) marked(path string, entries []os.DirEntry) string {
+	if !s.excludeCaches && len(s.markers) == 0 {
+		return ""
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if s.markers[name] {
+			return "contains " + name
+		}
+		if s.excludeCaches && name == CacheDirTag && isCacheDirTag(filepath.Join(path, name)) {
+			return "contains a cache directory tag"
+		}
 	}
+	return ""
+}
 
-	// Check if any directory component matches the pattern
-	if strings.Contains(pattern, "/") {
-		pathParts := strings.Split(path, "/")
-		patternParts := strings.Split(pattern, "/")
-
-		// Try to find the pattern in the path
-		for i := 0; i <= len(pathParts)-len(patternParts); i++ {
-			matches := true
-			for j, patternPart := range patternParts {
-				matched, err := filepath.Match(patternPart, pathParts[i+j])
-				if err != nil || !matched {
-					matches = false
-					break
-				}
-			}
-			if matches {
-				return true
-			}
+// isCacheDirTag reports whether a CACHEDIR.TAG file starts with the signature
+// the spec requires, so a stray file of that name doesn't hide a directory
+func isCacheDirTag(path string) bool {
+	f, err := os.Open(path) //nolint:gosec // path is from filesystem scan
+	if err != nil {
+		slog.Warn("failed to open cache directory tag", "path", path, "error", err)
+		return false
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("failed to close cache directory tag", "path", path, "error", err)
 		}
+	}()
+
+	signature := make([]byte, len(CacheDirSignature))
+	if _, err := io.ReadFull(f, signature); err != nil {
+		return false
 	}
+	return string(signature) == CacheDirSignature
+}
 
+// shouldIgnore checks a path as found in the tree against the ignore rules in
+// effect. A followed symlink's target is checked against the config's
+// patterns as well, target is empty for anything else.
+func (s *Scanner) shouldIgnore(sc scope, treePath, target string, isDir bool) bool {
+	if sc.ignore.Ignored(treePath, isDir) {
+		return true
+	}
+	if target != "" && target != treePath {
+		ignored, _ := s.ignore.Match(target, isDir)
+		return ignored
+	}
 	return false
 }
 
-func (s *Scanner) ScanDryRun(paths []string) ([]FileInfo, error) {
-	files, err := s.Scan(paths)
+func (s *Scanner) ScanDryRun(ctx context.Context, paths []string) ([]FileInfo, error) {
+	files, err := s.Scan(ctx, paths)
 	if err != nil {
 		return nil, fmt.Errorf("scan failed: %w", err)
 	}
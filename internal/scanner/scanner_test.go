@@ -1,6 +1,9 @@
 package scanner
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -30,7 +33,7 @@ func TestScanDirectory(t *testing.T) {
 
 	// Scan the directory
 	scanner := New([]string{})
-	files, err := scanner.Scan([]string{tmpDir})
+	files, err := scanner.Scan(context.Background(), []string{tmpDir})
 	if err != nil {
 		t.Fatalf("scan failed: %v", err)
 	}
@@ -41,6 +44,44 @@ func TestScanDirectory(t *testing.T) {
 	}
 }
 
+func TestScanStopsWhenCanceled(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := New([]string{}).Scan(ctx, []string{tmpDir}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled scan, got %v", err)
+	}
+}
+
+func TestWalkStopsWithCallbackError(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errStop := errors.New("stop")
+	var visited []string
+	err := New([]string{}).Walk(context.Background(), []string{tmpDir}, func(file FileInfo) error {
+		visited = append(visited, filepath.Base(file.Path))
+		if len(visited) == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("expected callback error, got %v", err)
+	}
+	if len(visited) != 2 {
+		t.Errorf("expected walk to stop after 2 files, visited %v", visited)
+	}
+}
+
 func TestIgnorePatterns(t *testing.T) {
 	// Create temporary test directory structure
 	tmpDir := t.TempDir()
@@ -67,7 +108,7 @@ func TestIgnorePatterns(t *testing.T) {
 
 	// Scan with ignore patterns
 	scanner := New([]string{"*.tmp", ".cache/*"})
-	files, err := scanner.Scan([]string{tmpDir})
+	files, err := scanner.Scan(context.Background(), []string{tmpDir})
 	if err != nil {
 		t.Fatalf("scan failed: %v", err)
 	}
@@ -119,7 +160,7 @@ func TestNestedDirectories(t *testing.T) {
 
 	// Scan the directory
 	scanner := New([]string{})
-	files, err := scanner.Scan([]string{tmpDir})
+	files, err := scanner.Scan(context.Background(), []string{tmpDir})
 	if err != nil {
 		t.Fatalf("scan failed: %v", err)
 	}
@@ -151,7 +192,7 @@ func TestPermissionErrorHandling(t *testing.T) {
 
 	// Scan should not fail, just log and continue
 	scanner := New([]string{})
-	files, err := scanner.Scan([]string{tmpDir})
+	files, err := scanner.Scan(context.Background(), []string{tmpDir})
 	if err != nil {
 		t.Fatalf("scan should not fail on permission errors: %v", err)
 	}
@@ -181,7 +222,7 @@ func TestSymlinkHandling(t *testing.T) {
 
 	// Scan the directory
 	scanner := New([]string{})
-	files, err := scanner.Scan([]string{tmpDir})
+	files, err := scanner.Scan(context.Background(), []string{tmpDir})
 	if err != nil {
 		t.Fatalf("scan failed: %v", err)
 	}
@@ -194,6 +235,74 @@ func TestSymlinkHandling(t *testing.T) {
 	}
 }
 
+func TestSymlinkPolicies(t *testing.T) {
+	tmpDir := t.TempDir()
+	docs := filepath.Join(tmpDir, "docs")
+	data := filepath.Join(tmpDir, "data")
+	for _, dir := range []string{docs, data} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{filepath.Join(docs, "real.txt"), filepath.Join(data, "a.txt")} {
+		if err := os.WriteFile(path, []byte("test content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"link.txt": "real.txt",
+		"data":     data,
+		"broken":   "nowhere",
+		"loop":     ".",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(docs, name)); err != nil {
+			t.Skip("symlink creation not supported on this platform")
+		}
+	}
+
+	tests := []struct {
+		policy SymlinkPolicy
+		want   map[string]string // found paths below docs, with their link targets
+	}{
+		// Followed links keep their path in docs
+		{SymlinksFollow, map[string]string{"real.txt": "", "link.txt": "", "data/a.txt": ""}},
+		{SymlinksPreserve, map[string]string{"real.txt": "", "link.txt": "real.txt", "data": data, "broken": "nowhere", "loop": "."}},
+		{SymlinksSkip, map[string]string{"real.txt": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			for _, walkers := range []int{1, 4} {
+				s := New([]string{})
+				s.SetSymlinks(tt.policy)
+				s.SetWalkers(walkers)
+				files, err := s.Scan(context.Background(), []string{docs})
+				if err != nil {
+					t.Fatalf("scan failed: %v", err)
+				}
+
+				found := make(map[string]string)
+				for _, file := range files {
+					relPath, _ := filepath.Rel(docs, file.Path)
+					found[filepath.ToSlash(relPath)] = file.LinkTarget
+				}
+				if fmt.Sprint(found) != fmt.Sprint(tt.want) {
+					t.Errorf("walkers=%d: expected %v, got %v", walkers, tt.want, found)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSymlinkPolicy(t *testing.T) {
+	if p, err := ParseSymlinkPolicy(""); err != nil || p != SymlinksFollow {
+		t.Errorf("expected follow by default, got %q, %v", p, err)
+	}
+	if _, err := ParseSymlinkPolicy("copy"); err == nil {
+		t.Error("expected unknown policy to be rejected")
+	}
+}
+
 func TestDoubleStarPattern(t *testing.T) {
 	tmpDir := t.TempDir()
 
@@ -219,7 +328,7 @@ func TestDoubleStarPattern(t *testing.T) {
 
 	// Scan with ** pattern
 	scanner := New([]string{"**/node_modules/**"})
-	files, err := scanner.Scan([]string{tmpDir})
+	files, err := scanner.Scan(context.Background(), []string{tmpDir})
 	if err != nil {
 		t.Fatalf("scan failed: %v", err)
 	}
@@ -247,26 +356,169 @@ func TestDoubleStarPattern(t *testing.T) {
 	}
 }
 
-func TestMatchPattern(t *testing.T) {
-	scanner := New([]string{})
+func TestIgnoreFiles(t *testing.T) {
+	tmpDir := t.TempDir()
 
-	tests := []struct {
-		path    string
-		pattern string
-		want    bool
-	}{
-		{"/path/to/file.tmp", "*.tmp", true},
-		{"/path/to/file.txt", "*.tmp", false},
-		{"/path/.cache/data", ".cache/*", true},
-		{"/path/cache/data", ".cache/*", false},
-		{"/path/to/node_modules/lib.js", "**/node_modules/**", true},
-		{"/path/to/lib.js", "**/node_modules/**", false},
+	testFiles := map[string]bool{
+		"keep.txt":                     false,
+		"build/out.bin":                true,  // build/ in the root ignore file
+		"docs/build":                   false, // a file, build/ only matches directories
+		"docs/draft.md":                true,  // *.md
+		"docs/README.md":               false, // re-included with !
+		"my_node_modules_backup/a.js":  false, // only whole names match
+		"src/node_modules/lib.js":      true,  // **/node_modules/** from the config
+		"src/generated/a.go":           true,  // generated/ in src's ignore file
+		"other/generated/a.go":         false, // src's ignore file doesn't reach here
+		"src/vendor/keep.md":           false, // !keep.md in vendor's ignore file
+		"src/vendor/nested/drop.md":    true,
+		"src/.m_backuperignore":        false,
+		"src/vendor/.m_backuperignore": false,
+		".m_backuperignore":            false,
+		"anchored/root-only.txt":       true,  // /anchored/root-only.txt
+		"docs/anchored/root-only.txt":  false, // not at the root
+		"a/b/c/deep/x/y/z.log":         true,  // a/**/deep/**/*.log
+		"a/deep/z.log":                 true,
+		"a/deep/z.txt":                 false,
+	}
+	ignoreFiles := map[string]string{
+		".m_backuperignore":            "# comment\nbuild/\n*.md\n!README.md\n/anchored/root-only.txt\na/**/deep/**/*.log\n",
+		"src/.m_backuperignore":        "generated/\n",
+		"src/vendor/.m_backuperignore": "!keep.md\n",
 	}
 
-	for _, tt := range tests {
-		got := scanner.matchPattern(tt.path, tt.pattern)
-		if got != tt.want {
-			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.path, tt.pattern, got, tt.want)
+	for f := range testFiles {
+		path := filepath.Join(tmpDir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		content := ignoreFiles[f]
+		if content == "" {
+			content = "test content"
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+	}
+
+	scanner := New([]string{"**/node_modules/**"})
+	files, err := scanner.Scan(context.Background(), []string{tmpDir})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	found := make(map[string]bool)
+	for _, file := range files {
+		relPath, _ := filepath.Rel(tmpDir, file.Path)
+		found[filepath.ToSlash(relPath)] = true
+	}
+	for f, shouldIgnore := range testFiles {
+		if found[f] == shouldIgnore {
+			t.Errorf("%s: expected ignored=%v", f, shouldIgnore)
+		}
+	}
+}
+
+func TestMarkedDirectoriesAreSkipped(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	testFiles := map[string]bool{
+		"keep.txt":               false,
+		".nobackup":              false, // the path to scan is scanned anyway
+		"cache/CACHEDIR.TAG":     true,
+		"cache/data.bin":         true,
+		"fake/CACHEDIR.TAG":      false, // without the signature
+		"fake/data.bin":          false,
+		"project/.nobackup":      true,
+		"project/src/main.go":    true,
+		"project2/.keep":         false, // not a marker
+		"a/b/skip/.nobackup":     true,
+		"a/b/skip/deep/file.txt": true,
+		"a/b/file.txt":           false,
+	}
+	content := map[string]string{
+		"cache/CACHEDIR.TAG": CacheDirSignature + "\n# This file is a cache directory tag.\n",
+		"fake/CACHEDIR.TAG":  "not a tag",
+	}
+	for f := range testFiles {
+		path := filepath.Join(tmpDir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		data := content[f]
+		if data == "" {
+			data = "test content"
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+	}
+
+	s := New([]string{})
+	if files, err := s.Scan(context.Background(), []string{tmpDir}); err != nil || len(files) != len(testFiles) {
+		t.Fatalf("expected every file without markers set, got %d (%v)", len(files), err)
+	}
+
+	s.SetExcludeCaches(true)
+	s.SetExcludeMarkers([]string{".nobackup"})
+	files, err := s.Scan(context.Background(), []string{tmpDir})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	found := make(map[string]bool)
+	for _, file := range files {
+		relPath, _ := filepath.Rel(tmpDir, file.Path)
+		found[filepath.ToSlash(relPath)] = true
+	}
+	for f, shouldSkip := range testFiles {
+		if found[f] == shouldSkip {
+			t.Errorf("%s: expected skipped=%v", f, shouldSkip)
+		}
+	}
+}
+
+func TestRulesApplyBelowTheirPath(t *testing.T) {
+	tmpDir := t.TempDir()
+	docs := filepath.Join(tmpDir, "docs")
+	src := filepath.Join(tmpDir, "src")
+
+	testFiles := map[string]bool{
+		"docs/report.pdf":          false,
+		"docs/notes.txt":           true, // not included
+		"docs/letters/letter.docx": false,
+		"docs/letters/old/a.pdf":   true,  // below max depth
+		"docs/build/manual.pdf":    false, // build/ is only excluded under src
+		"src/main.go":              false,
+		"src/build/main":           true,
+		"src/cmd/build/tool":       true,
+		"src/notes.txt":            false, // includes only apply under docs
+		"src/vendor/lib/deep/x.go": false, // no max depth
+	}
+	for f := range testFiles {
+		path := filepath.Join(tmpDir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("test content"), 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+	}
+
+	scanner := New([]string{})
+	scanner.SetRules(docs, Rules{Include: []string{"*.pdf", "*.docx"}, MaxDepth: 2})
+	scanner.SetRules(src+string(filepath.Separator), Rules{Exclude: []string{"build/"}})
+	files, err := scanner.Scan(context.Background(), []string{docs, src})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	found := make(map[string]bool)
+	for _, file := range files {
+		relPath, _ := filepath.Rel(tmpDir, file.Path)
+		found[filepath.ToSlash(relPath)] = true
+	}
+	for f, shouldSkip := range testFiles {
+		if found[f] == shouldSkip {
+			t.Errorf("%s: expected skipped=%v", f, shouldSkip)
 		}
 	}
 }
@@ -276,3 +528,162 @@ func containsPath(path, substr string) bool {
 		filepath.Base(path) == substr ||
 		filepath.Dir(path) != path && containsPath(filepath.Dir(path), substr)
 }
+
+// makeTree creates dirs directories of files files each, nested depth deep
+func makeTree(tb testing.TB, root string, dirs, files, depth int) int {
+	tb.Helper()
+	count := 0
+	for d := range dirs {
+		dir := root
+		for level := range depth {
+			dir = filepath.Join(dir, fmt.Sprintf("d%02d-%d", d, level))
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		for f := range files {
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%03d.txt", f)), []byte("content"), 0644); err != nil {
+				tb.Fatal(err)
+			}
+			count++
+		}
+	}
+	return count
+}
+
+func walkPaths(t *testing.T, s *Scanner, paths []string) []string {
+	t.Helper()
+	var found []string
+	err := s.Walk(context.Background(), paths, func(file FileInfo) error {
+		found = append(found, file.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	return found
+}
+
+func TestParallelWalkFindsSameFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	count := makeTree(t, tmpDir, 20, 10, 3)
+	single := filepath.Join(t.TempDir(), "single.txt")
+	if err := os.WriteFile(single, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{tmpDir, single}
+
+	sequential := walkPaths(t, New([]string{}), paths)
+	if len(sequential) != count+1 {
+		t.Fatalf("expected %d files, got %d", count+1, len(sequential))
+	}
+
+	parallel := New([]string{})
+	parallel.SetWalkers(8)
+	unordered := walkPaths(t, parallel, paths)
+	if len(unordered) != len(sequential) {
+		t.Fatalf("expected %d files from parallel walk, got %d", len(sequential), len(unordered))
+	}
+	want := make(map[string]bool)
+	for _, path := range sequential {
+		want[path] = true
+	}
+	for _, path := range unordered {
+		if !want[path] {
+			t.Errorf("unexpected file %s", path)
+		}
+	}
+
+	// Ordered, it matches the single walker exactly
+	parallel.SetOrdered(true)
+	ordered := walkPaths(t, parallel, paths)
+	for i := range sequential {
+		if ordered[i] != sequential[i] {
+			t.Fatalf("expected %s at %d, got %s", sequential[i], i, ordered[i])
+		}
+	}
+}
+
+func TestParallelWalkHandlesSymlinkLoops(t *testing.T) {
+	tmpDir := t.TempDir()
+	sub := filepath.Join(tmpDir, "sub")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"loop-a", "loop-b", "loop-c"} {
+		if err := os.Symlink(tmpDir, filepath.Join(sub, name)); err != nil {
+			t.Skip("symlink creation not supported on this platform")
+		}
+	}
+
+	s := New([]string{})
+	s.SetWalkers(4)
+	if found := walkPaths(t, s, []string{tmpDir}); len(found) != 1 {
+		t.Errorf("expected the file once, got %v", found)
+	}
+}
+
+func TestParallelWalkStops(t *testing.T) {
+	tmpDir := t.TempDir()
+	makeTree(t, tmpDir, 20, 10, 2)
+
+	for _, ordered := range []bool{false, true} {
+		s := New([]string{})
+		s.SetWalkers(4)
+		s.SetOrdered(ordered)
+
+		errStop := errors.New("stop")
+		calls := 0
+		err := s.Walk(context.Background(), []string{tmpDir}, func(FileInfo) error {
+			calls++
+			if calls == 5 {
+				return errStop
+			}
+			return nil
+		})
+		if !errors.Is(err, errStop) || calls != 5 {
+			t.Errorf("ordered=%v: expected walk to stop after 5 files, got %d calls and %v", ordered, calls, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := s.Walk(ctx, []string{tmpDir}, func(FileInfo) error { return nil }); !errors.Is(err, context.Canceled) {
+			t.Errorf("ordered=%v: expected canceled walk, got %v", ordered, err)
+		}
+	}
+}
+
+func BenchmarkWalk(b *testing.B) {
+	tmpDir := b.TempDir()
+	count := makeTree(b, tmpDir, 200, 20, 4)
+
+	for _, bench := range []struct {
+		name    string
+		walkers int
+		ordered bool
+	}{
+		{"sequential", 1, false},
+		{"parallel-4", 4, false},
+		{"parallel-16", 16, false},
+		{"parallel-16-ordered", 16, true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			s := New([]string{})
+			s.SetWalkers(bench.walkers)
+			s.SetOrdered(bench.ordered)
+			for range b.N {
+				found := 0
+				err := s.Walk(context.Background(), []string{tmpDir}, func(FileInfo) error {
+					found++
+					return nil
+				})
+				if err != nil || found != count {
+					b.Fatalf("expected %d files, got %d (%v)", count, found, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+//go:build unix
+
+package scanner
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// collectSkipped sets a skip handler on s and returns what it was told
+func collectSkipped(s *Scanner) func() map[string]string {
+	var mu sync.Mutex
+	skipped := make(map[string]string)
+	s.SetSkipHandler(func(skip Skipped) {
+		mu.Lock()
+		defer mu.Unlock()
+		skipped[skip.Path] = skip.Reason
+	})
+	return func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return skipped
+	}
+}
+
+func TestSpecialFilesAreSkipped(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("test content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fifo := filepath.Join(tmpDir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+		t.Skipf("can't create a FIFO: %v", err)
+	}
+	socket := filepath.Join(tmpDir, "sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("can't create a socket: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	ignored := filepath.Join(tmpDir, "ignored.fifo")
+	if err := syscall.Mkfifo(ignored, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, walkers := range []int{1, 4} {
+		s := New([]string{"*.fifo"})
+		s.SetWalkers(walkers)
+		skipped := collectSkipped(s)
+		files, err := s.Scan(context.Background(), []string{tmpDir})
+		if err != nil {
+			t.Fatalf("scan failed: %v", err)
+		}
+
+		if len(files) != 1 || filepath.Base(files[0].Path) != "file.txt" {
+			t.Errorf("walkers=%d: expected only the regular file, got %v", walkers, files)
+		}
+		// Ignored paths aren't reported
+		want := map[string]string{fifo: SkipFIFO, socket: SkipSocket}
+		got := skipped()
+		if len(got) != len(want) {
+			t.Errorf("walkers=%d: expected %v to be reported, got %v", walkers, want, got)
+		}
+		for path, reason := range want {
+			if got[path] != reason {
+				t.Errorf("walkers=%d: expected %s to be skipped as %s, got %q", walkers, path, reason, got[path])
+			}
+		}
+	}
+}
+
+func TestOneFileSystemStopsAtMountPoints(t *testing.T) {
+	// /proc is a filesystem of its own where it exists
+	rootInfo, err := os.Stat("/")
+	if err != nil {
+		t.Skip("can't stat /")
+	}
+	procInfo, err := os.Stat("/proc")
+	if err != nil {
+		t.Skip("no /proc on this platform")
+	}
+	rootDev, _ := device(rootInfo)
+	procDev, _ := device(procInfo)
+	if rootDev == procDev {
+		t.Skip("/proc is not a separate filesystem here")
+	}
+
+	s := New([]string{})
+	s.SetOneFileSystem(true)
+	s.SetRules("/", Rules{MaxDepth: 2})
+	skipped := collectSkipped(s)
+	err = s.Walk(context.Background(), []string{"/"}, func(file FileInfo) error {
+		if strings.HasPrefix(file.Path, "/proc/") {
+			t.Errorf("found %s on another filesystem", file.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if reason := skipped()["/proc"]; reason != SkipOtherFileSystem {
+		t.Errorf("expected /proc to be skipped as another filesystem, got %q", reason)
+	}
+}
@@ -0,0 +1,256 @@
+package scanner
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+)
+
+// visited is the set of absolute paths a walk has been to, shared by its
+// directory readers
+type visited struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+func newVisited() *visited {
+	return &visited{paths: make(map[string]bool)}
+}
+
+// add records path and reports whether it is new
+func (v *visited) add(path string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.paths[path] {
+		return false
+	}
+	v.paths[path] = true
+	return true
+}
+
+// dirTask is a directory waiting to be read
+type dirTask struct {
+	path     string
+	treePath string
+	sc       scope
+	result   *dirResult // where to put the entries of an ordered walk
+}
+
+// dirResult holds what reading one directory found, in name order, once
+// done is closed
+type dirResult struct {
+	entries []walkEntry
+	done    chan struct{}
+}
+
+// walkEntry is either a file or a subdirectory of an ordered walk
+type walkEntry struct {
+	file FileInfo
+	sub  *dirResult
+}
+
+// dirQueue hands out directories to the readers until every directory put in
+// it has been read, including the ones found on the way
+type dirQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	tasks   []dirTask
+	pending int // queued or being read
+}
+
+func newDirQueue() *dirQueue {
+	q := &dirQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *dirQueue) push(task dirTask) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tasks = append(q.tasks, task)
+	q.pending++
+	q.cond.Signal()
+}
+
+// pop waits for a directory to read. It returns false once all are read.
+func (q *dirQueue) pop() (dirTask, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.tasks) == 0 && q.pending > 0 {
+		q.cond.Wait()
+	}
+	if len(q.tasks) == 0 {
+		return dirTask{}, false
+	}
+	task := q.tasks[0]
+	q.tasks[0] = dirTask{}
+	q.tasks = q.tasks[1:]
+	return task, true
+}
+
+// done marks a popped directory as read
+func (q *dirQueue) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending--
+	if q.pending == 0 {
+		q.cond.Broadcast()
+	}
+}
+
+// walker is a walk with several directory readers
+type walker struct {
+	s       *Scanner
+	ctx     context.Context
+	seen    *visited
+	queue   *dirQueue
+	files   chan FileInfo // found by an unordered walk
+	ordered bool
+}
+
+// walkParallel is Walk with s.walkers directory readers. The paths to scan
+// are checked up front, then every directory found goes through the queue.
+// An unordered walk hands files over as the readers find them, an ordered
+// one collects each directory's entries and goes through them depth-first.
+func (s *Scanner) walkParallel(ctx context.Context, paths []string, fn func(FileInfo) error) error {
+	walkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &walker{
+		s:       s,
+		ctx:     walkCtx,
+		seen:    newVisited(),
+		queue:   newDirQueue(),
+		files:   make(chan FileInfo, s.walkers),
+		ordered: s.ordered,
+	}
+
+	// The paths to scan are the top level, an unordered walk only keeps the
+	// files among them
+	var top []walkEntry
+	for _, path := range paths {
+		sc := s.rootScope(path)
+		f, ok := s.visit(path, path, w.seen, sc)
+		if !ok {
+			continue
+		}
+		if !f.info.IsDir() {
+			top = append(top, walkEntry{file: f.fileInfo()})
+		} else if sub := w.enqueue(f, sc); sub != nil {
+			top = append(top, walkEntry{sub: sub})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for range s.walkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				task, ok := w.queue.pop()
+				if !ok {
+					return
+				}
+				w.read(task)
+				w.queue.done()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(w.files)
+	}()
+
+	err := w.emit(top, fn)
+	if err == nil && !w.ordered {
+		for file := range w.files {
+			if err = fn(file); err != nil {
+				break
+			}
+		}
+	}
+
+	// Stop the readers and wait for them before returning
+	cancel()
+	for range w.files { //nolint:revive // draining until the readers are done
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// enqueue queues a directory visit returned, with sc the scope it was
+// visited in. For an ordered walk it returns where its entries will be.
+func (w *walker) enqueue(f found, sc scope) *dirResult {
+	task := dirTask{path: f.path, treePath: f.treePath, sc: sc}
+	if w.ordered {
+		task.result = &dirResult{done: make(chan struct{})}
+	}
+	w.queue.push(task)
+	return task.result
+}
+
+// read reads one directory, queues its subdirectories and hands over or
+// collects its files
+func (w *walker) read(task dirTask) {
+	var entries []walkEntry
+	defer func() {
+		if task.result != nil {
+			task.result.entries = entries
+			close(task.result.done)
+		}
+	}()
+	if w.ctx.Err() != nil {
+		return
+	}
+
+	dirEntries, entryScope, ok := w.s.readDir(task.path, task.treePath, task.sc)
+	if !ok {
+		return
+	}
+	for _, entry := range dirEntries {
+		if w.ctx.Err() != nil {
+			return
+		}
+		name := entry.Name()
+		f, ok := w.s.visit(filepath.Join(task.path, name), filepath.Join(task.treePath, name), w.seen, entryScope)
+		if !ok {
+			continue
+		}
+		if f.info.IsDir() {
+			if sub := w.enqueue(f, entryScope); sub != nil {
+				entries = append(entries, walkEntry{sub: sub})
+			}
+			continue
+		}
+		if w.ordered {
+			entries = append(entries, walkEntry{file: f.fileInfo()})
+			continue
+		}
+		select {
+		case w.files <- f.fileInfo():
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// emit calls fn for entries depth-first, waiting for each directory to be
+// read. For an unordered walk these are just the files among the paths to scan.
+func (w *walker) emit(entries []walkEntry, fn func(FileInfo) error) error {
+	for _, entry := range entries {
+		if entry.sub == nil {
+			if err := fn(entry.file); err != nil {
+				return err
+			}
+			continue
+		}
+		<-entry.sub.done
+		sub := entry.sub.entries
+		entry.sub.entries = nil // done with it, let it go
+		if err := w.emit(sub, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
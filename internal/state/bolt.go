@@ -0,0 +1,300 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	filesBucket = []byte("files")
+	metaBucket  = []byte("meta")
+	lastRunKey  = []byte("last_run")
+)
+
+// flushEvery bounds how many puts and deletes are buffered before they are
+// committed, so memory use stays flat however rarely Save is called
+const flushEvery = 10000
+
+// BoltStore keeps state in a bbolt database, so large trees don't have to be
+// loaded into memory and rewritten as a whole. Puts and deletes are buffered
+// and committed in batches of flushEvery and by Save. Every entry describes a
+// file already copied, so committing it early is safe.
+type BoltStore struct {
+	db      *bolt.DB
+	pending map[string]*FileState // nil marks a deletion
+	lastRun []byte                // marshaled time set by SetLastRun, written by the next commit
+	walks   int                   // walks in progress, a commit under one could deadlock bbolt's remap
+	mu      sync.Mutex
+}
+
+// OpenBolt opens or creates the database at path
+func OpenBolt(path string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	db, err := openBoltDB(path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{filesBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize state database: %w", err)
+	}
+
+	slog.Info("opened state database", "path", path)
+	return &BoltStore{db: db, pending: make(map[string]*FileState)}, nil
+}
+
+// OpenBoltReadOnly opens an existing database for commands that only read it.
+// Readers share the lock, so only a run writing to the database blocks them.
+func OpenBoltReadOnly(path string) (*BoltStore, error) {
+	db, err := openBoltDB(path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{filesBucket, metaBucket} {
+			if tx.Bucket(name) == nil {
+				return fmt.Errorf("bucket %q not found", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("not a state database: %w", err)
+	}
+
+	slog.Info("opened state database read-only", "path", path)
+	return &BoltStore{db: db, pending: make(map[string]*FileState)}, nil
+}
+
+func openBoltDB(path string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, fmt.Errorf("state database %s is in use by another run", path)
+		}
+		return nil, fmt.Errorf("failed to open state database: %w", err)
+	}
+	return db, nil
+}
+
+func (s *BoltStore) Get(path string) (FileState, bool, error) {
+	s.mu.Lock()
+	fileState, buffered := s.pending[path]
+	s.mu.Unlock()
+	if buffered {
+		if fileState == nil {
+			return FileState{}, false, nil
+		}
+		return *fileState, true, nil
+	}
+
+	var result FileState
+	var exists bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		result, exists, err = (&boltTx{tx: tx}).Get(path)
+		return err
+	})
+	return result, exists, err
+}
+
+func (s *BoltStore) Put(path string, fileState FileState) error {
+	return s.buffer(path, &fileState)
+}
+
+func (s *BoltStore) Delete(path string) error {
+	return s.buffer(path, nil)
+}
+
+// buffer records a change and commits the buffer once it is full, unless a
+// walk is reading the database
+func (s *BoltStore) buffer(path string, fileState *FileState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[path] = fileState
+	if len(s.pending) < flushEvery || s.walks > 0 {
+		return nil
+	}
+	return s.commitLocked(func(*bolt.Tx) error { return nil })
+}
+
+// Update commits buffered changes along with fn's, in one transaction
+func (s *BoltStore) Update(fn func(tx Tx) error) error {
+	return s.commit(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+// commit writes buffered changes and whatever fn writes in one transaction
+func (s *BoltStore) commit(fn func(tx *bolt.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commitLocked(fn)
+}
+
+// commitLocked is commit for callers holding s.mu
+func (s *BoltStore) commitLocked(fn func(tx *bolt.Tx) error) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := (&boltTx{tx: tx}).apply(s.pending); err != nil {
+			return err
+		}
+		if s.lastRun != nil {
+			if err := tx.Bucket(metaBucket).Put(lastRunKey, s.lastRun); err != nil {
+				return err
+			}
+		}
+		return fn(tx)
+	})
+	if err != nil {
+		return err
+	}
+	s.pending = make(map[string]*FileState)
+	s.lastRun = nil
+	return nil
+}
+
+// Walk commits buffered changes first, then reads the matching entries with
+// a cursor. Changes fn makes are buffered and don't affect the walk.
+func (s *BoltStore) Walk(prefix string, fn func(path string, fileState FileState) error) error {
+	s.mu.Lock()
+	if len(s.pending) > 0 {
+		if err := s.commitLocked(func(*bolt.Tx) error { return nil }); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	s.walks++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.walks--
+		s.mu.Unlock()
+	}()
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(filesBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var fileState FileState
+			if err := json.Unmarshal(v, &fileState); err != nil {
+				return fmt.Errorf("corrupted state entry %q: %w", k, err)
+			}
+			if err := fn(string(k), fileState); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Stats() (Stats, error) {
+	var stats Stats
+	err := s.Walk("", func(_ string, fileState FileState) error {
+		stats.Files++
+		stats.TotalSize += fileState.Size
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(metaBucket).Get(lastRunKey); v != nil {
+			return stats.LastRun.UnmarshalText(v)
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func (s *BoltStore) SetLastRun(t time.Time) error {
+	stamp, err := t.MarshalText()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRun = stamp
+	return nil
+}
+
+// Save commits buffered changes
+func (s *BoltStore) Save() error {
+	err := s.commit(func(*bolt.Tx) error { return nil })
+	if err != nil {
+		slog.Error("failed to save state database", "path", s.db.Path(), "error", err)
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	slog.Info("saved state database", "path", s.db.Path())
+	return nil
+}
+
+// Close releases the database without saving buffered changes
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltTx stores entries as JSON encoded FileState keyed by path
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) Get(path string) (FileState, bool, error) {
+	v := t.tx.Bucket(filesBucket).Get([]byte(path))
+	if v == nil {
+		return FileState{}, false, nil
+	}
+	var fileState FileState
+	if err := json.Unmarshal(v, &fileState); err != nil {
+		return FileState{}, false, fmt.Errorf("corrupted state entry %q: %w", path, err)
+	}
+	return fileState, true, nil
+}
+
+func (t *boltTx) Put(path string, fileState FileState) error {
+	v, err := json.Marshal(fileState)
+	if err != nil {
+		return err
+	}
+	return t.tx.Bucket(filesBucket).Put([]byte(path), v)
+}
+
+func (t *boltTx) Delete(path string) error {
+	return t.tx.Bucket(filesBucket).Delete([]byte(path))
+}
+
+func (t *boltTx) apply(changes map[string]*FileState) error {
+	for path, fileState := range changes {
+		var err error
+		if fileState == nil {
+			err = t.Delete(path)
+		} else {
+			err = t.Put(path, *fileState)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Each destination gets its own state, since a file backed up to one backup
+// root says nothing about another. The files live in StateDir and are named
+// after a key, see Key.
+
+// StateDir returns the directory holding one state file per destination
+func StateDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".config", "m_backuper", "state"), nil
+}
+
+// Key names the state of a destination: the profile when one is configured,
+// otherwise a hash of the backup root and device ID
+func Key(profile, backupRoot, deviceID string) (string, error) {
+	if profile != "" {
+		if strings.ContainsAny(profile, `/\`) || profile == "." || profile == ".." {
+			return "", fmt.Errorf("invalid profile name %q", profile)
+		}
+		return profile, nil
+	}
+	sum := sha256.Sum256([]byte(backupRoot + "\x00" + deviceID))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// PathFor returns the state file of key for the given backend
+func PathFor(key, backend string) (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, key+extension(backend)), nil
+}
+
+func extension(backend string) string {
+	if backend == BackendBolt {
+		return ".db"
+	}
+	return ".json"
+}
+
+// AdoptLegacy moves the single state file used before state was kept per
+// destination to path, so upgrading doesn't back everything up again. It does
+// nothing once path exists or there is no legacy state left.
+func AdoptLegacy(path string) error {
+	legacy, err := StatePath()
+	if err != nil {
+		return err
+	}
+	legacyBase := strings.TrimSuffix(legacy, ".json")
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+
+	for _, ext := range []string{".json", ".db"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			return nil
+		}
+	}
+	for _, ext := range []string{".json", ".db"} {
+		if _, err := os.Stat(legacyBase + ext); err != nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			return fmt.Errorf("failed to create state directory: %w", err)
+		}
+		if err := os.Rename(legacyBase+ext, base+ext); err != nil {
+			return fmt.Errorf("failed to move legacy state: %w", err)
+		}
+		slog.Info("moved legacy state", "from", legacyBase+ext, "to", base+ext)
+	}
+	return nil
+}
+
+// ReadPath returns the file to read the state of path from without changing
+// anything: path itself, or the legacy state while no backup has adopted it
+// yet. A legacy state of the other backend is left for AdoptLegacy.
+func ReadPath(path string) (string, error) {
+	legacy, err := StatePath()
+	if err != nil {
+		return "", err
+	}
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for _, ext := range []string{".json", ".db"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			return path, nil
+		}
+	}
+	legacyPath := strings.TrimSuffix(legacy, ".json") + filepath.Ext(path)
+	if _, err := os.Stat(legacyPath); err == nil {
+		return legacyPath, nil
+	}
+	return path, nil
+}
+
+// StateFile is a state found by List
+type StateFile struct {
+	Key     string
+	Backend string
+	Path    string
+}
+
+// List returns the state files in StateDir, sorted by key
+func List() ([]StateFile, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read state directory: %w", err)
+	}
+
+	var files []StateFile
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		var backend string
+		switch filepath.Ext(name) {
+		case ".json":
+			backend = BackendJSON
+		case ".db":
+			backend = BackendBolt
+		default:
+			continue // temp files and migrated leftovers
+		}
+		files = append(files, StateFile{
+			Key:     strings.TrimSuffix(name, filepath.Ext(name)),
+			Backend: backend,
+			Path:    filepath.Join(dir, name),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Key == files[j].Key {
+			return files[i].Backend < files[j].Backend
+		}
+		return files[i].Key < files[j].Key
+	})
+	return files, nil
+}
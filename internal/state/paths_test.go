@@ -0,0 +1,127 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	if key, err := Key("work", "/mnt/a", "laptop"); err != nil || key != "work" {
+		t.Errorf("expected profile as key, got %q (%v)", key, err)
+	}
+
+	a, _ := Key("", "/mnt/a", "laptop")
+	b, _ := Key("", "/mnt/b", "laptop")
+	c, _ := Key("", "/mnt/a", "phone")
+	if a == b || a == c {
+		t.Errorf("expected distinct keys per destination, got %s %s %s", a, b, c)
+	}
+	if again, _ := Key("", "/mnt/a", "laptop"); again != a {
+		t.Errorf("expected stable key, got %s and %s", a, again)
+	}
+
+	for _, profile := range []string{"../work", "a/b", ".."} {
+		if _, err := Key(profile, "/mnt/a", "laptop"); err == nil {
+			t.Errorf("expected error for profile %q", profile)
+		}
+	}
+}
+
+func TestAdoptLegacyMovesOldStateOnce(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	legacy, err := StatePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := New()
+	old.SetFileState("/data/a.txt", 1024)
+	if err := old.SaveTo(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := PathFor("first", BackendJSON)
+	if err := AdoptLegacy(first); err != nil {
+		t.Fatalf("AdoptLegacy failed: %v", err)
+	}
+	st, err := LoadFrom(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := st.GetFileState("/data/a.txt"); !exists {
+		t.Error("expected legacy entries in the adopted state")
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Error("expected legacy state to be moved")
+	}
+
+	// Another destination starts fresh instead of sharing the old state
+	second, _ := PathFor("second", BackendJSON)
+	if err := AdoptLegacy(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(second); !os.IsNotExist(err) {
+		t.Error("expected no state for the second destination")
+	}
+}
+
+func TestReadPathLeavesLegacyStateInPlace(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	path, _ := PathFor("work", BackendJSON)
+	if got, err := ReadPath(path); err != nil || got != path {
+		t.Errorf("expected %s without any state, got %q (%v)", path, got, err)
+	}
+
+	legacy, _ := StatePath()
+	if err := New().SaveTo(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ReadPath(path); got != legacy {
+		t.Errorf("expected legacy state to be read, got %q", got)
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		t.Errorf("expected legacy state to stay: %v", err)
+	}
+
+	// Once adopted the destination's own state is read
+	if err := AdoptLegacy(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ReadPath(path); got != path {
+		t.Errorf("expected %s after adoption, got %q", path, got)
+	}
+}
+
+func TestList(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	if files, err := List(); err != nil || len(files) != 0 {
+		t.Fatalf("expected no state files, got %v (%v)", files, err)
+	}
+
+	dir, _ := StateDir()
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"work.json", "home.db", "home.json.migrated", "work.json.tmp-1"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 state files, got %v", files)
+	}
+	if files[0].Key != "home" || files[0].Backend != BackendBolt {
+		t.Errorf("expected home bolt state first, got %+v", files[0])
+	}
+	if files[1].Key != "work" || files[1].Backend != BackendJSON {
+		t.Errorf("expected work json state second, got %+v", files[1])
+	}
+}
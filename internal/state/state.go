@@ -6,18 +6,27 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
 //nolint:govet // fieldalignment: field order optimized for JSON readability
 type FileState struct {
-	Size     int64  `json:"size"`
-	BackedUp string `json:"backed_up"` // ISO 8601 timestamp
+	Size         int64  `json:"size"`
+	ModTime      int64  `json:"mod_time,omitempty"`      // Unix timestamp of the source file
+	BackedUp     string `json:"backed_up"`               // ISO 8601 timestamp
+	Digest       string `json:"digest,omitempty"`        // "<algorithm>:<hex>" when hashed
+	MissingSince string `json:"missing_since,omitempty"` // ISO 8601, set while the source is missing
+	LinkTarget   string `json:"link_target,omitempty"`   // set when a symlink was backed up as a link
 }
 
+// State is safe for concurrent use through its methods. Files may only be
+// accessed directly while no backup is running.
 type State struct {
 	LastRun time.Time            `json:"last_run"`
 	Files   map[string]FileState `json:"files"`
+	path    string               // where Save writes, the default location when empty
+	mu      sync.RWMutex
 }
 
 func New() *State {
@@ -26,6 +35,8 @@ func New() *State {
 	}
 }
 
+// StatePath returns the single state file used before state was kept per
+// destination. See StateDir and AdoptLegacy.
 func StatePath() (string, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -44,6 +55,7 @@ func Load() (*State, error) {
 
 func LoadFrom(statePath string) (*State, error) {
 	state := New()
+	state.path = statePath
 
 	// Try to load from file
 	data, err := os.ReadFile(statePath) //nolint:gosec // State path is from trusted source
@@ -65,10 +77,14 @@ func LoadFrom(statePath string) (*State, error) {
 	return state, nil
 }
 
+// Save writes the state back to the file it was loaded from
 func (s *State) Save() error {
-	statePath, err := StatePath()
-	if err != nil {
-		return err
+	statePath := s.path
+	if statePath == "" {
+		var err error
+		if statePath, err = StatePath(); err != nil {
+			return err
+		}
 	}
 	return s.SaveTo(statePath)
 }
@@ -81,41 +97,93 @@ func (s *State) SaveTo(statePath string) error {
 		return fmt.Errorf("failed to create state directory: %w", err)
 	}
 
-	// Update last run time
-	s.LastRun = time.Now()
-
 	// Marshal state to JSON with indentation
+	s.mu.RLock()
 	data, err := json.MarshalIndent(s, "", "  ")
+	fileCount := len(s.Files)
+	s.mu.RUnlock()
 	if err != nil {
 		return fmt.Errorf("failed to marshal state: %w", err)
 	}
 
 	// Write to file
-	if err := os.WriteFile(statePath, data, 0o600); err != nil {
+	if err := writeFileAtomic(statePath, data); err != nil {
 		slog.Error("failed to write state file", "path", statePath, "error", err)
 		return fmt.Errorf("failed to write state file: %w", err)
 	}
 
-	slog.Info("saved state to file", "path", statePath, "file_count", len(s.Files))
+	slog.Info("saved state to file", "path", statePath, "file_count", fileCount)
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it over
+// path, so a crash mid-write leaves the previous state file intact
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		_ = tmp.Close() // may already be closed
+		if err := os.Remove(tmp.Name()); err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to remove temp state file", "path", tmp.Name(), "error", err)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	committed = true
 	return nil
 }
 
 func (s *State) GetFileState(path string) (FileState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	state, exists := s.Files[path]
 	return state, exists
 }
 
 func (s *State) SetFileState(path string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Files[path] = FileState{
 		Size:     size,
 		BackedUp: time.Now().Format(time.RFC3339),
 	}
 }
 
+// MarkMissing sets MissingSince to now unless it is already set, and returns
+// the time the source has been missing since
+func (f *FileState) MarkMissing(now time.Time) time.Time {
+	if since, err := time.Parse(time.RFC3339, f.MissingSince); err == nil {
+		return since
+	}
+	f.MissingSince = now.Format(time.RFC3339)
+	return now
+}
+
 func (s *State) RemoveFileState(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	delete(s.Files, path)
 }
 
 func (s *State) FileCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return len(s.Files)
 }
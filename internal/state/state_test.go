@@ -1,8 +1,10 @@
 package state
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -134,6 +136,37 @@ func TestFileWriteErrors(t *testing.T) {
 	}
 }
 
+func TestSaveReplacesStateAtomically(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	state := New()
+	state.SetFileState("/path/to/first.txt", 1)
+	if err := state.SaveTo(statePath); err != nil {
+		t.Fatalf("failed to save state: %v", err)
+	}
+	state.SetFileState("/path/to/second.txt", 2)
+	if err := state.SaveTo(statePath); err != nil {
+		t.Fatalf("failed to save state: %v", err)
+	}
+
+	loaded, err := LoadFrom(statePath)
+	if err != nil {
+		t.Fatalf("failed to load state: %v", err)
+	}
+	if loaded.FileCount() != 2 {
+		t.Errorf("expected 2 files, got %d", loaded.FileCount())
+	}
+
+	// Only the state file remains, no temp files
+	entries, _ := os.ReadDir(filepath.Dir(statePath))
+	if len(entries) != 1 {
+		t.Errorf("expected only the state file, found %d entries", len(entries))
+	}
+	if info, err := os.Stat(statePath); err == nil && info.Mode().Perm() != 0o600 {
+		t.Errorf("expected state file mode 0600, got %v", info.Mode().Perm())
+	}
+}
+
 func TestSetAndGetFileState(t *testing.T) {
 	state := New()
 
@@ -190,30 +223,26 @@ func TestRemoveFileState(t *testing.T) {
 	}
 }
 
-func TestLastRunUpdatedOnSave(t *testing.T) {
+func TestLastRunPersistedOnSave(t *testing.T) {
 	tmpDir := t.TempDir()
 	statePath := filepath.Join(tmpDir, "state.json")
 
 	state := New()
 
-	// LastRun should be zero initially
-	if !state.LastRun.IsZero() {
-		t.Error("LastRun should be zero initially")
-	}
-
-	// Save state
-	before := time.Now()
+	// A save alone, e.g. a checkpoint, doesn't count as a run
 	if err := state.SaveTo(statePath); err != nil {
 		t.Fatalf("failed to save state: %v", err)
 	}
-	after := time.Now()
+	if !state.LastRun.IsZero() {
+		t.Error("LastRun should stay zero until it is set")
+	}
 
-	// LastRun should be updated
-	if state.LastRun.IsZero() {
-		t.Error("LastRun should not be zero after save")
+	lastRun := time.Now().Truncate(time.Second)
+	if err := state.SetLastRun(lastRun); err != nil {
+		t.Fatal(err)
 	}
-	if state.LastRun.Before(before) || state.LastRun.After(after) {
-		t.Error("LastRun timestamp is outside expected range")
+	if err := state.SaveTo(statePath); err != nil {
+		t.Fatalf("failed to save state: %v", err)
 	}
 
 	// Load state and verify LastRun persisted
@@ -221,7 +250,35 @@ func TestLastRunUpdatedOnSave(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to load state: %v", err)
 	}
-	if loadedState.LastRun.IsZero() {
-		t.Error("LastRun should not be zero in loaded state")
+	if !loadedState.LastRun.Equal(lastRun) {
+		t.Errorf("expected LastRun %v in loaded state, got %v", lastRun, loadedState.LastRun)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	state := New()
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("/path/to/file%d.txt", i)
+			state.SetFileState(path, int64(i))
+			if _, exists := state.GetFileState(path); !exists {
+				t.Errorf("expected state for %s", path)
+			}
+			if i%10 == 0 {
+				if err := state.SaveTo(statePath); err != nil {
+					t.Errorf("failed to save state: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if state.FileCount() != 50 {
+		t.Errorf("expected 50 files, got %d", state.FileCount())
 	}
 }
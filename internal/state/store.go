@@ -0,0 +1,256 @@
+package state
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Store keeps the state of every backed up file between runs. Implementations
+// are safe for concurrent use. Changes reach disk no later than Save.
+type Store interface {
+	Get(path string) (FileState, bool, error)
+	Put(path string, fileState FileState) error
+	Delete(path string) error
+	// Update runs fn in a transaction. When fn returns an error none of its
+	// changes are kept.
+	Update(fn func(tx Tx) error) error
+	// Walk calls fn for every entry whose path starts with prefix, in path
+	// order. fn may call Put and Delete.
+	Walk(prefix string, fn func(path string, fileState FileState) error) error
+	Stats() (Stats, error)
+	// SetLastRun records when the last complete backup ran, persisted by the
+	// next Save
+	SetLastRun(t time.Time) error
+	// Save persists all changes
+	Save() error
+	Close() error
+}
+
+// Tx reads and writes entries within Store.Update
+type Tx interface {
+	Get(path string) (FileState, bool, error)
+	Put(path string, fileState FileState) error
+	Delete(path string) error
+}
+
+// Stats summarizes a store for `m_backuper status`
+type Stats struct {
+	LastRun   time.Time
+	Files     int
+	TotalSize int64
+}
+
+// Backends accepted by the state_backend config key
+const (
+	BackendJSON = "json"
+	BackendBolt = "bolt"
+)
+
+// Open opens the state at path with the given backend. The bolt backend
+// replaces the extension of path with .db, and a new database starts out with
+// the entries of the JSON state file next to it, if any.
+func Open(backend, path string) (Store, error) {
+	switch backend {
+	case BackendJSON, "":
+		return LoadFrom(path)
+	case BackendBolt:
+		base := strings.TrimSuffix(path, filepath.Ext(path))
+		return OpenBoltMigrating(base+".db", base+".json")
+	default:
+		return nil, fmt.Errorf("unknown state backend %q (expected json or bolt)", backend)
+	}
+}
+
+// OpenReadOnly opens the state at path for commands that only read it, like
+// Open but without creating or migrating anything. A bolt database that
+// doesn't exist yet is read from the JSON state file next to it, if any.
+func OpenReadOnly(backend, path string) (Store, error) {
+	switch backend {
+	case BackendJSON, "":
+		return LoadFrom(path)
+	case BackendBolt:
+		base := strings.TrimSuffix(path, filepath.Ext(path))
+		if _, err := os.Stat(base + ".db"); os.IsNotExist(err) {
+			return LoadFrom(base + ".json")
+		}
+		return OpenBoltReadOnly(base + ".db")
+	default:
+		return nil, fmt.Errorf("unknown state backend %q (expected json or bolt)", backend)
+	}
+}
+
+// OpenBoltMigrating opens the bolt database at dbPath. If it doesn't exist
+// yet and jsonPath does, the JSON entries are imported once and the JSON
+// file is renamed so it isn't used by mistake.
+func OpenBoltMigrating(dbPath, jsonPath string) (*BoltStore, error) {
+	_, err := os.Stat(dbPath)
+	fresh := os.IsNotExist(err)
+
+	store, err := OpenBolt(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return store, nil
+	}
+	if _, err := os.Stat(jsonPath); err != nil {
+		return store, nil
+	}
+
+	if err := MigrateJSON(jsonPath, store); err != nil {
+		_ = store.Close()
+		// Don't leave a half-filled database that would skip the migration next time
+		_ = os.Remove(dbPath)
+		return nil, err
+	}
+	if err := os.Rename(jsonPath, jsonPath+".migrated"); err != nil {
+		_ = store.Close()
+		return nil, fmt.Errorf("failed to rename migrated state file: %w", err)
+	}
+	slog.Info("migrated state to database", "from", jsonPath, "to", dbPath)
+	return store, nil
+}
+
+// MigrateJSON copies every entry and the last run time of a JSON state file
+// into dst and saves it
+func MigrateJSON(jsonPath string, dst Store) error {
+	src, err := LoadFrom(jsonPath)
+	if err != nil {
+		return fmt.Errorf("failed to load state to migrate: %w", err)
+	}
+
+	err = dst.Update(func(tx Tx) error {
+		for path, fileState := range src.Files {
+			if err := tx.Put(path, fileState); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate state: %w", err)
+	}
+	if err := dst.SetLastRun(src.LastRun); err != nil {
+		return err
+	}
+	return dst.Save()
+}
+
+// Get returns the entry for path
+func (s *State) Get(path string) (FileState, bool, error) {
+	fileState, exists := s.GetFileState(path)
+	return fileState, exists, nil
+}
+
+// Put replaces the entry for path
+func (s *State) Put(path string, fileState FileState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Files[path] = fileState
+	return nil
+}
+
+// Delete removes the entry for path
+func (s *State) Delete(path string) error {
+	s.RemoveFileState(path)
+	return nil
+}
+
+// Update stages fn's changes and applies them once fn succeeds
+func (s *State) Update(fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &jsonTx{files: s.Files, changes: make(map[string]*FileState)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for path, fileState := range tx.changes {
+		if fileState == nil {
+			delete(s.Files, path)
+		} else {
+			s.Files[path] = *fileState
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for a copy of the matching entries, so fn may modify the state
+func (s *State) Walk(prefix string, fn func(path string, fileState FileState) error) error {
+	s.mu.RLock()
+	paths := make([]string, 0, len(s.Files))
+	for path := range s.Files {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	entries := make(map[string]FileState, len(paths))
+	for _, path := range paths {
+		entries[path] = s.Files[path]
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := fn(path, entries[path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *State) SetLastRun(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastRun = t
+	return nil
+}
+
+func (s *State) Stats() (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := Stats{LastRun: s.LastRun, Files: len(s.Files)}
+	for _, fileState := range s.Files {
+		stats.TotalSize += fileState.Size
+	}
+	return stats, nil
+}
+
+// Close does nothing, the JSON state holds no resources
+func (s *State) Close() error {
+	return nil
+}
+
+// jsonTx records changes without touching the state until Update commits them.
+// Update holds the state's lock for the whole transaction.
+type jsonTx struct {
+	files   map[string]FileState
+	changes map[string]*FileState // nil marks a deletion
+}
+
+func (tx *jsonTx) Get(path string) (FileState, bool, error) {
+	if fileState, changed := tx.changes[path]; changed {
+		if fileState == nil {
+			return FileState{}, false, nil
+		}
+		return *fileState, true, nil
+	}
+	fileState, exists := tx.files[path]
+	return fileState, exists, nil
+}
+
+func (tx *jsonTx) Put(path string, fileState FileState) error {
+	tx.changes[path] = &fileState
+	return nil
+}
+
+func (tx *jsonTx) Delete(path string) error {
+	tx.changes[path] = nil
+	return nil
+}
@@ -0,0 +1,341 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stores returns a fresh instance of every backend
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	bolt, err := OpenBolt(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("failed to open bolt store: %v", err)
+	}
+	t.Cleanup(func() { _ = bolt.Close() })
+
+	return map[string]Store{
+		BackendJSON: New(),
+		BackendBolt: bolt,
+	}
+}
+
+func TestStorePutGetDelete(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			want := FileState{Size: 1024, ModTime: 1700000000, Digest: "sha256:abc"}
+			if err := store.Put("/data/a.txt", want); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+
+			got, exists, err := store.Get("/data/a.txt")
+			if err != nil || !exists {
+				t.Fatalf("expected entry, got exists=%v err=%v", exists, err)
+			}
+			if got != want {
+				t.Errorf("expected %+v, got %+v", want, got)
+			}
+
+			if err := store.Delete("/data/a.txt"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if _, exists, _ := store.Get("/data/a.txt"); exists {
+				t.Error("expected entry to be deleted")
+			}
+		})
+	}
+}
+
+func TestStoreWalkPrefix(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, path := range []string{"/data/b.txt", "/data/a.txt", "/database/c.txt", "/other/d.txt"} {
+				if err := store.Put(path, FileState{Size: 1}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var paths []string
+			err := store.Walk("/data/", func(path string, _ FileState) error {
+				paths = append(paths, path)
+				// Changing the store during a walk must not disturb it
+				return store.Delete(path)
+			})
+			if err != nil {
+				t.Fatalf("Walk failed: %v", err)
+			}
+			if len(paths) != 2 || paths[0] != "/data/a.txt" || paths[1] != "/data/b.txt" {
+				t.Errorf("expected [/data/a.txt /data/b.txt], got %v", paths)
+			}
+
+			stats, err := store.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Files != 2 || stats.TotalSize != 2 {
+				t.Errorf("expected 2 files of 2 bytes left, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestStoreUpdateRollsBackOnError(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Put("/data/kept.txt", FileState{Size: 1}); err != nil {
+				t.Fatal(err)
+			}
+
+			errAbort := errors.New("abort")
+			err := store.Update(func(tx Tx) error {
+				if err := tx.Put("/data/new.txt", FileState{Size: 2}); err != nil {
+					return err
+				}
+				if err := tx.Delete("/data/kept.txt"); err != nil {
+					return err
+				}
+				if _, exists, _ := tx.Get("/data/new.txt"); !exists {
+					t.Error("expected transaction to see its own writes")
+				}
+				return errAbort
+			})
+			if !errors.Is(err, errAbort) {
+				t.Fatalf("expected abort error, got %v", err)
+			}
+
+			if _, exists, _ := store.Get("/data/new.txt"); exists {
+				t.Error("expected put of failed transaction to be discarded")
+			}
+			if _, exists, _ := store.Get("/data/kept.txt"); !exists {
+				t.Error("expected delete of failed transaction to be discarded")
+			}
+		})
+	}
+}
+
+func TestBoltStorePersistsOnSave(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	store, err := OpenBolt(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("/data/saved.txt", FileState{Size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetLastRun(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	// Changes after the last save are lost, like with the JSON state
+	if err := store.Put("/data/unsaved.txt", FileState{Size: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenBolt(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = store.Close() }()
+
+	if _, exists, _ := store.Get("/data/saved.txt"); !exists {
+		t.Error("expected saved entry after reopening")
+	}
+	if _, exists, _ := store.Get("/data/unsaved.txt"); exists {
+		t.Error("expected unsaved entry to be gone after reopening")
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LastRun.IsZero() {
+		t.Error("expected Save to record the last run it was given")
+	}
+}
+
+func TestBoltStoreFlushesFullBuffer(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	store, err := OpenBolt(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range flushEvery {
+		if err := store.Put(fmt.Sprintf("/data/%05d.txt", i), FileState{Size: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(store.pending); n != 0 {
+		t.Errorf("expected a full buffer to be committed, %d changes still buffered", n)
+	}
+	// Closed without Save, the committed batch is still there
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenBolt(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = store.Close() }()
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != flushEvery {
+		t.Errorf("expected %d entries after reopening, got %d", flushEvery, stats.Files)
+	}
+}
+
+func TestOpenBoltMigratingImportsJSONState(t *testing.T) {
+	tmpDir := t.TempDir()
+	jsonPath := filepath.Join(tmpDir, "state.json")
+	dbPath := filepath.Join(tmpDir, "state.db")
+
+	old := New()
+	if err := old.Put("/data/a.txt", FileState{Size: 1024, Digest: "sha256:abc"}); err != nil {
+		t.Fatal(err)
+	}
+	old.SetFileState("/data/b.txt", 2048)
+	lastRun := time.Now().Truncate(time.Second)
+	if err := old.SetLastRun(lastRun); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.SaveTo(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenBoltMigrating(dbPath, jsonPath)
+	if err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	defer func() { _ = store.Close() }()
+
+	got, exists, err := store.Get("/data/a.txt")
+	if err != nil || !exists {
+		t.Fatalf("expected migrated entry, got exists=%v err=%v", exists, err)
+	}
+	if got.Size != 1024 || got.Digest != "sha256:abc" {
+		t.Errorf("migrated entry lost fields: %+v", got)
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 2 {
+		t.Errorf("expected 2 migrated files, got %d", stats.Files)
+	}
+	if !stats.LastRun.Equal(lastRun) {
+		t.Errorf("expected last run %v to carry over, got %v", lastRun, stats.LastRun)
+	}
+
+	// The JSON file is set aside so it isn't migrated or used again
+	if _, err := os.Stat(jsonPath); !os.IsNotExist(err) {
+		t.Error("expected JSON state to be renamed")
+	}
+	if _, err := os.Stat(jsonPath + ".migrated"); err != nil {
+		t.Errorf("expected migrated JSON state to be kept: %v", err)
+	}
+}
+
+func TestOpenBoltFailsWhileInUse(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	store, err := OpenBolt(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = store.Close() }()
+
+	start := time.Now()
+	if _, err := OpenBolt(dbPath); err == nil {
+		t.Fatal("expected second open of the same database to fail")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("expected second open to give up quickly")
+	}
+}
+
+func TestOpenReadOnlyDoesNotMigrate(t *testing.T) {
+	tmpDir := t.TempDir()
+	jsonPath := filepath.Join(tmpDir, "state.json")
+
+	old := New()
+	old.SetFileState("/data/a.txt", 1024)
+	if err := old.SaveTo(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenReadOnly(BackendBolt, jsonPath)
+	if err != nil {
+		t.Fatalf("read-only open failed: %v", err)
+	}
+	defer func() { _ = store.Close() }()
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 1 {
+		t.Errorf("expected the JSON entry to be read, got %d files", stats.Files)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "state.db")); !os.IsNotExist(err) {
+		t.Error("expected no database to be created")
+	}
+	if _, err := os.Stat(jsonPath); err != nil {
+		t.Errorf("expected JSON state to stay in place: %v", err)
+	}
+}
+
+func TestOpenBoltReadOnlySharesTheDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	store, err := OpenBolt(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("/data/a.txt", FileState{Size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetLastRun(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := OpenBoltReadOnly(dbPath)
+	if err != nil {
+		t.Fatalf("read-only open failed: %v", err)
+	}
+	defer func() { _ = first.Close() }()
+	second, err := OpenBoltReadOnly(dbPath)
+	if err != nil {
+		t.Fatalf("second read-only open failed: %v", err)
+	}
+	defer func() { _ = second.Close() }()
+
+	for _, reader := range []*BoltStore{first, second} {
+		stats, err := reader.Stats()
+		if err != nil {
+			t.Fatalf("Stats failed: %v", err)
+		}
+		if stats.Files != 1 || stats.LastRun.IsZero() {
+			t.Errorf("expected 1 file and a last run, got %+v", stats)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Package testutil holds fixtures shared by the tests of several packages
+package testutil
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mackeper/m_backuper/internal/backup"
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/scanner"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+// SetupBackup writes files, keyed by their path relative to a new source
+// directory, and backs them up to a local backup root under deviceID. It
+// returns the source directory, the backup root and the state of the run,
+// which is saved in the same temporary directory.
+func SetupBackup(t *testing.T, deviceID string, files map[string]string, preserveMetadata bool) (srcDir, backupRoot string, st *state.State) {
+	t.Helper()
+
+	tmpDir := t.TempDir()
+	srcDir = filepath.Join(tmpDir, "src")
+	backupRoot = filepath.Join(tmpDir, "backup")
+
+	for name, content := range files {
+		path := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+	}
+
+	c := copier.NewLocalCopier(backupRoot)
+	c.SetPreserveMetadata(preserveMetadata)
+	st, err := state.LoadFrom(filepath.Join(tmpDir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := backup.New(scanner.New([]string{}), detector.NewSizeDetector(), c, st, deviceID)
+	b.SetPreserveMetadata(preserveMetadata)
+	if _, err := b.Run(context.Background(), []string{srcDir}, backupRoot); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	return srcDir, backupRoot, st
+}
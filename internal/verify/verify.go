@@ -0,0 +1,247 @@
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"path/filepath"
+	"sort"
+
+	"github.com/mackeper/m_backuper/internal/backup"
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/metadata"
+	"github.com/mackeper/m_backuper/internal/restore"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+// Problem describes a single file that failed verification
+type Problem struct {
+	Path     string // original source path
+	Expected int64  // size recorded in state
+	Actual   int64  // size found at the destination
+}
+
+//nolint:govet // fieldalignment: field order optimized for readability
+type Result struct {
+	Total     int // entries in state, less those a snapshot can't hold
+	Checked   int // entries actually checked (less than Total when sampling)
+	OK        int
+	Missing   []Problem
+	Truncated []Problem // destination smaller than recorded size
+	Mismatch  []Problem // destination larger than recorded size
+	Corrupt   []Problem // size matches but the digest doesn't, or a link points elsewhere
+	Extra     []string  // destination files with no state entry (full runs only)
+}
+
+// Failed reports whether any problem was found
+func (r *Result) Failed() bool {
+	return len(r.Missing) > 0 || len(r.Truncated) > 0 || len(r.Mismatch) > 0 ||
+		len(r.Corrupt) > 0 || len(r.Extra) > 0
+}
+
+//nolint:govet // fieldalignment: field order optimized for readability
+type Options struct {
+	// SamplePercent in (0, 100) checks a random subset and skips the scan for
+	// extra files; 0 or 100 and above checks everything
+	SamplePercent float64
+	// Checksums re-hashes destination files whose state entry has a digest
+	Checksums bool
+	// Snapshot checks the named snapshot instead of the mirror
+	Snapshot string
+}
+
+type Verify struct {
+	restorer   copier.Restorer
+	state      state.Store
+	backupRoot string
+	deviceID   string
+}
+
+func New(r copier.Restorer, st state.Store, backupRoot, deviceID string) *Verify {
+	return &Verify{
+		restorer:   r,
+		state:      st,
+		backupRoot: backupRoot,
+		deviceID:   deviceID,
+	}
+}
+
+// Run checks state entries against the destination
+func (v *Verify) Run(opts Options) (*Result, error) {
+	entries := make(map[string]state.FileState)
+	err := v.state.Walk("", func(path string, fileState state.FileState) error {
+		// A file in its deletion grace period is still in the mirror, but
+		// snapshots taken since it went missing don't contain it
+		if opts.Snapshot != "" && fileState.MissingSince != "" {
+			return nil
+		}
+		entries[path] = fileState
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state: %w", err)
+	}
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	result := &Result{Total: len(paths)}
+	fullRun := opts.SamplePercent <= 0 || opts.SamplePercent >= 100
+	if !fullRun {
+		paths = sample(paths, opts.SamplePercent)
+	}
+	slog.Info("starting verify", "device_id", v.deviceID, "snapshot", opts.Snapshot,
+		"entries", result.Total, "checking", len(paths))
+
+	deviceRoot := filepath.Join(v.backupRoot, v.deviceID)
+	if opts.Snapshot != "" {
+		deviceRoot = backup.SnapshotRoot(v.backupRoot, v.deviceID, opts.Snapshot)
+	}
+
+	// Links the destination can't hold are in the sidecar
+	sidecar, err := backup.LoadSidecar(v.restorer, deviceRoot)
+	if err != nil {
+		slog.Warn("failed to load metadata sidecar", "error", err)
+	}
+
+	// On a full run, walk the destination once instead of a stat per file
+	var found map[string]fs.FileInfo
+	if fullRun {
+		var err error
+		if found, err = v.walkDestination(deviceRoot); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range paths {
+		fileState := entries[path]
+		destPath := filepath.Join(deviceRoot, path)
+
+		if fileState.LinkTarget != "" {
+			delete(found, path)
+			result.Checked++
+			switch target, ok := v.readLink(destPath, path, sidecar); {
+			case !ok:
+				result.Missing = append(result.Missing, Problem{Path: path, Expected: fileState.Size})
+			case target != fileState.LinkTarget:
+				result.Corrupt = append(result.Corrupt, Problem{Path: path, Expected: fileState.Size, Actual: int64(len(target))})
+			default:
+				result.OK++
+			}
+			continue
+		}
+
+		var info fs.FileInfo
+		if fullRun {
+			info = found[path]
+			delete(found, path)
+		} else if stat, err := v.restorer.Stat(destPath); err == nil {
+			info = stat
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("failed to stat destination file", "path", destPath, "error", err)
+		}
+
+		result.Checked++
+		switch {
+		case info == nil:
+			result.Missing = append(result.Missing, Problem{Path: path, Expected: fileState.Size})
+		case info.Size() < fileState.Size:
+			result.Truncated = append(result.Truncated, Problem{Path: path, Expected: fileState.Size, Actual: info.Size()})
+		case info.Size() > fileState.Size:
+			result.Mismatch = append(result.Mismatch, Problem{Path: path, Expected: fileState.Size, Actual: info.Size()})
+		case opts.Checksums && fileState.Digest != "" && !v.digestMatches(destPath, fileState.Digest):
+			result.Corrupt = append(result.Corrupt, Problem{Path: path, Expected: fileState.Size, Actual: info.Size()})
+		default:
+			result.OK++
+		}
+	}
+
+	for path := range found {
+		result.Extra = append(result.Extra, path)
+	}
+	sort.Strings(result.Extra)
+
+	slog.Info("verify complete",
+		"checked", result.Checked,
+		"ok", result.OK,
+		"missing", len(result.Missing),
+		"truncated", len(result.Truncated),
+		"mismatch", len(result.Mismatch),
+		"corrupt", len(result.Corrupt),
+		"extra", len(result.Extra),
+	)
+	return result, nil
+}
+
+// digestMatches hashes a destination file with the algorithm of the recorded digest
+func (v *Verify) digestMatches(destPath, expected string) bool {
+	f, err := v.restorer.Open(destPath)
+	if err != nil {
+		slog.Warn("failed to open destination file", "path", destPath, "error", err)
+		return false
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("failed to close destination file", "path", destPath, "error", err)
+		}
+	}()
+
+	digest, err := detector.ReaderDigest(f, detector.DigestAlgorithm(expected))
+	if err != nil {
+		slog.Warn("failed to hash destination file", "path", destPath, "error", err)
+		return false
+	}
+	return digest == expected
+}
+
+// readLink returns the target of a link in the backup, from the sidecar
+// when the destination can't hold links
+func (v *Verify) readLink(destPath, path string, sidecar *metadata.Sidecar) (string, bool) {
+	symlinker, ok := v.restorer.(copier.Symlinker)
+	if !ok {
+		target := sidecar.Link(path)
+		return target, target != ""
+	}
+	target, err := symlinker.Readlink(destPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("failed to read link", "path", destPath, "error", err)
+	}
+	return target, err == nil
+}
+
+// walkDestination returns every file under deviceRoot keyed by its original
+// source path
+func (v *Verify) walkDestination(deviceRoot string) (map[string]fs.FileInfo, error) {
+	found := make(map[string]fs.FileInfo)
+
+	err := v.restorer.Walk(deviceRoot, func(path string, info fs.FileInfo) error {
+		rel, err := filepath.Rel(deviceRoot, path)
+		if err != nil {
+			return err
+		}
+		found[restore.OriginalPath(rel)] = info
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to walk backup %s: %w", deviceRoot, err)
+	}
+	return found, nil
+}
+
+// sample picks a random percentage of paths, always at least one
+func sample(paths []string, percent float64) []string {
+	n := int(float64(len(paths)) * percent / 100)
+	if n < 1 && len(paths) > 0 {
+		n = 1
+	}
+	//nolint:gosec // sampling does not need a cryptographic source
+	rand.Shuffle(len(paths), func(i, j int) { paths[i], paths[j] = paths[j], paths[i] })
+	picked := paths[:n]
+	sort.Strings(picked)
+	return picked
+}
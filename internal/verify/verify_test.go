@@ -0,0 +1,241 @@
+package verify
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mackeper/m_backuper/internal/backup"
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/scanner"
+	"github.com/mackeper/m_backuper/internal/state"
+	"github.com/mackeper/m_backuper/internal/testutil"
+)
+
+const deviceID = "test-device"
+
+func TestVerifyIntactBackup(t *testing.T) {
+	_, backupRoot, st := testutil.SetupBackup(t, deviceID, map[string]string{
+		"file1.txt":        "content 1",
+		"subdir/file2.txt": "content 2",
+	}, false)
+
+	result, err := New(copier.NewLocalCopier(backupRoot), st, backupRoot, deviceID).Run(Options{Checksums: true})
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+
+	if result.Failed() {
+		t.Errorf("expected no problems, got %+v", result)
+	}
+	if result.Checked != 2 || result.OK != 2 {
+		t.Errorf("expected 2 checked and 2 OK, got %d checked and %d OK", result.Checked, result.OK)
+	}
+}
+
+func TestVerifyReportsMissingTruncatedAndExtra(t *testing.T) {
+	srcDir, backupRoot, st := testutil.SetupBackup(t, deviceID, map[string]string{
+		"missing.txt":   "will be deleted",
+		"truncated.txt": "will be truncated",
+		"grown.txt":     "will grow",
+		"ok.txt":        "untouched",
+	}, false)
+
+	destOf := func(name string) string {
+		return filepath.Join(backupRoot, deviceID, srcDir, name)
+	}
+	if err := os.Remove(destOf("missing.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(destOf("truncated.txt"), []byte("will"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(destOf("grown.txt"), []byte("will grow a lot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(destOf("extra.txt"), []byte("not in state"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := New(copier.NewLocalCopier(backupRoot), st, backupRoot, deviceID).Run(Options{Checksums: true})
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+
+	if !result.Failed() {
+		t.Fatal("expected verify to report problems")
+	}
+	if len(result.Missing) != 1 || result.Missing[0].Path != filepath.Join(srcDir, "missing.txt") {
+		t.Errorf("expected missing.txt to be missing, got %+v", result.Missing)
+	}
+	if len(result.Truncated) != 1 || result.Truncated[0].Actual != 4 {
+		t.Errorf("expected truncated.txt to be truncated to 4 bytes, got %+v", result.Truncated)
+	}
+	if len(result.Mismatch) != 1 {
+		t.Errorf("expected one size mismatch, got %+v", result.Mismatch)
+	}
+	if len(result.Extra) != 1 || result.Extra[0] != filepath.Join(srcDir, "extra.txt") {
+		t.Errorf("expected extra.txt to be reported as extra, got %v", result.Extra)
+	}
+	if result.OK != 1 {
+		t.Errorf("expected 1 OK file, got %d", result.OK)
+	}
+}
+
+func TestVerifyDetectsCorruptionWithDigest(t *testing.T) {
+	srcDir, backupRoot, st := testutil.SetupBackup(t, deviceID, map[string]string{"file.txt": "original content"}, false)
+
+	srcFile := filepath.Join(srcDir, "file.txt")
+	digest, err := detector.FileDigest(srcFile, detector.DefaultHashAlgorithm)
+	if err != nil {
+		t.Fatalf("failed to hash source file: %v", err)
+	}
+	fileState, _ := st.GetFileState(srcFile)
+	fileState.Digest = digest
+	if err := st.Put(srcFile, fileState); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size, different content
+	destFile := filepath.Join(backupRoot, deviceID, srcFile)
+	if err := os.WriteFile(destFile, []byte("ORIGINAL CONTENT"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v := New(copier.NewLocalCopier(backupRoot), st, backupRoot, deviceID)
+
+	result, err := v.Run(Options{Checksums: true})
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if len(result.Corrupt) != 1 {
+		t.Errorf("expected 1 corrupt file, got %+v", result.Corrupt)
+	}
+
+	// Without checksums only the size is compared
+	result, err = v.Run(Options{})
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if result.Failed() {
+		t.Errorf("expected no problems without checksums, got %+v", result)
+	}
+}
+
+func TestVerifyChecksLinkTargets(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	backupRoot := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(srcDir, "current")
+	if err := os.Symlink("real.txt", link); err != nil {
+		t.Skip("symlink creation not supported on this platform")
+	}
+
+	st := state.New()
+	s := scanner.New([]string{})
+	s.SetSymlinks(scanner.SymlinksPreserve)
+	c := copier.NewLocalCopier(backupRoot)
+	if _, err := backup.New(s, detector.NewSizeDetector(), c, st, deviceID).Run(context.Background(), []string{srcDir}, backupRoot); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	v := New(c, st, backupRoot, deviceID)
+	result, err := v.Run(Options{})
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if result.Failed() || result.OK != 1 {
+		t.Errorf("expected the link to check out, got %+v", result)
+	}
+
+	// A link pointing elsewhere is corrupt, though its size is the same
+	if err := c.Symlink("real.bak", filepath.Join(backupRoot, deviceID, link)); err != nil {
+		t.Fatal(err)
+	}
+	result, err = v.Run(Options{})
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if len(result.Corrupt) != 1 || len(result.Extra) != 0 {
+		t.Errorf("expected the link to be corrupt, got %+v", result)
+	}
+}
+
+func TestVerifySnapshotSkipsFilesInGracePeriod(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	backupRoot := filepath.Join(tmpDir, "backup")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"kept.txt", "deleted.txt"} {
+		if err := os.WriteFile(filepath.Join(srcDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := state.New()
+	c := copier.NewLocalCopier(backupRoot)
+	b := backup.New(scanner.New([]string{}), detector.NewSizeDetector(), c, st, deviceID)
+	b.SetSnapshots(true)
+	b.SetDeletionPolicy(backup.DeletionKeep, time.Hour)
+	if _, err := b.Run(context.Background(), []string{srcDir}, backupRoot); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(srcDir, "deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+	backupResult, err := b.Run(context.Background(), []string{srcDir}, backupRoot)
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	// The deleted file keeps its state entry until the grace period is over,
+	// but the new snapshot doesn't hold it
+	result, err := New(c, st, backupRoot, deviceID).Run(Options{Snapshot: backupResult.Snapshot})
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if result.Failed() {
+		t.Errorf("expected no problems, got %+v", result)
+	}
+	if result.Total != 1 || result.OK != 1 {
+		t.Errorf("expected 1 entry checked OK, got %+v", result)
+	}
+}
+
+func TestVerifySampling(t *testing.T) {
+	files := make(map[string]string)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		files[name+".txt"] = name
+	}
+	_, backupRoot, st := testutil.SetupBackup(t, deviceID, files, false)
+
+	result, err := New(copier.NewLocalCopier(backupRoot), st, backupRoot, deviceID).Run(Options{SamplePercent: 30, Checksums: true})
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+
+	if result.Total != 10 {
+		t.Errorf("expected 10 total entries, got %d", result.Total)
+	}
+	if result.Checked != 3 {
+		t.Errorf("expected 3 entries checked with 30%% sample, got %d", result.Checked)
+	}
+	if result.Failed() {
+		t.Errorf("expected no problems, got %+v", result)
+	}
+}
+
+func TestSampleAlwaysPicksAtLeastOne(t *testing.T) {
+	picked := sample([]string{"a", "b", "c"}, 1)
+	if len(picked) != 1 {
+		t.Errorf("expected 1 path picked, got %d", len(picked))
+	}
+}
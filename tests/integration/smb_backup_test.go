@@ -3,6 +3,7 @@
 package integration
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
@@ -70,7 +71,7 @@ func TestSMBBackupFullFlow(t *testing.T) {
 	b := backup.New(s, d, c, st, deviceID)
 
 	t.Log("Starting backup to SMB share...")
-	if err := b.Run([]string{srcDir}, dstDir); err != nil {
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
 		t.Fatalf("Backup failed: %v", err)
 	}
 	t.Log("Backup completed successfully")
@@ -127,7 +128,7 @@ func TestSMBBackupIncremental(t *testing.T) {
 	// First backup
 	b1 := backup.New(s, d, c, st, deviceID)
 	t.Log("Running initial backup...")
-	if err := b1.Run([]string{srcDir}, dstDir); err != nil {
+	if _, err := b1.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
 		t.Fatalf("Initial backup failed: %v", err)
 	}
 
@@ -142,7 +143,7 @@ func TestSMBBackupIncremental(t *testing.T) {
 	// Second backup (incremental)
 	b2 := backup.New(s, d, c, st, deviceID)
 	t.Log("Running incremental backup...")
-	if err := b2.Run([]string{srcDir}, dstDir); err != nil {
+	if _, err := b2.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
 		t.Fatalf("Incremental backup failed: %v", err)
 	}
 
@@ -201,7 +202,7 @@ func TestSMBBackupWithIgnorePatterns(t *testing.T) {
 	// Run backup
 	b := backup.New(s, d, c, st, deviceID)
 	t.Log("Running backup with ignore patterns...")
-	if err := b.Run([]string{srcDir}, dstDir); err != nil {
+	if _, err := b.Run(context.Background(), []string{srcDir}, dstDir); err != nil {
 		t.Fatalf("Backup failed: %v", err)
 	}
 
@@ -0,0 +1,177 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mackeper/m_backuper/internal/backup"
+	"github.com/mackeper/m_backuper/internal/copier"
+	"github.com/mackeper/m_backuper/internal/detector"
+	"github.com/mackeper/m_backuper/internal/scanner"
+	"github.com/mackeper/m_backuper/internal/state"
+)
+
+// smbRoot builds a UNC backup root from the SMB_HOST and SMB_SHARE variables
+// set in docker-compose.test.yml
+func smbRoot(t *testing.T, dir string) string {
+	t.Helper()
+
+	host := os.Getenv("SMB_HOST")
+	share := os.Getenv("SMB_SHARE")
+	if host == "" || share == "" {
+		t.Fatal("SMB_HOST and SMB_SHARE environment variables must be set")
+	}
+	return "//" + host + "/" + share + "/" + dir
+}
+
+func TestSMBCopierDirectCopy(t *testing.T) {
+	root := smbRoot(t, "smb-copier-test")
+	t.Logf("Using SMB root: %s", root)
+
+	c, err := copier.NewSMBCopier(root, os.Getenv("SMB_USER"), os.Getenv("SMB_PASS"))
+	if err != nil {
+		t.Fatalf("Failed to connect to SMB share: %v", err)
+	}
+	defer c.Close()
+
+	srcFile := filepath.Join(t.TempDir(), "file.txt")
+	content := []byte("copied over SMB without a mount")
+	if err := os.WriteFile(srcFile, content, 0o644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	n, err := c.Copy(context.Background(), srcFile, filepath.Join(root, "nested", "dir", "file.txt"))
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if n != int64(len(content)) {
+		t.Errorf("Copied %d bytes, expected %d", n, len(content))
+	}
+
+	// When the share is also mounted, verify the content through the mount
+	if smbMount := os.Getenv("SMB_MOUNT"); smbMount != "" {
+		dstDir := filepath.Join(smbMount, "smb-copier-test")
+		defer os.RemoveAll(dstDir)
+
+		got, err := os.ReadFile(filepath.Join(dstDir, "nested", "dir", "file.txt"))
+		if err != nil {
+			t.Fatalf("Failed to read copied file through mount: %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("Content mismatch:\nGot: %q\nExpected: %q", got, content)
+		}
+	}
+}
+
+func TestSMBCopierReplacesExistingFile(t *testing.T) {
+	root := smbRoot(t, "smb-copier-replace")
+
+	c, err := copier.NewSMBCopier(root, os.Getenv("SMB_USER"), os.Getenv("SMB_PASS"))
+	if err != nil {
+		t.Fatalf("Failed to connect to SMB share: %v", err)
+	}
+	defer c.Close()
+
+	srcFile := filepath.Join(t.TempDir(), "file.txt")
+	dst := filepath.Join(root, "file.txt")
+	for _, content := range []string{"first version", "second, longer version"} {
+		if err := os.WriteFile(srcFile, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+		if _, err := c.Copy(context.Background(), srcFile, dst); err != nil {
+			t.Fatalf("Copy failed: %v", err)
+		}
+	}
+
+	f, err := c.Open(dst)
+	if err != nil {
+		t.Fatalf("Failed to open copied file: %v", err)
+	}
+	defer f.Close()
+	var got bytes.Buffer
+	if _, err := got.ReadFrom(f); err != nil {
+		t.Fatalf("Failed to read copied file: %v", err)
+	}
+	if got.String() != "second, longer version" {
+		t.Errorf("Expected the second version, got %q", got.String())
+	}
+
+	// No temp files are left next to the target
+	entries, err := c.ReadDir(root)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	for _, entry := range entries {
+		if copier.IsTempFile(entry.Name()) {
+			t.Errorf("Leftover temp file %s", entry.Name())
+		}
+	}
+}
+
+func TestSMBCopierBadCredentials(t *testing.T) {
+	root := smbRoot(t, "smb-copier-test")
+
+	if _, err := copier.NewSMBCopier(root, "nosuchuser", "wrongpass"); err == nil {
+		t.Error("Expected authentication error with bad credentials, got nil")
+	}
+}
+
+func TestSMBCopierBackupFlow(t *testing.T) {
+	root := smbRoot(t, "smb-copier-backup")
+
+	srcDir := t.TempDir()
+	testFiles := map[string]string{
+		"file1.txt":        "content of file 1",
+		"subdir/file2.txt": "content of file 2 in subdirectory",
+	}
+	for relPath, content := range testFiles {
+		fullPath := filepath.Join(srcDir, relPath)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	c, err := copier.NewSMBCopier(root, os.Getenv("SMB_USER"), os.Getenv("SMB_PASS"))
+	if err != nil {
+		t.Fatalf("Failed to connect to SMB share: %v", err)
+	}
+	defer c.Close()
+
+	st := state.New()
+	deviceID := "smb-copier-device"
+	b := backup.New(scanner.New([]string{}), detector.NewSizeDetector(), c, st, deviceID)
+
+	t.Log("Starting backup over direct SMB connection...")
+	if _, err := b.Run(context.Background(), []string{srcDir}, root); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	if st.FileCount() != len(testFiles) {
+		t.Errorf("State file count = %d, expected %d", st.FileCount(), len(testFiles))
+	}
+
+	if smbMount := os.Getenv("SMB_MOUNT"); smbMount != "" {
+		dstDir := filepath.Join(smbMount, "smb-copier-backup")
+		defer os.RemoveAll(dstDir)
+
+		for relPath, expected := range testFiles {
+			backupPath := filepath.Join(dstDir, deviceID, srcDir, relPath)
+			got, err := os.ReadFile(backupPath)
+			if err != nil {
+				t.Errorf("Failed to read backed up file %s: %v", backupPath, err)
+				continue
+			}
+			if string(got) != expected {
+				t.Errorf("Content mismatch for %s:\nGot: %q\nExpected: %q", relPath, got, expected)
+			}
+		}
+	}
+}